@@ -0,0 +1,192 @@
+// Package control serves an HTTP/JSON API for inspecting and controlling a running monitor.
+//
+//	GET    /watchlist             lists the watchlist
+//	PUT    /watchlist/{fileId}    adds the id to the watchlist, with the watch options in the body if any
+//	DELETE /watchlist/{fileId}    removes the id from the watchlist, keeping its history
+//	POST   /sweep                 evaluates the watchlist now, returning once every id has been resolved
+//	GET    /files/{fileId}        shows the file's current version and state in the cache
+//	GET    /versions/{fileId}     lists the file's copied versions, or with ?at=<ms> the one current then
+//	POST   /restore/{fileId}      restores the file to the version current at ?at=<ms>
+//	GET    /stats                 shows the value of every metric
+//	GET    /health                shows the state of the pipeline; 503 if the monitor isn't running
+//
+// A FileId may contain slashes, so everything after the prefix is taken as the id.  The API has no
+// authentication, and can restore files over their current content, so it should only be served where
+// every client is trusted.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/metrics"
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/jsfinn/enfi-assessment/monitor"
+)
+
+// maxBodyBytes caps the size of a request body, which is only ever a small set of watch options
+const maxBodyBytes = 64 << 10
+
+type server struct {
+	monitor  *monitor.Monitor
+	registry *metrics.Registry
+}
+
+// NewServer returns the handler for the control API of the given monitor, reporting the metrics in registry
+func NewServer(m *monitor.Monitor, registry *metrics.Registry) http.Handler {
+	s := &server{monitor: m, registry: registry}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /watchlist", s.getWatchlist)
+	mux.HandleFunc("PUT /watchlist/{fileId...}", s.addToWatchlist)
+	mux.HandleFunc("DELETE /watchlist/{fileId...}", s.removeFromWatchlist)
+	mux.HandleFunc("POST /sweep", s.sweep)
+	mux.HandleFunc("GET /files/{fileId...}", s.getFile)
+	mux.HandleFunc("GET /versions/{fileId...}", s.getVersions)
+	mux.HandleFunc("POST /restore/{fileId...}", s.restore)
+	mux.HandleFunc("GET /stats", s.getStats)
+	mux.HandleFunc("GET /health", s.getHealth)
+	return mux
+}
+
+// watchlistResponse lists the entries of the watchlist, each as just its id unless it has watch options
+type watchlistResponse struct {
+	Watchlist []model.WatchEntry `json:"watchlist"`
+}
+
+func (s *server) getWatchlist(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, watchlistResponse{Watchlist: s.monitor.WatchEntries()})
+}
+
+// addToWatchlist adds the id, replacing its options if it's already in the watchlist.  Without a body, the
+// whole tree beneath the id is watched.
+func (s *server) addToWatchlist(w http.ResponseWriter, r *http.Request) {
+	entry := model.WatchEntry{Id: model.FileId(r.PathValue("fileId"))}
+	body := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	var tooLarge *http.MaxBytesError
+	if err := json.NewDecoder(body).Decode(&entry.WatchOptions); errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.monitor.Watch(entry); errors.Is(err, monitor.ErrInvalidWatchOptions) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, watchlistResponse{Watchlist: s.monitor.WatchEntries()})
+}
+
+func (s *server) removeFromWatchlist(w http.ResponseWriter, r *http.Request) {
+	if err := s.monitor.RemoveFromWatchlist(model.FileId(r.PathValue("fileId"))); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, watchlistResponse{Watchlist: s.monitor.WatchEntries()})
+}
+
+type sweepResponse struct {
+	DurationMs int64 `json:"durationMs"`
+}
+
+// sweep runs until every id has been resolved, or the request is cancelled
+func (s *server) sweep(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if err := s.monitor.EvaluateWatchlistContext(r.Context()); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sweepResponse{DurationMs: time.Since(start).Milliseconds()})
+}
+
+func (s *server) getFile(w http.ResponseWriter, r *http.Request) {
+	fileId := model.FileId(r.PathValue("fileId"))
+	status, found := s.monitor.FileStatus(fileId)
+	if !found {
+		writeError(w, http.StatusNotFound, model.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+type versionsResponse struct {
+	Versions []model.FileVersion `json:"versions"`
+}
+
+// getVersions lists every copied version of the file, or just the one current at the time given by at
+func (s *server) getVersions(w http.ResponseWriter, r *http.Request) {
+	fileId := model.FileId(r.PathValue("fileId"))
+	if !r.URL.Query().Has("at") {
+		writeJSON(w, http.StatusOK, versionsResponse{Versions: s.monitor.Versions(fileId)})
+		return
+	}
+	at, err := strconv.ParseInt(r.URL.Query().Get("at"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	version, found := s.monitor.VersionAt(fileId, at)
+	if !found {
+		writeError(w, http.StatusNotFound, monitor.ErrNoVersion)
+		return
+	}
+	writeJSON(w, http.StatusOK, version)
+}
+
+// restore restores the file to the version current at the time given by at, returning the version
+func (s *server) restore(w http.ResponseWriter, r *http.Request) {
+	at, err := strconv.ParseInt(r.URL.Query().Get("at"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	version, err := s.monitor.Restore(r.Context(), model.FileId(r.PathValue("fileId")), at)
+	switch {
+	case errors.Is(err, monitor.ErrNoVersion):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, monitor.ErrRestoreUnsupported):
+		writeError(w, http.StatusNotImplemented, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, version)
+	}
+}
+
+func (s *server) getStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.Values())
+}
+
+func (s *server) getHealth(w http.ResponseWriter, r *http.Request) {
+	health := s.monitor.Health()
+	status := http.StatusOK
+	if !health.Running {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/metrics"
+	"github.com/jsfinn/enfi-assessment/mock"
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/jsfinn/enfi-assessment/monitor"
+)
+
+// request sends a request to the handler and decodes the JSON response into body, returning the status
+func request(t *testing.T, handler http.Handler, method string, path string, body any) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	if body != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("%s %s: error decoding %q: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestServer(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("file1", "")
+	fp.AddFile("dir1/file2", "dir1")
+
+	registry := metrics.NewRegistry()
+	m := monitor.NewMonitor(monitor.AdaptApi(fp), []model.FileId{"file1"}, monitor.NewHistoryCache(), registry, monitor.DefaultOptions())
+	m.Start()
+	handler := NewServer(m, registry)
+
+	var watchlist watchlistResponse
+	if status := request(t, handler, "PUT", "/watchlist/dir1", &watchlist); status != http.StatusOK ||
+		!slices.Equal(model.WatchEntryIds(watchlist.Watchlist), []model.FileId{"dir1", "file1"}) {
+		t.Errorf("PUT /watchlist/dir1: got %d %v", status, watchlist.Watchlist)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("PUT", "/watchlist/dir1", strings.NewReader(`{"exclude": ["`+strings.Repeat("x", maxBodyBytes)+`"]}`)))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT /watchlist/dir1 with an oversized body: got %d, want 413", recorder.Code)
+	}
+
+	if status := request(t, handler, "POST", "/sweep", &sweepResponse{}); status != http.StatusOK {
+		t.Errorf("POST /sweep: got %d", status)
+	}
+	// the sweep returns once every file has been found, so wait for the copy it led to to be recorded
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		var versions versionsResponse
+		if request(t, handler, "GET", "/versions/dir1/file2", &versions); len(versions.Versions) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for dir1/file2 to be copied")
+		}
+	}
+
+	var file monitor.FileStatus
+	if status := request(t, handler, "GET", "/files/dir1/file2", &file); status != http.StatusOK ||
+		file.Version != 1 || file.WatchType != model.WatchTypeImplicit {
+		t.Errorf("GET /files/dir1/file2: got %d %+v", status, file)
+	}
+	if status := request(t, handler, "GET", "/files/missing", &errorResponse{}); status != http.StatusNotFound {
+		t.Errorf("GET /files/missing: got %d, want 404", status)
+	}
+
+	if status := request(t, handler, "DELETE", "/watchlist/file1", &watchlist); status != http.StatusOK ||
+		!slices.Equal(model.WatchEntryIds(watchlist.Watchlist), []model.FileId{"dir1"}) {
+		t.Errorf("DELETE /watchlist/file1: got %d %v", status, watchlist.Watchlist)
+	}
+
+	var versions versionsResponse
+	if status := request(t, handler, "GET", "/versions/dir1/file2", &versions); status != http.StatusOK ||
+		len(versions.Versions) != 1 || versions.Versions[0].Version != 1 {
+		t.Errorf("GET /versions/dir1/file2: got %d %+v", status, versions)
+	}
+	var version model.FileVersion
+	if status := request(t, handler, "GET", "/versions/dir1/file2?at="+strconv.FormatInt(time.Now().UnixMilli(), 10), &version); status != http.StatusOK ||
+		version.Version != 1 {
+		t.Errorf("GET /versions/dir1/file2?at=now: got %d %+v", status, version)
+	}
+	if status := request(t, handler, "GET", "/versions/dir1/file2?at=0", &errorResponse{}); status != http.StatusNotFound {
+		t.Errorf("GET /versions/dir1/file2?at=0: got %d, want 404", status)
+	}
+	if status := request(t, handler, "POST", "/restore/dir1/file2?at=now", &errorResponse{}); status != http.StatusBadRequest {
+		t.Errorf("POST /restore/dir1/file2?at=now: got %d, want 400", status)
+	}
+	if status := request(t, handler, "POST", "/restore/dir1/file2?at="+strconv.FormatInt(time.Now().UnixMilli(), 10), &version); status != http.StatusOK ||
+		version.Version != 1 {
+		t.Errorf("POST /restore/dir1/file2: got %d %+v", status, version)
+	}
+
+	var stats map[string]float64
+	if status := request(t, handler, "GET", "/stats", &stats); status != http.StatusOK || stats["evaluate_watchlist_calls"] != 1 {
+		t.Errorf("GET /stats: got %d %v", status, stats)
+	}
+
+	var health monitor.Health
+	if status := request(t, handler, "GET", "/health", &health); status != http.StatusOK || !health.Running ||
+		health.LastSweep == nil || !health.LastSweep.Complete {
+		t.Errorf("GET /health: got %d %+v", status, health)
+	}
+
+	m.ShutDown()
+	if status := request(t, handler, "GET", "/health", &health); status != http.StatusServiceUnavailable || health.Running {
+		t.Errorf("GET /health after shutdown: got %d %+v", status, health)
+	}
+}
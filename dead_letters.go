@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/metrics"
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/jsfinn/enfi-assessment/monitor"
+)
+
+const deadLettersUsage = "usage: dead-letters list | dead-letters replay [fileId ...]"
+
+// runDeadLetters inspects or replays the dead-letter store:
+//
+//	dead-letters list                  lists every copy that ran out of retries
+//	dead-letters replay [fileId ...]   retries the copies of the given files, or of every file
+func runDeadLetters(ctx context.Context, config *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(deadLettersUsage)
+	}
+	if config.DeadLetters.Type != "file" {
+		return errors.New("dead letters are only kept between runs when dead_letters.type is file")
+	}
+	store, err := newDeadLetterStore(config.DeadLetters)
+	if err != nil {
+		return fmt.Errorf("creating dead-letter store: %w", err)
+	}
+
+	switch args[0] {
+	case "list":
+		letters := store.List()
+		for _, letter := range letters {
+			kind := "copy"
+			if letter.Kind != monitor.DeadLetterCopy {
+				kind = string(letter.Kind)
+			}
+			fmt.Printf("%s\t%s version %d\tattempts %d\tfailed %s\t%s\n", letter.FileId, kind, letter.Version, letter.Attempts,
+				time.UnixMilli(letter.FailedAt).Format(time.RFC3339), letter.Error)
+		}
+		fmt.Printf("%d dead letters\n", len(letters))
+		return nil
+
+	case "replay":
+		api, _, _, err := newApi(ctx, config)
+		if err != nil {
+			return fmt.Errorf("creating provider: %w", err)
+		}
+		historyCache, err := newCache(config.Cache)
+		if err != nil {
+			return fmt.Errorf("creating cache: %w", err)
+		}
+		if closer, ok := historyCache.(io.Closer); ok {
+			defer func() {
+				if err := closer.Close(); err != nil {
+					log.Printf("Error closing cache: %v", err)
+				}
+			}()
+		}
+
+		// Replayed copies are recorded like any other, so they can be restored and pruned
+		versions, err := newVersionCatalog(config.Versions)
+		if err != nil {
+			return fmt.Errorf("creating version catalog: %w", err)
+		}
+		if closer, ok := versions.(io.Closer); ok {
+			defer func() {
+				if err := closer.Close(); err != nil {
+					log.Printf("Error closing version catalog: %v", err)
+				}
+			}()
+		}
+
+		fileIds := []model.FileId{}
+		for _, fileId := range args[1:] {
+			fileIds = append(fileIds, model.FileId(fileId))
+		}
+		m := monitor.NewMonitor(api, nil, historyCache, metrics.NewRegistry(), config.Monitor)
+		m.SetDeadLetterStore(store)
+		m.SetVersionCatalog(versions)
+		replayed := m.ReplayDeadLetters(ctx, fileIds...)
+		fmt.Printf("%d replayed, %d dead letters remaining\n", replayed, len(store.List()))
+		return nil
+
+	default:
+		return errors.New(deadLettersUsage)
+	}
+}
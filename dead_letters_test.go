@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/jsfinn/enfi-assessment/monitor"
+)
+
+func TestReplayRecordsVersions(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file1"), []byte("one"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Provider:    "local",
+		Local:       LocalConfig{Root: root, Destination: filepath.Join(dir, "copies")},
+		Cache:       CacheConfig{Type: "file", Directory: filepath.Join(dir, "history")},
+		DeadLetters: DeadLetterConfig{Type: "file", File: filepath.Join(dir, "dead_letters.json")},
+		Versions:    VersionsConfig{Type: "file", File: filepath.Join(dir, "versions.jsonl")},
+	}
+
+	// A previous run left version 1 of file1 pending and dead-lettered
+	cache, err := monitor.NewFileHistoryCache(config.Cache.Directory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, _ := cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 1000})
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := monitor.NewFileDeadLetterStore(config.DeadLetters.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(monitor.DeadLetter{FileId: "file1", LastModified: 1000, Version: version, Attempts: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runDeadLetters(context.Background(), config, []string{"replay"}); err != nil {
+		t.Fatalf("Error replaying: %v", err)
+	}
+
+	catalog, err := monitor.NewFileVersionCatalog(config.Versions.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	if versions := catalog.Versions("file1"); len(versions) != 1 || versions[0].Version != version {
+		t.Errorf("Versions of file1 after replay: got %+v, want version %d", versions, version)
+	}
+}
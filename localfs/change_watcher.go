@@ -0,0 +1,245 @@
+package localfs
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// changeWatcher is a monitor.ChangeSource that uses fsnotify (inotify on Linux) to report changes to the
+// files in a watchlist, using the same FileIds as fileSystemProvider.  Every directory beneath a watched
+// directory is watched, including directories created later.  A watched file is watched through its
+// parent directory, and notifications for the other files in that directory are ignored.  The monitor
+// keeps the watchlist up to date through UpdateWatchlist as it changes.
+type changeWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+
+	// mu guards the watchlist: directories are the watched directories, and files are the watched files
+	// outside of them
+	mu          sync.RWMutex
+	directories map[model.FileId]bool
+	files       map[model.FileId]bool
+
+	changes   chan model.FileId
+	overflows chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewChangeWatcher starts watching the files and directories in the watchlist, relative to root
+func NewChangeWatcher(root string, watchlist []model.FileId) (*changeWatcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &changeWatcher{
+		root:        root,
+		watcher:     watcher,
+		directories: make(map[model.FileId]bool),
+		files:       make(map[model.FileId]bool),
+		changes:     make(chan model.FileId, 1000),
+		overflows:   make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	cw.UpdateWatchlist(watchlist, nil)
+
+	go cw.run()
+	return cw, nil
+}
+
+// UpdateWatchlist starts watching the files and directories added to the watchlist, and stops watching
+// those removed from it.  Only the directories added are walked, so a change costs no more than the trees it
+// adds, and ids that are already watched are left as they are.
+func (cw *changeWatcher) UpdateWatchlist(added []model.FileId, removed []model.FileId) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	select {
+	case <-cw.done:
+		return
+	default:
+	}
+
+	for _, fileId := range removed {
+		delete(cw.directories, fileId)
+		delete(cw.files, fileId)
+	}
+	for _, fileId := range added {
+		if cw.directories[fileId] || cw.files[fileId] {
+			continue
+		}
+		filePath := filepath.Join(cw.root, filepath.FromSlash(string(fileId)))
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			cw.directories[fileId] = true
+			cw.addRecursive(filePath)
+			continue
+		}
+		// a file, or something that doesn't exist yet, is watched through its parent
+		cw.files[fileId] = true
+		if err := cw.watcher.Add(filepath.Dir(filePath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error watching %s: %v", filepath.Dir(filePath), err)
+		}
+	}
+	if len(removed) > 0 {
+		cw.removeUnneeded()
+	}
+}
+
+// removeUnneeded stops watching the directories the watchlist no longer needs: those that are neither a
+// watched directory nor beneath one, and don't hold a watched file.  Must be called with mu held.
+func (cw *changeWatcher) removeUnneeded() {
+	parents := make(map[string]bool, len(cw.files))
+	for fileId := range cw.files {
+		parents[filepath.Dir(filepath.Join(cw.root, filepath.FromSlash(string(fileId))))] = true
+	}
+	for _, path := range cw.watcher.WatchList() {
+		if fileId, ok := cw.fileId(path); parents[path] || (ok && (cw.directories[fileId] || cw.isBeneathDirectory(fileId))) {
+			continue
+		}
+		if err := cw.watcher.Remove(path); err != nil && !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+			log.Printf("Error no longer watching %s: %v", path, err)
+		}
+	}
+}
+
+func (cw *changeWatcher) Changes() <-chan model.FileId {
+	return cw.changes
+}
+
+func (cw *changeWatcher) Overflows() <-chan struct{} {
+	return cw.overflows
+}
+
+// Close stops watching and closes the changes channel
+func (cw *changeWatcher) Close() error {
+	var err error
+	cw.closeOnce.Do(func() {
+		close(cw.done)
+		err = cw.watcher.Close()
+	})
+	return err
+}
+
+// run translates fsnotify events into FileIds until the watcher is closed
+func (cw *changeWatcher) run() {
+	defer close(cw.changes)
+	for {
+		select {
+		case <-cw.done:
+			return
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+			cw.handleEvent(event)
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Any error means events may have been lost, most likely to a queue overflow
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				log.Printf("Error watching for changes: %v", err)
+			}
+			cw.signalOverflow()
+		}
+	}
+}
+
+func (cw *changeWatcher) handleEvent(event fsnotify.Event) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	fileId, ok := cw.fileId(event.Name)
+	if !ok {
+		return
+	}
+	cw.mu.RLock()
+	watched, beneath := cw.isWatched(fileId), cw.isBeneathDirectory(fileId)
+	cw.mu.RUnlock()
+	if !watched {
+		return
+	}
+
+	// A directory created beneath a watched directory needs watching too
+	if event.Has(fsnotify.Create) && beneath {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			cw.addRecursive(event.Name)
+		}
+	}
+
+	select {
+	case cw.changes <- fileId:
+	case <-cw.done:
+	}
+}
+
+// addRecursive watches the directory and every directory beneath it
+func (cw *changeWatcher) addRecursive(directoryPath string) {
+	filepath.WalkDir(directoryPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// removed while walking
+			return nil
+		}
+		if entry.IsDir() {
+			if err := cw.watcher.Add(path); err != nil {
+				log.Printf("Error watching %s: %v", path, err)
+				cw.signalOverflow()
+			}
+		}
+		return nil
+	})
+}
+
+// signalOverflow reports that changes may have been missed
+func (cw *changeWatcher) signalOverflow() {
+	select {
+	case cw.overflows <- struct{}{}:
+	default:
+	}
+}
+
+// fileId converts an absolute path beneath the root into a FileId
+func (cw *changeWatcher) fileId(path string) (model.FileId, bool) {
+	relative, err := filepath.Rel(cw.root, path)
+	if err != nil || !filepath.IsLocal(relative) {
+		return "", false
+	}
+	if relative == "." {
+		return "", true
+	}
+	return model.FileId(filepath.ToSlash(relative)), true
+}
+
+// isWatched returns whether the file is in the watchlist or beneath a directory that is.  Must be called
+// with mu held.
+func (cw *changeWatcher) isWatched(fileId model.FileId) bool {
+	return cw.files[fileId] || cw.directories[fileId] || cw.isBeneathDirectory(fileId)
+}
+
+// isBeneathDirectory returns whether the file is beneath a directory in the watchlist.  Must be called with
+// mu held.
+func (cw *changeWatcher) isBeneathDirectory(fileId model.FileId) bool {
+	if cw.directories[""] {
+		return true
+	}
+	for parent := string(fileId); strings.Contains(parent, "/"); {
+		parent = parent[:strings.LastIndex(parent, "/")]
+		if cw.directories[model.FileId(parent)] {
+			return true
+		}
+	}
+	return false
+}
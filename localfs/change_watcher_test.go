@@ -0,0 +1,101 @@
+package localfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// expectChange waits for the watcher to report the given id, skipping any other ids reported first
+func expectChange(t *testing.T, cw *changeWatcher, want model.FileId) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case fileId := <-cw.Changes():
+			if fileId == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change reported for %s", want)
+		}
+	}
+}
+
+func TestChangeWatcher(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "dir1", "dir2"), 0o755)
+	os.Mkdir(filepath.Join(root, "other"), 0o755)
+	os.WriteFile(filepath.Join(root, "other", "file1"), []byte("one"), 0o644)
+
+	cw, err := NewChangeWatcher(root, []model.FileId{"dir1", "other/file1"})
+	if err != nil {
+		t.Fatalf("Error creating watcher: %v", err)
+	}
+	defer cw.Close()
+
+	// a file in a subdirectory of a watched directory
+	os.WriteFile(filepath.Join(root, "dir1", "dir2", "file2"), []byte("two"), 0o644)
+	expectChange(t, cw, "dir1/dir2/file2")
+
+	// a file in a directory created after the watcher started, which is watched before it's reported
+	os.Mkdir(filepath.Join(root, "dir1", "dir3"), 0o755)
+	expectChange(t, cw, "dir1/dir3")
+	os.WriteFile(filepath.Join(root, "dir1", "dir3", "file3"), []byte("three"), 0o644)
+	expectChange(t, cw, "dir1/dir3/file3")
+
+	// an unwatched sibling of a watched file is ignored
+	os.WriteFile(filepath.Join(root, "other", "file4"), []byte("four"), 0o644)
+	os.WriteFile(filepath.Join(root, "other", "file1"), []byte("one, again"), 0o644)
+	timeout := time.After(2 * time.Second)
+	for reported := false; !reported; {
+		select {
+		case fileId := <-cw.Changes():
+			if fileId == "other/file4" {
+				t.Errorf("got change for unwatched file %s", fileId)
+			}
+			reported = fileId == "other/file1"
+		case <-timeout:
+			t.Fatalf("no change reported for other/file1")
+		}
+	}
+
+	cw.Close()
+	for range cw.Changes() {
+	}
+}
+
+func TestChangeWatcherFollowsWatchlist(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "dir1"), 0o755)
+	os.Mkdir(filepath.Join(root, "dir2"), 0o755)
+
+	cw, err := NewChangeWatcher(root, []model.FileId{"dir1"})
+	if err != nil {
+		t.Fatalf("Error creating watcher: %v", err)
+	}
+	defer cw.Close()
+
+	// a directory added to the watchlist is watched, and one removed from it no longer is
+	cw.UpdateWatchlist([]model.FileId{"dir2"}, []model.FileId{"dir1"})
+	if watching := cw.watcher.WatchList(); len(watching) != 1 || watching[0] != filepath.Join(root, "dir2") {
+		t.Errorf("watching %v, want only dir2", watching)
+	}
+	os.WriteFile(filepath.Join(root, "dir1", "file1"), []byte("one"), 0o644)
+	os.WriteFile(filepath.Join(root, "dir2", "file2"), []byte("two"), 0o644)
+	timeout := time.After(2 * time.Second)
+	for reported := false; !reported; {
+		select {
+		case fileId := <-cw.Changes():
+			if fileId == "dir1/file1" {
+				t.Errorf("got change for %s after removing dir1", fileId)
+			}
+			reported = fileId == "dir2/file2"
+		case <-timeout:
+			t.Fatalf("no change reported for dir2/file2")
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package localfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// fileSystemProvider is an implementation of monitor.ContextApi backed by the local filesystem.  A FileId is
+// the slash-separated path of a file relative to the root directory, and the empty FileId is the root itself.
+//
+// Copies are written beneath the destination directory, with one tree per version that mirrors the watched
+// tree:
+//
+//	<destination>/v<version>/<fileId>
+//
+// The destination must be outside the root, or the monitor would copy its own copies.
+type fileSystemProvider struct {
+	root        string
+	destination string
+}
+
+// NewFileSystemProvider creates a provider that watches the files beneath root and copies them beneath
+// destination.  The root must be an existing directory; the destination is created if it doesn't exist, and
+// must not be the root or beneath it.
+func NewFileSystemProvider(root string, destination string) (*fileSystemProvider, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	destination, err = filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root is resolved so that ids can be checked against it once their own symlinks are resolved
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("root %s is not a directory", root)
+	}
+	if err := CheckOutsideRoot(root, destination); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(destination, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &fileSystemProvider{root: root, destination: destination}, nil
+}
+
+// RetrieveMetadata returns the metadata for the file with the given ID. If the file does not exist, it returns an error.
+func (p *fileSystemProvider) RetrieveMetadata(ctx context.Context, fileId model.FileId) (model.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Metadata{}, err
+	}
+	filePath, err := p.path(fileId)
+	if err != nil {
+		return model.Metadata{}, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return model.Metadata{}, notFound(fileId, err)
+	}
+	return metadataFromInfo(fileId, info), nil
+}
+
+// CopyFile copies the file with the given ID to the destination, as the given version.  The copy is written to a
+// temporary file and renamed into place, so a version is either copied completely or not at all.  If the file is a
+// directory, it returns an error.
+func (p *fileSystemProvider) CopyFile(ctx context.Context, fileId model.FileId, lastUpdated int64, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sourcePath, err := p.path(fileId)
+	if err != nil {
+		return err
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return notFound(fileId, err)
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("file is a directory")
+	}
+
+	copyPath := p.CopyLocation(fileId, version)
+	copyDirectory := filepath.Dir(copyPath)
+	if err := os.MkdirAll(copyDirectory, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(copyDirectory, ".copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, &contextReader{ctx: ctx, reader: source}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// The copy keeps the modification time of the version it was taken from
+	modified := time.UnixMilli(lastUpdated)
+	if err := os.Chtimes(tmp.Name(), modified, modified); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), copyPath)
+}
+
+// CopyLocation returns the path the copy of the given version of the file is written to
+func (p *fileSystemProvider) CopyLocation(fileId model.FileId, version int) string {
+	return filepath.Join(p.destination, "v"+strconv.Itoa(version), filepath.FromSlash(string(fileId)))
+}
+
+// PruneCopy removes the copy of the given version
+func (p *fileSystemProvider) PruneCopy(ctx context.Context, version model.FileVersion) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := p.path(version.FileId); err != nil {
+		return err
+	}
+	if err := os.Remove(p.CopyLocation(version.FileId, version.Version)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// RestoreCopy replaces the file with the copy of the given version, recreating the file if it has been
+// deleted.  Like a copy, the restored content is written to a temporary file and renamed into place.
+func (p *fileSystemProvider) RestoreCopy(ctx context.Context, version model.FileVersion) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	targetPath, err := p.path(version.FileId)
+	if err != nil {
+		return err
+	}
+
+	source, err := os.Open(p.CopyLocation(version.FileId, version.Version))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(targetPath), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, &contextReader{ctx: ctx, reader: source}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), targetPath)
+}
+
+// ContentHash returns the SHA-256 of the content of the file with the given ID, in hex.  If the file is a
+// directory, it returns an error.
+func (p *fileSystemProvider) ContentHash(ctx context.Context, fileId model.FileId) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	filePath, err := p.path(fileId)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", notFound(fileId, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &contextReader{ctx: ctx, reader: file}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// GetChildren returns the children of the given file.  If FileID is empty, it returns the children of the root directory.
+// Only regular files and directories are returned; symlinks and other special files are skipped.  If the file is not a
+// directory, it returns an error.
+func (p *fileSystemProvider) GetChildren(ctx context.Context, fileId model.FileId) ([]model.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	directoryPath, err := p.path(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(directoryPath)
+	if err != nil {
+		return nil, notFound(fileId, err)
+	}
+
+	children := []model.Metadata{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() && !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed since the directory was read
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		children = append(children, metadataFromInfo(model.FileId(path.Join(string(fileId), entry.Name())), info))
+	}
+	return children, nil
+}
+
+// path returns the location of the file with the given ID, refusing any ID that would escape the root,
+// whether by its own path or by going through a symlink that leads outside it
+func (p *fileSystemProvider) path(fileId model.FileId) (string, error) {
+	if fileId == "" {
+		return p.root, nil
+	}
+	relative := filepath.FromSlash(string(fileId))
+	if !filepath.IsLocal(relative) {
+		return "", fmt.Errorf("invalid FileId %q", fileId)
+	}
+	filePath := filepath.Join(p.root, relative)
+
+	resolved, err := resolveSymlinks(filePath)
+	if err != nil {
+		return "", err
+	}
+	if inRoot, err := filepath.Rel(p.root, resolved); err != nil || !filepath.IsLocal(inRoot) {
+		return "", fmt.Errorf("invalid FileId %q: leads outside the root", fileId)
+	}
+	return filePath, nil
+}
+
+// CheckOutsideRoot returns an error if any of the paths is the root or beneath it, after resolving the
+// symlinks of both.  Anything the application writes beneath the root, such as the copies or the cache,
+// would otherwise be watched and copied in turn.
+func CheckOutsideRoot(root string, paths ...string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if root, err = resolveSymlinks(root); err != nil {
+		return err
+	}
+	for _, filePath := range paths {
+		absolute, err := filepath.Abs(filePath)
+		if err != nil {
+			return err
+		}
+		resolved, err := resolveSymlinks(absolute)
+		if err != nil {
+			return err
+		}
+		if inRoot, err := filepath.Rel(root, resolved); err == nil && filepath.IsLocal(inRoot) {
+			return fmt.Errorf("%s is inside the root %s", filePath, root)
+		}
+	}
+	return nil
+}
+
+// resolveSymlinks resolves the symlinks in the path.  A file that doesn't exist, such as one about to be
+// restored, is resolved through the nearest of its ancestors that does.
+func resolveSymlinks(filePath string) (string, error) {
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(filePath)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(filePath)
+		if parent == filePath {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(filePath), missing)
+		filePath = parent
+	}
+}
+
+// metadataFromInfo returns the metadata of the file.  Its Path is its FileId, and its content type is
+// guessed from the extension of its name.
+func metadataFromInfo(fileId model.FileId, info fs.FileInfo) model.Metadata {
+	metadata := model.Metadata{
+		Id:           fileId,
+		LastModified: info.ModTime().UnixMilli(),
+		IsDirectory:  info.IsDir(),
+		ParentId:     parentId(fileId),
+		Name:         info.Name(),
+		Path:         string(fileId),
+	}
+	if !info.IsDir() {
+		metadata.Size = info.Size()
+		metadata.ContentType = mime.TypeByExtension(path.Ext(metadata.Name))
+	}
+	return metadata
+}
+
+// parentId returns the ID of the directory holding the file, which is empty for files in the root
+func parentId(fileId model.FileId) model.FileId {
+	if fileId == "" {
+		return ""
+	}
+	parent := path.Dir(string(fileId))
+	if parent == "." {
+		return ""
+	}
+	return model.FileId(parent)
+}
+
+// notFound converts a missing file error into model.ErrNotFound, leaving any other error as it is
+func notFound(fileId model.FileId, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", model.ErrNotFound, fileId)
+	}
+	return err
+}
+
+// contextReader stops reading once its context is done, so a long copy can be cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
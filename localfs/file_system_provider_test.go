@@ -0,0 +1,240 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// newTestProvider creates a provider over a root holding file1 and dir1/file2
+func newTestProvider(t *testing.T) (*fileSystemProvider, string, string) {
+	root := t.TempDir()
+	destination := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(root, "file1"), []byte("one"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir1", "file2"), []byte("two"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewFileSystemProvider(root, destination)
+	if err != nil {
+		t.Fatalf("Error creating provider: %v", err)
+	}
+	return provider, root, destination
+}
+
+func TestDestinationInsideRoot(t *testing.T) {
+	root := t.TempDir()
+	for _, destination := range []string{root, filepath.Join(root, ".copies")} {
+		if _, err := NewFileSystemProvider(root, destination); err == nil {
+			t.Errorf("%s: expected an error for a destination inside the root", destination)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "watched"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileSystemProvider(filepath.Join(root, "watched"), filepath.Join(root, ".copies")); err != nil {
+		t.Errorf("Error creating provider beside its destination: %v", err)
+	}
+}
+
+func TestRetrieveMetadata(t *testing.T) {
+	provider, _, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	metadata, err := provider.RetrieveMetadata(ctx, "dir1/file2")
+	if err != nil {
+		t.Fatalf("Error retrieving metadata: %v", err)
+	}
+	if metadata.IsDirectory || metadata.ParentId != "dir1" || metadata.LastModified == 0 {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+	if metadata.Name != "file2" || metadata.Path != "dir1/file2" || metadata.Size != 3 {
+		t.Errorf("got name %q, path %q, size %d, want file2, dir1/file2, 3", metadata.Name, metadata.Path, metadata.Size)
+	}
+
+	if _, err := provider.RetrieveMetadata(ctx, "missing"); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err := provider.RetrieveMetadata(ctx, "../outside"); err == nil || errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected an invalid FileId error, got %v", err)
+	}
+}
+
+func TestGetChildren(t *testing.T) {
+	provider, _, _ := newTestProvider(t)
+
+	children, err := provider.GetChildren(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Error retrieving children: %v", err)
+	}
+	ids := []model.FileId{}
+	for _, child := range children {
+		ids = append(ids, child.Id)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []model.FileId{"dir1", "file1"}) {
+		t.Errorf("got children %v", ids)
+	}
+
+	if _, err := provider.GetChildren(context.Background(), "file1"); err == nil {
+		t.Errorf("expected an error listing the children of a file")
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	provider, root, destination := newTestProvider(t)
+	ctx := context.Background()
+
+	metadata, _ := provider.RetrieveMetadata(ctx, "dir1/file2")
+	if err := provider.CopyFile(ctx, "dir1/file2", metadata.LastModified, 1); err != nil {
+		t.Fatalf("Error copying file: %v", err)
+	}
+	os.WriteFile(filepath.Join(root, "dir1", "file2"), []byte("two, again"), 0o644)
+	if err := provider.CopyFile(ctx, "dir1/file2", metadata.LastModified, 2); err != nil {
+		t.Fatalf("Error copying file: %v", err)
+	}
+
+	for version, want := range map[string]string{"v1": "two", "v2": "two, again"} {
+		data, err := os.ReadFile(filepath.Join(destination, version, "dir1", "file2"))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %q (%v), want %q", version, data, err, want)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(destination, "v1", "dir1"))
+	if len(entries) != 1 {
+		t.Errorf("expected only the copy in the version's directory, got %d entries", len(entries))
+	}
+
+	if err := provider.CopyFile(ctx, "dir1", 0, 1); err == nil {
+		t.Errorf("expected an error copying a directory")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	provider, root, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	before, err := provider.ContentHash(ctx, "file1")
+	if err != nil {
+		t.Fatalf("Error hashing file1: %v", err)
+	}
+	// touching the file leaves the hash alone, while changing its content doesn't
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "file1"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if touched, _ := provider.ContentHash(ctx, "file1"); touched != before {
+		t.Errorf("got hash %s after touch, want %s", touched, before)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file1"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := provider.ContentHash(ctx, "file1"); changed == before {
+		t.Errorf("hash didn't change with the content")
+	}
+
+	if _, err := provider.ContentHash(ctx, "missing"); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("missing file: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRestoreCopy(t *testing.T) {
+	provider, root, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	if err := provider.CopyFile(ctx, "dir1/file2", 0, 1); err != nil {
+		t.Fatalf("Error copying file: %v", err)
+	}
+	os.Remove(filepath.Join(root, "dir1", "file2"))
+
+	// a deleted file is recreated from its copy
+	version := model.FileVersion{FileId: "dir1/file2", Version: 1, Location: provider.CopyLocation("dir1/file2", 1)}
+	if err := provider.RestoreCopy(ctx, version); err != nil {
+		t.Fatalf("Error restoring file: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "dir1", "file2")); err != nil || string(data) != "two" {
+		t.Errorf("got %q (%v), want the content of version 1", data, err)
+	}
+
+	if err := provider.RestoreCopy(ctx, model.FileVersion{FileId: "dir1/file2", Version: 2}); err == nil {
+		t.Errorf("expected an error restoring a version that was never copied")
+	}
+}
+
+func TestPruneCopy(t *testing.T) {
+	provider, _, destination := newTestProvider(t)
+	ctx := context.Background()
+
+	for version := 1; version <= 2; version++ {
+		if err := provider.CopyFile(ctx, "file1", 0, version); err != nil {
+			t.Fatalf("Error copying file: %v", err)
+		}
+	}
+	if err := provider.PruneCopy(ctx, model.FileVersion{FileId: "file1", Version: 1}); err != nil {
+		t.Fatalf("Error pruning copy: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "v1", "file1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected version 1 to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "v2", "file1")); err != nil {
+		t.Errorf("expected version 2 to be left, got %v", err)
+	}
+
+	// pruning a copy that's already gone isn't an error
+	if err := provider.PruneCopy(ctx, model.FileVersion{FileId: "file1", Version: 1}); err != nil {
+		t.Errorf("got %v pruning a pruned copy", err)
+	}
+}
+
+func TestSymlinkOutsideRoot(t *testing.T) {
+	provider, root, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "dir1"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.RetrieveMetadata(ctx, "link/secret"); err == nil || errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected an invalid FileId error, got %v", err)
+	}
+	// a restore through the symlink, even of a file that doesn't exist, mustn't write outside the root
+	version := model.FileVersion{FileId: "link/file1", Version: 1}
+	copyPath := provider.CopyLocation(version.FileId, version.Version)
+	if err := os.MkdirAll(filepath.Dir(copyPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(copyPath, []byte("one"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.RestoreCopy(ctx, version); err == nil {
+		t.Errorf("expected an error restoring through a symlink outside the root")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restore wrote outside the root: %v", err)
+	}
+
+	// a symlink that stays within the root is followed
+	if metadata, err := provider.RetrieveMetadata(ctx, "inside/file2"); err != nil || metadata.Size != 3 {
+		t.Errorf("got %+v (%v), want the metadata of dir1/file2", metadata, err)
+	}
+}
@@ -1,19 +1,87 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
 	"time"
 
+	"github.com/jsfinn/enfi-assessment/control"
+	"github.com/jsfinn/enfi-assessment/localfs"
+	"github.com/jsfinn/enfi-assessment/metrics"
 	"github.com/jsfinn/enfi-assessment/mock"
 	"github.com/jsfinn/enfi-assessment/model"
 	"github.com/jsfinn/enfi-assessment/monitor"
+	"github.com/mitchellh/mapstructure"
 	"github.com/samber/lo"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Datafile        string `mapstructure:"datafile"`
-	WatchIntervalMs int64  `mapstructure:"watch_interval_ms"`
+	// Provider is either "mock" (the default), which replays the datafile, or "local"
+	Provider        string           `mapstructure:"provider"`
+	Local           LocalConfig      `mapstructure:"local"`
+	Datafile        string           `mapstructure:"datafile"`
+	WatchIntervalMs int64            `mapstructure:"watch_interval_ms"`
+	Monitor         monitor.Options  `mapstructure:"monitor"`
+	Cache           CacheConfig      `mapstructure:"cache"`
+	DeadLetters     DeadLetterConfig `mapstructure:"dead_letters"`
+	Versions        VersionsConfig   `mapstructure:"versions"`
+	// WatchlistFile is where changes to the watchlist are saved.  Once it exists, it replaces the watchlist
+	// from the datafile or the local config.  Empty means changes aren't saved.
+	WatchlistFile string `mapstructure:"watchlist_file"`
+	// ControlAddress is the address the control API is served on while the monitor runs, or empty to not serve it
+	ControlAddress string `mapstructure:"control_address"`
+	// MetricsAddress is the address /metrics is served on while the monitor runs, or empty to not serve it
+	MetricsAddress string `mapstructure:"metrics_address"`
+}
+
+// LocalConfig configures the local filesystem provider
+type LocalConfig struct {
+	// Root is the directory the FileIds in the watchlist are relative to
+	Root string `mapstructure:"root"`
+	// Destination is the directory the copies are written to
+	Destination string `mapstructure:"destination"`
+	// Watchlist is the list of files and directories to watch, relative to Root.  Each entry is either an
+	// id, or a map with the id and its watch options.
+	Watchlist []model.WatchEntry `mapstructure:"watchlist"`
+	// Notify picks up changes as they happen using inotify, as well as by sweeping the watchlist
+	Notify bool `mapstructure:"notify"`
+	// ReconcileIntervalMs replaces the monitor's interval when Notify is set, since the sweeps are only
+	// needed to catch changes the notifications missed
+	ReconcileIntervalMs int64 `mapstructure:"reconcile_interval_ms"`
+}
+
+// CacheConfig selects the Cache implementation used by the monitor
+type CacheConfig struct {
+	// Type is either "memory" (the default) or "file"
+	Type string `mapstructure:"type"`
+	// Directory is where the file cache keeps its snapshot and log
+	Directory string `mapstructure:"directory"`
+	// SnapshotEvery is the number of updates the file cache logs between snapshots
+	SnapshotEvery int `mapstructure:"snapshot_every"`
+}
+
+// DeadLetterConfig selects where copies that run out of retries are kept
+type DeadLetterConfig struct {
+	// Type is either "memory" (the default) or "file"
+	Type string `mapstructure:"type"`
+	// File is where the file store keeps the dead letters
+	File string `mapstructure:"file"`
+}
+
+// VersionsConfig selects where the catalog of copied versions is kept
+type VersionsConfig struct {
+	// Type is either "memory" (the default) or "file"
+	Type string `mapstructure:"type"`
+	// File is where the file catalog appends each copied version
+	File string `mapstructure:"file"`
 }
 
 func loadConfig() (*Config, error) {
@@ -26,73 +94,313 @@ func loadConfig() (*Config, error) {
 	}
 
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil { // Unmarshal the config into the struct
+	hooks := mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		watchEntryHook,
+	)
+	if err := viper.Unmarshal(&config, viper.DecodeHook(hooks)); err != nil { // Unmarshal the config into the struct
 		return nil, err
 	}
 
 	return &config, nil
 }
 
+// watchEntryHook lets a watchlist entry without options be written as just its id
+func watchEntryHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(model.WatchEntry{}) {
+		return model.WatchEntry{Id: model.FileId(data.(string))}, nil
+	}
+	return data, nil
+}
+
+func newCache(config CacheConfig) (monitor.Cache, error) {
+	switch config.Type {
+	case "", "memory":
+		return monitor.NewHistoryCache(), nil
+	case "file":
+		return monitor.NewFileHistoryCache(config.Directory, config.SnapshotEvery)
+	default:
+		return nil, fmt.Errorf("unknown cache type %q", config.Type)
+	}
+}
+
+// newApi creates the configured provider
+func newApi(ctx context.Context, config *Config) (api monitor.ContextApi, watchlist []model.WatchEntry, nextStep func() bool, err error) {
+	switch config.Provider {
+	case "", "mock":
+		return newMockApi(ctx, config)
+	case "local":
+		return newLocalApi(ctx, config)
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown provider %q", config.Provider)
+	}
+}
+
+func newDeadLetterStore(config DeadLetterConfig) (monitor.DeadLetterStore, error) {
+	switch config.Type {
+	case "", "memory":
+		return monitor.NewDeadLetterStore(), nil
+	case "file":
+		return monitor.NewFileDeadLetterStore(config.File)
+	default:
+		return nil, fmt.Errorf("unknown dead-letter store type %q", config.Type)
+	}
+}
+
+func newVersionCatalog(config VersionsConfig) (monitor.VersionCatalog, error) {
+	switch config.Type {
+	case "", "memory":
+		return monitor.NewVersionCatalog(), nil
+	case "file":
+		return monitor.NewFileVersionCatalog(config.File)
+	default:
+		return nil, fmt.Errorf("unknown version catalog type %q", config.Type)
+	}
+}
+
+// newMockApi creates the mock provider from the datafile.  nextStep applies the next set of updates from
+// the datafile, returning false once they've all been applied.
+func newMockApi(ctx context.Context, config *Config) (api monitor.ContextApi, watchlist []model.WatchEntry, nextStep func() bool, err error) {
+	fp, watchlist, steps, err := mock.NewFileProviderFromFile(config.Datafile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nextStep = func() bool {
+		if len(steps) == 0 || ctx.Err() != nil {
+			return false
+		}
+		for _, fileId := range steps[0] {
+			fp.UpdateLastModified(fileId)
+		}
+		steps = steps[1:]
+		return true
+	}
+	return monitor.AdaptApi(fp), watchlist, nextStep, nil
+}
+
+// newLocalApi creates the local filesystem provider.  nextStep returns false once the application has been
+// interrupted.
+func newLocalApi(ctx context.Context, config *Config) (api monitor.ContextApi, watchlist []model.WatchEntry, nextStep func() bool, err error) {
+	api, err = localfs.NewFileSystemProvider(config.Local.Root, config.Local.Destination)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := localfs.CheckOutsideRoot(config.Local.Root, historyFiles(config)...); err != nil {
+		return nil, nil, nil, err
+	}
+
+	nextStep = func() bool {
+		return ctx.Err() == nil
+	}
+	return api, config.Local.Watchlist, nextStep, nil
+}
+
+// historyFiles returns the files and directories the application keeps its history in, which a local
+// provider mustn't watch
+func historyFiles(config *Config) []string {
+	var files []string
+	if config.Cache.Type == "file" {
+		files = append(files, config.Cache.Directory)
+	}
+	if config.DeadLetters.Type == "file" {
+		files = append(files, config.DeadLetters.File)
+	}
+	if config.Versions.Type == "file" {
+		files = append(files, config.Versions.File)
+	}
+	if config.WatchlistFile != "" {
+		files = append(files, config.WatchlistFile)
+	}
+	return files
+}
+
+// serve serves the handler on the address in the background, until the returned server is closed
+func serve(address string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving %s: %v", address, err)
+		}
+	}()
+	return server
+}
+
 func main() {
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	fp, watchlist, steps, err := mock.NewFileProviderFromFile(config.Datafile)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dead-letters":
+			err = runDeadLetters(ctx, config, os.Args[2:])
+		case "watchlist":
+			err = runWatchlist(config, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	api, watchlist, nextStep, err := newApi(ctx, config)
 	if err != nil {
-		log.Fatalf("Error reading file: %v", err)
+		log.Fatalf("Error creating provider: %v", err)
+	}
+	var watchlistStore monitor.WatchlistStore
+	if config.WatchlistFile != "" {
+		watchlistStore = monitor.NewFileWatchlistStore(config.WatchlistFile)
+		saved, found, err := watchlistStore.Load()
+		if err != nil {
+			log.Fatalf("Error loading watchlist: %v", err)
+		}
+		if found {
+			watchlist = saved
+		}
 	}
 
-	historyCache := monitor.NewHistoryCache()
+	historyCache, err := newCache(config.Cache)
+	if err != nil {
+		log.Fatalf("Error creating cache: %v", err)
+	}
+	deadLetters, err := newDeadLetterStore(config.DeadLetters)
+	if err != nil {
+		log.Fatalf("Error creating dead-letter store: %v", err)
+	}
+	versions, err := newVersionCatalog(config.Versions)
+	if err != nil {
+		log.Fatalf("Error creating version catalog: %v", err)
+	}
 
-	counter := monitor.NewSimpleCounter()
+	registry := metrics.NewRegistry()
+	if config.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		defer serve(config.MetricsAddress, mux).Close()
+	}
 
 	// 500 files to watch
 
-	monitor := monitor.NewMonitor(fp, watchlist, historyCache, counter)
+	// The monitor sweeps the watchlist on its own, every watch_interval_ms unless monitor.interval_ms is set.
+	// With notifications on, the sweeps only need to reconcile what the notifications missed.
+	options := config.Monitor
+	if options.IntervalMs == 0 {
+		options.IntervalMs = config.WatchIntervalMs
+	}
+	notify := config.Provider == "local" && config.Local.Notify
+	if notify && config.Local.ReconcileIntervalMs > 0 {
+		options.IntervalMs = config.Local.ReconcileIntervalMs
+	}
+
+	monitor := monitor.NewMonitor(api, nil, historyCache, registry, options)
+	if err := monitor.Watch(watchlist...); err != nil {
+		log.Fatalf("Error in watchlist: %v", err)
+	}
+	monitor.SetDeadLetterStore(deadLetters)
+	monitor.SetVersionCatalog(versions)
+	if watchlistStore != nil {
+		monitor.SetWatchlistStore(watchlistStore)
+	}
 	monitor.Start()
 
-	// check the watchlist 100 times
-	for _, step := range steps {
-		for _, fileId := range step {
-			fp.UpdateLastModified(fileId)
+	if config.ControlAddress != "" {
+		defer serve(config.ControlAddress, control.NewServer(monitor, registry)).Close()
+	}
+
+	if notify {
+		watcher, err := localfs.NewChangeWatcher(config.Local.Root, model.WatchEntryIds(watchlist))
+		if err != nil {
+			log.Fatalf("Error watching for changes: %v", err)
 		}
-		monitor.EvaluateWatchlist()
-		time.Sleep(time.Duration(config.WatchIntervalMs) * time.Millisecond)
+		defer watcher.Close()
+		monitor.WatchChanges(watcher)
+	}
+
+	// take one step every watch_interval_ms while the monitor sweeps, then sweep once more to pick up the
+	// last step before shutting down
+	for nextStep() {
+		select {
+		case <-time.After(time.Duration(config.WatchIntervalMs) * time.Millisecond):
+		case <-ctx.Done():
+		}
+	}
+	monitor.EvaluateWatchlistContext(ctx)
+	report := monitor.ShutDown()
+	if !report.Drained {
+		log.Printf("Shut down before the pipeline drained, dropping %v", report.Unprocessed)
+	} else if report.PendingCopies > 0 {
+		log.Printf("Shut down with %d copies pending", report.PendingCopies)
+	}
+	if report.UnsettledChanges > 0 {
+		log.Printf("Shut down with %d changes still settling", report.UnsettledChanges)
 	}
-	monitor.ShutDown()
 
 	// Dump watch Log
 	log.Printf("watch Log:")
-	watchlistMap := lo.Associate(watchlist, func(fileId model.FileId) (model.FileId, bool) { return fileId, true })
+	watchlistMap := lo.Associate(monitor.Watchlist(), func(fileId model.FileId) (model.FileId, bool) { return fileId, true })
 	historyKeys := historyCache.GetAllCacheKeys()
 
 	for _, key := range historyKeys {
 		_, version := historyCache.Get(key)
-		var watchtype string
-		if _, ok := watchlistMap[model.FileId(key)]; ok {
-			watchtype = "explicit"
-		} else {
-			watchtype = "implicit"
-		}
+		watchtype := monitor.WatchType(key)
 		var status = "not copied"
-		if version > 0 {
+		if historyCache.IsDeleted(key) {
+			status = "deleted"
+		} else if historyCache.PendingVersion(key) > 0 {
+			status = "pending"
+		} else if version > 0 {
 			status = "copied"
 		}
 
-		log.Printf("File: %v   watchtype: %v  version: %v   status: %v", key, watchtype, version, status)
+		log.Printf("File: %v   watchtype: %v  version: %v   status: %v", describeFile(historyCache, key), watchtype, version, status)
 		delete(watchlistMap, key)
 	}
 
 	for key := range watchlistMap {
-		if m, _ := fp.RetrieveMetadata(key); !m.IsDirectory {
-			log.Printf("File: %v   watchtype: explicit  version: 0   status: not copied", key)
+		if m, err := api.RetrieveMetadata(context.Background(), key); err == nil && !m.IsDirectory {
+			log.Printf("File: %v   watchtype: explicit  version: 0   status: not copied", describeMetadata(m))
 		}
 	}
 
 	// Dump counter stats
-	counter.DumpStatsToLog()
+	registry.DumpToLog()
 
+	if closer, ok := historyCache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing cache: %v", err)
+		}
+	}
+	if closer, ok := versions.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing version catalog: %v", err)
+		}
+	}
+
+}
+
+// describeFile describes the file with the given ID for the watch log, by the metadata last recorded in the
+// cache
+func describeFile(cache monitor.Cache, fileId model.FileId) string {
+	metadata, found := cache.Metadata(fileId)
+	if !found || metadata.Path == "" {
+		return string(fileId)
+	}
+	return describeMetadata(metadata)
+}
+
+// describeMetadata describes a file by its path, id, size and content type
+func describeMetadata(metadata model.Metadata) string {
+	description := fmt.Sprintf("%s (%s, %d bytes", metadata.Path, metadata.Id, metadata.Size)
+	if metadata.ContentType != "" {
+		description += ", " + metadata.ContentType
+	}
+	return description + ")"
 }
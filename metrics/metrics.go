@@ -0,0 +1,344 @@
+// Package metrics holds the counters, gauges and histograms recorded by the monitor, and exposes them in
+// the Prometheus text format.  Every metric is safe for concurrent use.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets used by every histogram
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// Registry holds every metric, keyed by name and labels.  A metric is created the first time it's
+// asked for, so callers don't need to register metrics up front.
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+// family holds the metrics sharing a name, which differ only in their labels
+type family struct {
+	kind    kind
+	metrics map[string]any
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter with the given name and labels, given as alternating names and values
+func (r *Registry) Counter(name string, labels ...string) *Counter {
+	return metric(r, name, counterKind, labels, func() *Counter { return &Counter{} })
+}
+
+// Gauge returns the gauge with the given name and labels, given as alternating names and values
+func (r *Registry) Gauge(name string, labels ...string) *Gauge {
+	return metric(r, name, gaugeKind, labels, func() *Gauge { return &Gauge{} })
+}
+
+// GaugeFunc sets the gauge with the given name and labels to report the value of f whenever it's read,
+// replacing any earlier function
+func (r *Registry) GaugeFunc(name string, f func() float64, labels ...string) {
+	r.Gauge(name, labels...).fn.Store(&f)
+}
+
+// Histogram returns the histogram with the given name and labels, given as alternating names and values
+func (r *Registry) Histogram(name string, labels ...string) *Histogram {
+	return metric(r, name, histogramKind, labels, func() *Histogram {
+		return &Histogram{buckets: DefaultBuckets, counts: make([]atomic.Uint64, len(DefaultBuckets))}
+	})
+}
+
+// metric returns the metric with the given name and labels, creating it if it doesn't exist
+func metric[T any](r *Registry, name string, k kind, labels []string, create func() T) T {
+	key := labelString(labels)
+
+	r.mu.RLock()
+	f, ok := r.families[name]
+	if ok && f.kind == k {
+		if m, ok := f.metrics[key]; ok {
+			r.mu.RUnlock()
+			return m.(T)
+		}
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok = r.families[name]
+	if !ok {
+		f = &family{kind: k, metrics: make(map[string]any)}
+		r.families[name] = f
+	} else if f.kind != k {
+		panic(fmt.Sprintf("metric %s is a %s, not a %s", name, f.kind, k))
+	}
+	if m, ok := f.metrics[key]; ok {
+		return m.(T)
+	}
+	m := create()
+	f.metrics[key] = m
+	return m
+}
+
+// labelString formats alternating label names and values as they appear in the text format
+func labelString(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("labels must be given as name and value pairs")
+	}
+	pairs := []string{}
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+quoteLabelValue(labels[i+1]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Counter is a count that only goes up
+type Counter struct {
+	value atomic.Int64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down, either set directly or read from a function
+type Gauge struct {
+	bits atomic.Uint64
+	fn   atomic.Pointer[func() float64]
+}
+
+// Set sets the gauge to the given value
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta float64) {
+	addFloat(&g.bits, delta)
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	if fn := g.fn.Load(); fn != nil {
+		return (*fn)()
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations into buckets by value, along with their count and sum
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64
+}
+
+// Observe records a single observation
+func (h *Histogram) Observe(value float64) {
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		h.counts[i].Add(1)
+	}
+	addFloat(&h.sum, value)
+	h.count.Add(1)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Sum returns the sum of every observation
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sum.Load())
+}
+
+// addFloat atomically adds delta to the float64 stored as bits
+func addFloat(bits *atomic.Uint64, delta float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// WriteText writes every metric in the Prometheus text exposition format, sorted by name and labels
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f, keys := r.family(name)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.kind)
+		for _, key := range keys {
+			r.mu.RLock()
+			m := f.metrics[key]
+			r.mu.RUnlock()
+
+			switch m := m.(type) {
+			case *Counter:
+				fmt.Fprintf(&b, "%s %d\n", series(name, key), m.Value())
+			case *Gauge:
+				fmt.Fprintf(&b, "%s %s\n", series(name, key), formatFloat(m.Value()))
+			case *Histogram:
+				cumulative := uint64(0)
+				for i, bound := range m.buckets {
+					cumulative += m.counts[i].Load()
+					fmt.Fprintf(&b, "%s %d\n", series(name+"_bucket", withLabel(key, "le", formatFloat(bound))), cumulative)
+				}
+				count := m.Count()
+				fmt.Fprintf(&b, "%s %d\n", series(name+"_bucket", withLabel(key, "le", "+Inf")), count)
+				fmt.Fprintf(&b, "%s %s\n", series(name+"_sum", key), formatFloat(m.Sum()))
+				fmt.Fprintf(&b, "%s %d\n", series(name+"_count", key), count)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// family returns the family with the given name along with its label keys, sorted
+func (r *Registry) family(name string) (*family, []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f := r.families[name]
+	keys := make([]string, 0, len(f.metrics))
+	for key := range f.metrics {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return f, keys
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format, so the registry can be mounted at /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.WriteText(w); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
+}
+
+// Values returns the value of every counter and gauge, and the count and sum of every histogram, keyed by
+// the series name as it appears in the text format
+func (r *Registry) Values() map[string]float64 {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+
+	values := map[string]float64{}
+	for _, name := range names {
+		f, keys := r.family(name)
+		for _, key := range keys {
+			r.mu.RLock()
+			m := f.metrics[key]
+			r.mu.RUnlock()
+			switch m := m.(type) {
+			case *Counter:
+				values[series(name, key)] = float64(m.Value())
+			case *Gauge:
+				values[series(name, key)] = m.Value()
+			case *Histogram:
+				values[series(name+"_count", key)] = float64(m.Count())
+				values[series(name+"_sum", key)] = m.Sum()
+			}
+		}
+	}
+	return values
+}
+
+// DumpToLog logs the value of every counter and gauge
+func (r *Registry) DumpToLog() {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.families))
+	for name, f := range r.families {
+		if f.kind != histogramKind {
+			names = append(names, name)
+		}
+	}
+	r.mu.RUnlock()
+	slices.Sort(names)
+
+	for _, name := range names {
+		f, keys := r.family(name)
+		for _, key := range keys {
+			r.mu.RLock()
+			m := f.metrics[key]
+			r.mu.RUnlock()
+			switch m := m.(type) {
+			case *Counter:
+				log.Printf("%s: %d", series(name, key), m.Value())
+			case *Gauge:
+				log.Printf("%s: %s", series(name, key), formatFloat(m.Value()))
+			}
+		}
+	}
+}
+
+func series(name string, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func withLabel(labels string, name string, value string) string {
+	label := name + "=" + quoteLabelValue(value)
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+// labelValueEscaper escapes a label value as the text format requires: only backslash, double quote and
+// newline are escaped, and every other character is written as it is
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabelValue quotes and escapes a label value for the text format
+func quoteLabelValue(value string) string {
+	return `"` + labelValueEscaper.Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
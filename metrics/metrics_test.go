@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounterDoesNotLoseIncrements(t *testing.T) {
+	registry := NewRegistry()
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				registry.Counter("calls").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := registry.Counter("calls").Value(); calls != 50000 {
+		t.Errorf("got %d calls, want 50000", calls)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("copy_file_calls").Add(3)
+	registry.GaugeFunc("queue_depth", func() float64 { return 7 }, "stage", "copy")
+	registry.Gauge("watchlist_size").Set(2)
+	registry.Counter("copy_errors", "file", "dir\\\"a\"\nb\tc\u00e9").Inc()
+	histogram := registry.Histogram("api_call_duration_seconds", "call", "copy_file")
+	histogram.Observe(0.003)
+	histogram.Observe(0.2)
+	histogram.Observe(20)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	text := recorder.Body.String()
+
+	for _, line := range []string{
+		"# TYPE api_call_duration_seconds histogram",
+		`api_call_duration_seconds_bucket{call="copy_file",le="0.001"} 0`,
+		`api_call_duration_seconds_bucket{call="copy_file",le="0.005"} 1`,
+		`api_call_duration_seconds_bucket{call="copy_file",le="0.25"} 2`,
+		`api_call_duration_seconds_bucket{call="copy_file",le="+Inf"} 3`,
+		`api_call_duration_seconds_sum{call="copy_file"} 20.203`,
+		`api_call_duration_seconds_count{call="copy_file"} 3`,
+		"# TYPE copy_file_calls counter",
+		"copy_file_calls 3",
+		"# TYPE queue_depth gauge",
+		`queue_depth{stage="copy"} 7`,
+		"watchlist_size 2",
+		// only backslash, double quote and newline are escaped
+		`copy_errors{file="dir\\\"a\"\nb` + "\t" + `cé"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, text)
+		}
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", contentType)
+	}
+}
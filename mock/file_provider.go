@@ -1,37 +1,109 @@
 package mock
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"math/rand/v2"
+	"mime"
+	"path"
 	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jsfinn/enfi-assessment/model"
 )
 
 type fileProvider struct {
+	// mu guards the file tree, since the monitor reads it from several goroutines while it's being mutated
+	mu           sync.RWMutex
 	files        []*mockFile
 	fileById     map[model.FileId]*mockFile
 	childrenById map[model.FileId][]model.FileId
+	// revisions counts the changes to file content, giving each revision its own ETag
+	revisions int
+	// changes is the change log served by ChangesSince.  The change at changes[i] is numbered
+	// changesTrimmed+i+1, and a cursor is the number of the last change it has seen.
+	changes        []model.FileId
+	changesTrimmed int
+	// copies holds the ETag of each version copied, by file and version, so that versions can be restored
+	copies map[model.FileId]map[int]string
 }
 
+// changeLogLimit is the number of changes the change log keeps; cursors older than that have expired
+const changeLogLimit = 100000
+
 // mockFile is a struct that represents a file in the mock file provider.
 type mockFile struct {
 	FileId       model.FileId
 	LastModified int64
 	IsDirectory  bool
 	ParentId     model.FileId
+	Name         string
+	Size         int64
+	ContentType  string
+	// ETag changes whenever the file's content changes, but not when it's only touched
+	ETag string
 }
 
-// Helper function to extract metadata from a mock file
+// Helper function to extract metadata from a mock file.  The file's Path depends on its parents, so it's
+// left empty.
 func MetadataFromFile(file mockFile) model.Metadata {
 	return model.Metadata{
 		Id:           file.FileId,
 		LastModified: file.LastModified,
 		IsDirectory:  file.IsDirectory,
+		ParentId:     file.ParentId,
+		Name:         file.Name,
+		Size:         file.Size,
+		ContentType:  file.ContentType,
+		ContentHash:  file.ETag,
+	}
+}
+
+// metadata returns the metadata of the file, with its Path built from the names of its parents.  Must be
+// called with mu held.
+func (fp *fileProvider) metadata(file *mockFile) model.Metadata {
+	metadata := MetadataFromFile(*file)
+	names := []string{file.Name}
+	// A directory moved beneath itself would make the parents loop, so stop once every file has been seen
+	for parent, ok := fp.fileById[file.ParentId]; ok && len(names) <= len(fp.files); parent, ok = fp.fileById[parent.ParentId] {
+		names = append(names, parent.Name)
+	}
+	slices.Reverse(names)
+	metadata.Path = path.Join(names...)
+	return metadata
+}
+
+// describe sets the details of the file with the given ID, leaving any that are empty as they are
+func (fp *fileProvider) describe(id model.FileId, name string, size int64, contentType string) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	file, ok := fp.fileById[id]
+	if !ok {
+		return
+	}
+	if name != "" {
+		file.Name = name
+		file.ContentType = contentTypeOf(file)
+	}
+	if size != 0 {
+		file.Size = size
+	}
+	if contentType != "" {
+		file.ContentType = contentType
+	}
+}
+
+// contentTypeOf guesses the content type of a file from the extension of its name
+func contentTypeOf(file *mockFile) string {
+	if file.IsDirectory {
+		return ""
 	}
+	return mime.TypeByExtension(path.Ext(file.Name))
 }
 
 // NewFileProvider creates a new file provider with the given number of files and directories.  The
@@ -39,7 +111,7 @@ func MetadataFromFile(file mockFile) model.Metadata {
 // manually add the files and directories using AddFile and AddDirectory.
 func NewFileProvider(fileCount int, directoryCount int) *fileProvider {
 
-	fp := &fileProvider{fileById: make(map[model.FileId]*mockFile), childrenById: make(map[model.FileId][]model.FileId)}
+	fp := &fileProvider{fileById: make(map[model.FileId]*mockFile), childrenById: make(map[model.FileId][]model.FileId), copies: make(map[model.FileId]map[int]string)}
 
 	for i := 0; i < directoryCount; i++ {
 		fileId := model.FileId("directory" + strconv.Itoa(i+1))
@@ -49,6 +121,7 @@ func NewFileProvider(fileCount int, directoryCount int) *fileProvider {
 	for i := 0; i < fileCount; i++ {
 		fileId := model.FileId("file" + strconv.Itoa(i+1))
 		fp.AddFile(fileId, model.FileId(""))
+		fp.fileById[fileId].Size = int64(randRange(0, 1<<20))
 	}
 
 	// Randomly create a tree structure
@@ -72,13 +145,80 @@ func NewFileProvider(fileCount int, directoryCount int) *fileProvider {
 
 // UpdateLastModified updates the last modified time of the file with the given ID.
 func (fp *fileProvider) UpdateLastModified(fileId model.FileId) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if file, ok := fp.fileById[fileId]; ok {
+		modify(file)
+		file.ETag = fp.nextETag()
+		fp.propagate(file.ParentId)
+		fp.logChange(fileId)
+	}
+}
+
+// TouchFile updates the last modified time of the file with the given ID without changing its content.
+func (fp *fileProvider) TouchFile(fileId model.FileId) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
 	if file, ok := fp.fileById[fileId]; ok {
-		file.LastModified = time.Now().UnixMilli()
+		modify(file)
+		fp.propagate(file.ParentId)
+		fp.logChange(fileId)
+	}
+}
+
+// modify moves the last modified time of the file forward to now, and by at least a millisecond, so that
+// two changes in the same millisecond are never mistaken for none
+func modify(file *mockFile) {
+	file.LastModified = max(time.Now().UnixMilli(), file.LastModified+1)
+}
+
+// propagate moves the last modified time of the directory and every directory above it forward, since
+// something beneath them has changed.  Must be called with mu held.
+func (fp *fileProvider) propagate(directoryId model.FileId) {
+	directory, ok := fp.fileById[directoryId]
+	// A directory moved beneath itself would make the parents loop, so stop once every file has been seen
+	for seen := 0; ok && seen < len(fp.files); seen++ {
+		modify(directory)
+		directory, ok = fp.fileById[directory.ParentId]
 	}
 }
 
+// logChange appends the id to the change log, dropping the oldest changes once it's full.  Must be called
+// with mu held.
+func (fp *fileProvider) logChange(id model.FileId) {
+	fp.changes = append(fp.changes, id)
+	if len(fp.changes) > changeLogLimit {
+		trim := len(fp.changes) - changeLogLimit
+		fp.changes = slices.Clone(fp.changes[trim:])
+		fp.changesTrimmed += trim
+	}
+}
+
+// ExpireChanges empties the change log, so that every cursor issued so far has expired
+func (fp *fileProvider) ExpireChanges() {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	// Skip a number as well, so that even a cursor at the end of the log has expired
+	fp.changesTrimmed += len(fp.changes) + 1
+	fp.changes = nil
+}
+
+// PropagatesModTimes reports that a change beneath a directory always moves the directory's last modified
+// time forward, as modelled by propagate
+func (fp *fileProvider) PropagatesModTimes() bool {
+	return true
+}
+
+// nextETag returns the ETag of a new revision of some file's content.  Must be called with mu held.
+func (fp *fileProvider) nextETag() string {
+	fp.revisions++
+	return `"` + strconv.Itoa(fp.revisions) + `"`
+}
+
 // UpdateAny updates the last modified time of a random file (not directory) in the file provider.
 func (fp *fileProvider) UpdateAny() model.FileId {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
 
 	firstNonDirectory := 0
 	for i := 0; i < len(fp.files); i++ {
@@ -90,31 +230,88 @@ func (fp *fileProvider) UpdateAny() model.FileId {
 
 	fileIndex := randRange(firstNonDirectory, len(fp.files))
 	file := fp.files[fileIndex]
-	file.LastModified = time.Now().UnixMilli()
+	modify(file)
+	file.ETag = fp.nextETag()
+	fp.propagate(file.ParentId)
+	fp.logChange(file.FileId)
 	return file.FileId
 }
 
 // AddFile adds a file to the file provider with the given ID and parent directory.
 func (fp *fileProvider) AddFile(id model.FileId, parentDirectory model.FileId) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
 	millis := time.Now().UnixMilli()
-	file := &mockFile{FileId: id, LastModified: millis, IsDirectory: false, ParentId: parentDirectory}
+	file := &mockFile{FileId: id, LastModified: millis, IsDirectory: false, ParentId: parentDirectory, Name: path.Base(string(id)), ETag: fp.nextETag()}
+	file.ContentType = contentTypeOf(file)
 	fp.files = append(fp.files, file)
 	fp.fileById[file.FileId] = file
 	fp.childrenById[file.ParentId] = append(fp.childrenById[file.ParentId], file.FileId)
+	fp.propagate(file.ParentId)
+	fp.logChange(id)
 }
 
 // AddDirectory adds a directory to the file provider with the given ID and parent directory.
 func (fp *fileProvider) AddDirectory(id model.FileId, parentDirectory model.FileId) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
 	millis := time.Now().UnixMilli()
-	directory := &mockFile{FileId: id, LastModified: millis, IsDirectory: true, ParentId: parentDirectory}
+	directory := &mockFile{FileId: id, LastModified: millis, IsDirectory: true, ParentId: parentDirectory, Name: path.Base(string(id))}
 	fp.files = append(fp.files, directory)
 	fp.fileById[directory.FileId] = directory
 	fp.childrenById[id] = []model.FileId{}
 	fp.childrenById[directory.ParentId] = append(fp.childrenById[directory.ParentId], directory.FileId)
+	fp.propagate(directory.ParentId)
+	fp.logChange(id)
+}
+
+// MoveFile moves the file or directory with the given ID beneath the given parent directory.
+func (fp *fileProvider) MoveFile(id model.FileId, parentDirectory model.FileId) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	file, ok := fp.fileById[id]
+	if !ok {
+		return
+	}
+	fp.childrenById[file.ParentId] = slices.DeleteFunc(fp.childrenById[file.ParentId], func(childId model.FileId) bool { return childId == id })
+	fp.propagate(file.ParentId)
+	file.ParentId = parentDirectory
+	fp.childrenById[parentDirectory] = append(fp.childrenById[parentDirectory], id)
+	fp.propagate(parentDirectory)
+	fp.logChange(id)
+}
+
+// RemoveFile removes the file or directory with the given ID, along with everything beneath it.
+func (fp *fileProvider) RemoveFile(id model.FileId) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if file, ok := fp.fileById[id]; ok {
+		fp.removeFile(id)
+		fp.propagate(file.ParentId)
+	}
+}
+
+func (fp *fileProvider) removeFile(id model.FileId) {
+	file, ok := fp.fileById[id]
+	if !ok {
+		return
+	}
+	for _, childId := range slices.Clone(fp.childrenById[id]) {
+		fp.removeFile(childId)
+	}
+	if file.IsDirectory {
+		delete(fp.childrenById, id)
+	}
+	fp.childrenById[file.ParentId] = slices.DeleteFunc(fp.childrenById[file.ParentId], func(childId model.FileId) bool { return childId == id })
+	fp.files = slices.DeleteFunc(fp.files, func(f *mockFile) bool { return f == file })
+	delete(fp.fileById, id)
+	fp.logChange(id)
 }
 
 // CreateWatchList creates a watch list of the given size.  The watch list is a list of file IDs that are randomly selected from the files in the file provider.
 func (fp *fileProvider) CreateWatchList(count int) []model.FileId {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
 	var watchList []model.FileId
 	availableFiles := slices.Clone(fp.files)
 
@@ -136,31 +333,49 @@ func (fp *fileProvider) CreateWatchList(count int) []model.FileId {
 
 // RetrieveMetadata returns the metadata for the file with the given ID. If the file does not exist, it returns an error.
 func (fp *fileProvider) RetrieveMetadata(fileId model.FileId) (model.Metadata, error) {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	return fp.retrieveMetadata(fileId)
+}
+
+func (fp *fileProvider) retrieveMetadata(fileId model.FileId) (model.Metadata, error) {
 	if _, ok := fp.fileById[fileId]; !ok {
-		return model.Metadata{}, errors.New("file not found")
+		return model.Metadata{}, model.ErrNotFound
 	}
-	return MetadataFromFile(*fp.fileById[fileId]), nil
+	return fp.metadata(fp.fileById[fileId]), nil
 }
 
 // CopyFile copies the file with the given ID.  If the file is a directory, it returns an error.
 func (fp *fileProvider) CopyFile(fileId model.FileId, lastModified int64, version int) error {
-	if file, ok := fp.fileById[fileId]; !ok {
-		return errors.New("file not found")
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	file, ok := fp.fileById[fileId]
+	if !ok {
+		return model.ErrNotFound
 	} else if file.IsDirectory {
 		return errors.New("file is a directory")
 	}
 	log.Println("Copying file ", fileId, " lastModified", lastModified, " version ", version)
+	if fp.copies[fileId] == nil {
+		fp.copies[fileId] = make(map[int]string)
+	}
+	fp.copies[fileId][version] = file.ETag
 	return nil
 }
 
 // GetChildren returns the children of the given file.  If FileID is empty, it returns the root directory.  If the file is not a directory, it returns an error.
 func (fp *fileProvider) GetChildren(fileId model.FileId) ([]model.Metadata, error) {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	return fp.getChildren(fileId)
+}
 
+func (fp *fileProvider) getChildren(fileId model.FileId) ([]model.Metadata, error) {
 	if fileIds, ok := fp.childrenById[fileId]; ok {
 		var metadata []model.Metadata
 		for _, fileId := range fileIds {
 			file := fp.fileById[fileId]
-			filemetadata, err := fp.RetrieveMetadata(file.FileId)
+			filemetadata, err := fp.retrieveMetadata(file.FileId)
 			if err != nil {
 				return nil, err
 			}
@@ -168,7 +383,133 @@ func (fp *fileProvider) GetChildren(fileId model.FileId) ([]model.Metadata, erro
 		}
 		return metadata, nil
 	}
-	return nil, errors.New("file not found")
+	return nil, model.ErrNotFound
+}
+
+// BatchRetrieveMetadata returns the metadata for the files with the given IDs, keyed by ID.  Files that don't exist are left out of the result.
+func (fp *fileProvider) BatchRetrieveMetadata(ctx context.Context, fileIds []model.FileId) (map[model.FileId]model.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	metadata := make(map[model.FileId]model.Metadata, len(fileIds))
+	for _, fileId := range fileIds {
+		if file, ok := fp.fileById[fileId]; ok {
+			metadata[fileId] = fp.metadata(file)
+		}
+	}
+	return metadata, nil
+}
+
+// BatchGetChildren returns the children of the directories with the given IDs, keyed by directory ID.  Directories that don't exist are left out of the result.
+func (fp *fileProvider) BatchGetChildren(ctx context.Context, fileIds []model.FileId) (map[model.FileId][]model.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	children := make(map[model.FileId][]model.Metadata, len(fileIds))
+	for _, fileId := range fileIds {
+		if metadata, err := fp.getChildren(fileId); err == nil {
+			children[fileId] = metadata
+		}
+	}
+	return children, nil
+}
+
+// DeleteCopy removes the copies of the file with the given ID, recording the deletion as the given version.
+func (fp *fileProvider) DeleteCopy(ctx context.Context, fileId model.FileId, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Println("Deleting copy of file ", fileId, " version ", version)
+	return nil
+}
+
+// MoveCopy moves the copies of the file with the given ID from one parent directory to another, recording the move as the given version.
+func (fp *fileProvider) MoveCopy(ctx context.Context, fileId model.FileId, fromParentId model.FileId, toParentId model.FileId, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Println("Moving copy of file ", fileId, " from ", fromParentId, " to ", toParentId, " version ", version)
+	return nil
+}
+
+// ChangesSince returns the ids changed since the cursor, each once, in the order they first changed.  The
+// cursor is the number of changes seen so far, so an empty cursor starts from the end of the log.
+func (fp *fileProvider) ChangesSince(ctx context.Context, cursor string) ([]model.FileId, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+
+	end := fp.changesTrimmed + len(fp.changes)
+	if cursor == "" {
+		return nil, strconv.Itoa(end), nil
+	}
+	seen, err := strconv.Atoi(cursor)
+	if err != nil || seen < fp.changesTrimmed || seen > end {
+		return nil, "", fmt.Errorf("%w: %q", model.ErrCursorExpired, cursor)
+	}
+
+	fileIds := []model.FileId{}
+	changed := make(map[model.FileId]bool)
+	for _, id := range fp.changes[seen-fp.changesTrimmed:] {
+		if !changed[id] {
+			changed[id] = true
+			fileIds = append(fileIds, id)
+		}
+	}
+	return fileIds, strconv.Itoa(end), nil
+}
+
+// CopyLocation returns where the copy of the version would be kept, were the copies real
+func (fp *fileProvider) CopyLocation(fileId model.FileId, version int) string {
+	return "mock://copies/" + string(fileId) + "/v" + strconv.Itoa(version)
+}
+
+// RestoreCopy gives the file the content it had when the version was copied, as a change like any other
+func (fp *fileProvider) RestoreCopy(ctx context.Context, version model.FileVersion) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	file, ok := fp.fileById[version.FileId]
+	if !ok {
+		return model.ErrNotFound
+	}
+	etag, ok := fp.copies[version.FileId][version.Version]
+	if !ok {
+		return fmt.Errorf("no copy of %s version %d", version.FileId, version.Version)
+	}
+	log.Println("Restoring file ", version.FileId, " to version ", version.Version)
+	modify(file)
+	file.ETag = etag
+	fp.propagate(file.ParentId)
+	fp.logChange(file.FileId)
+	return nil
+}
+
+// PruneCopy forgets the copy of the version, so it can no longer be restored
+func (fp *fileProvider) PruneCopy(ctx context.Context, version model.FileVersion) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	log.Println("Pruning copy of file ", version.FileId, " version ", version.Version)
+	delete(fp.copies[version.FileId], version.Version)
+	return nil
+}
+
+// CopiedVersions returns the versions of the file whose copies are kept, in order
+func (fp *fileProvider) CopiedVersions(fileId model.FileId) []int {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	return slices.Sorted(maps.Keys(fp.copies[fileId]))
 }
 
 func randRange(min, max int) int {
@@ -7,19 +7,26 @@ import (
 	"github.com/jsfinn/enfi-assessment/model"
 )
 
+// fileDescription is a file or directory in a datafile.  The name defaults to the id, and the content type
+// is guessed from the name's extension unless it's given.
 type fileDescription struct {
 	Id          string             `json:"fileId"`
 	IsDirectory bool               `json:"isDirectory"`
 	Children    []*fileDescription `json:"children"`
+	Name        string             `json:"name"`
+	Size        int64              `json:"size"`
+	ContentType string             `json:"contentType"`
 }
 
+// testfile is the format of a datafile.  Each watchlist entry is either an id, or an object with the id
+// and its watch options.
 type testfile struct {
 	Filesystem []*fileDescription `json:"filesystem"`
-	Watchlist  []string           `json:"watchlist"`
+	Watchlist  []model.WatchEntry `json:"watchlist"`
 	Updates    [][]string         `json:"updates"`
 }
 
-func NewFileProviderFromFile(filename string) (fileProvider *fileProvider, watchlist []model.FileId, updates [][]model.FileId, err error) {
+func NewFileProviderFromFile(filename string) (fileProvider *fileProvider, watchlist []model.WatchEntry, updates [][]model.FileId, err error) {
 	var testfile testfile
 	var data []byte
 
@@ -32,17 +39,10 @@ func NewFileProviderFromFile(filename string) (fileProvider *fileProvider, watch
 	fileProvider = NewFileProvider(0, 0)
 
 	for _, f := range testfile.Filesystem {
-		if f.IsDirectory {
-			fileProvider.AddDirectory(model.FileId(f.Id), "")
-			addChildren(fileProvider, f)
-		} else {
-			fileProvider.AddFile(model.FileId(f.Id), "")
-		}
+		addFile(fileProvider, f, "")
 	}
 
-	for _, f := range testfile.Watchlist {
-		watchlist = append(watchlist, model.FileId(f))
-	}
+	watchlist = testfile.Watchlist
 
 	for _, u := range testfile.Updates {
 		var update []model.FileId
@@ -55,14 +55,15 @@ func NewFileProviderFromFile(filename string) (fileProvider *fileProvider, watch
 	return
 }
 
-func addChildren(fp *fileProvider, f *fileDescription) {
-	parentId := model.FileId(f.Id)
-	for _, c := range f.Children {
-		if c.IsDirectory {
-			fp.AddDirectory(model.FileId(c.Id), parentId)
-			addChildren(fp, c)
-		} else {
-			fp.AddFile(model.FileId(c.Id), parentId)
+// addFile adds the file or directory beneath the parent, along with everything beneath it
+func addFile(fp *fileProvider, f *fileDescription, parentId model.FileId) {
+	if f.IsDirectory {
+		fp.AddDirectory(model.FileId(f.Id), parentId)
+		for _, c := range f.Children {
+			addFile(fp, c, model.FileId(f.Id))
 		}
+	} else {
+		fp.AddFile(model.FileId(f.Id), parentId)
 	}
+	fp.describe(model.FileId(f.Id), f.Name, f.Size, f.ContentType)
 }
@@ -4,7 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/jsfinn/enfi-assessment/model"
 )
 
 func TestFileProviderReader(t *testing.T) {
@@ -38,3 +43,58 @@ func TestNewFileProviderFromFile(t *testing.T) {
 	fmt.Println(watchlist)
 	fmt.Println(steps)
 }
+
+func TestWatchlistEntriesWithOptions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "testdata.json")
+	data := `{
+		"filesystem": [{"fileId": "dir1", "isDirectory": true, "children": [{"fileId": "file1"}]}],
+		"watchlist": ["file1", {"id": "dir1", "maxDepth": 2, "exclude": ["*.tmp"]}]
+	}`
+	if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, watchlist, _, err := NewFileProviderFromFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	want := []model.WatchEntry{
+		{Id: "file1"},
+		{Id: "dir1", WatchOptions: model.WatchOptions{MaxDepth: 2, Exclude: []string{"*.tmp"}}},
+	}
+	if !reflect.DeepEqual(watchlist, want) {
+		t.Errorf("got watchlist %+v, want %+v", watchlist, want)
+	}
+}
+
+func TestFileDetails(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "testdata.json")
+	data := `{
+		"filesystem": [{"fileId": "d1", "name": "reports", "isDirectory": true, "children": [
+			{"fileId": "f1", "name": "q3.csv", "size": 2048},
+			{"fileId": "f2", "name": "notes", "contentType": "text/markdown"}
+		]}]
+	}`
+	if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, _, _, err := NewFileProviderFromFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	f1, _ := provider.RetrieveMetadata("f1")
+	if f1.Name != "q3.csv" || f1.Path != "reports/q3.csv" || f1.Size != 2048 || f1.ParentId != "d1" || !strings.HasPrefix(f1.ContentType, "text/csv") {
+		t.Errorf("f1: got %+v", f1)
+	}
+	f2, _ := provider.RetrieveMetadata("f2")
+	if f2.Path != "reports/notes" || f2.ContentType != "text/markdown" {
+		t.Errorf("f2: got %+v", f2)
+	}
+
+	// moving the file changes its path but not its id
+	provider.MoveFile("f1", "")
+	if moved, _ := provider.RetrieveMetadata("f1"); moved.Path != "q3.csv" {
+		t.Errorf("f1: got path %q after moving to the root, want q3.csv", moved.Path)
+	}
+}
@@ -1,8 +1,12 @@
 package mock
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+
+	"github.com/jsfinn/enfi-assessment/model"
 )
 
 // assertEqual checks if two integers are equal.
@@ -62,3 +66,51 @@ func TestCreateWatchList(t *testing.T) {
 	assertEqual(t, watchCount, len(watchList), "watchList count")
 	fmt.Printf("watchList: %v\n", watchList)
 }
+
+func TestBatchCalls(t *testing.T) {
+	fp := NewFileProvider(0, 0)
+
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir2", "dir1")
+	fp.AddFile("file1", "")
+	fp.AddFile("file2", "dir1")
+
+	metadata, err := fp.BatchRetrieveMetadata(context.Background(), []model.FileId{"dir1", "file1", "missing"})
+	assertEqual(t, nil, err, "BatchRetrieveMetadata error")
+	assertEqual(t, 2, len(metadata), "metadata")
+	assertEqual(t, true, metadata["dir1"].IsDirectory, "dir1 is a directory")
+
+	children, err := fp.BatchGetChildren(context.Background(), []model.FileId{"dir1", "dir2", "missing"})
+	assertEqual(t, nil, err, "BatchGetChildren error")
+	assertEqual(t, 2, len(children), "children")
+	assertEqual(t, 2, len(children["dir1"]), "dir1Children")
+	assertEqual(t, 0, len(children["dir2"]), "dir2Children")
+}
+
+func TestChangeLog(t *testing.T) {
+	fp := NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	ctx := context.Background()
+
+	changes, cursor, err := fp.ChangesSince(ctx, "")
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("got %v, %v from an empty cursor, want no changes", changes, err)
+	}
+
+	fp.AddFile("dir1/file1", "dir1")
+	fp.AddFile("dir1/file2", "dir1")
+	fp.UpdateLastModified("dir1/file1")
+	fp.RemoveFile("dir1")
+	changes, next, err := fp.ChangesSince(ctx, cursor)
+	if err != nil {
+		t.Fatalf("Error listing changes: %v", err)
+	}
+	if got := fmt.Sprint(changes); got != "[dir1/file1 dir1/file2 dir1]" {
+		t.Errorf("got changes %s, want each file once and the removed directory", got)
+	}
+
+	fp.ExpireChanges()
+	if _, _, err := fp.ChangesSince(ctx, next); !errors.Is(err, model.ErrCursorExpired) {
+		t.Errorf("got %v after the log expired, want ErrCursorExpired", err)
+	}
+}
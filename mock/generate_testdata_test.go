@@ -13,6 +13,16 @@ type File struct {
 	FileID      string `json:"fileId"`
 	IsDirectory bool   `json:"isDirectory,omitempty"`
 	Children    []File `json:"children,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+// extensions are given to the generated file names, so the files get a variety of content types
+var extensions = []string{".txt", ".csv", ".json", ".png", ".pdf"}
+
+// newFile returns a file with a random name and size
+func newFile(fileID string) File {
+	return File{FileID: fileID, Name: fileID + extensions[rand.Intn(len(extensions))], Size: rand.Int63n(1 << 20)}
 }
 
 // Data represents the overall JSON structure
@@ -79,7 +89,7 @@ func generateFilesystem(numFiles, numDirs int) ([]File, []string) {
 		for j := 0; j < numFilesInDir && fileCounter <= numFiles; j++ {
 			fileID := fmt.Sprintf("file%d", fileCounter)
 			fileCounter++
-			directory.Children = append(directory.Children, File{FileID: fileID})
+			directory.Children = append(directory.Children, newFile(fileID))
 			allFiles = append(allFiles, fileID)
 		}
 
@@ -99,7 +109,7 @@ func generateFilesystem(numFiles, numDirs int) ([]File, []string) {
 			for l := 0; l < numFilesInSubdir && fileCounter <= numFiles; l++ {
 				fileID := fmt.Sprintf("file%d", fileCounter)
 				fileCounter++
-				subdir.Children = append(subdir.Children, File{FileID: fileID})
+				subdir.Children = append(subdir.Children, newFile(fileID))
 				allFiles = append(allFiles, fileID)
 			}
 
@@ -112,7 +122,7 @@ func generateFilesystem(numFiles, numDirs int) ([]File, []string) {
 	// Add remaining files at root level
 	for fileCounter <= numFiles {
 		fileID := fmt.Sprintf("file%d", fileCounter)
-		filesystem = append(filesystem, File{FileID: fileID})
+		filesystem = append(filesystem, newFile(fileID))
 		allFiles = append(allFiles, fileID)
 		fileCounter++
 	}
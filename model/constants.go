@@ -3,7 +3,35 @@ package model
 type FileId string
 
 type Metadata struct {
-	Id           FileId
+	Id FileId
+	// LastModified is when the file was last modified, in milliseconds since the Unix epoch.  The monitor
+	// compares it with its own clock to decide when a change has settled, so it must be wall-clock time
+	// rather than a revision counter.
 	LastModified int64
 	IsDirectory  bool
+	ParentId     FileId
+	// Name is the file's own name, the last element of Path
+	Name string
+	// Path is the slash-separated path of the file from the root of the Api, for display; unlike the
+	// Id, it changes when the file or a directory above it moves or is renamed
+	Path string
+	// Size is the size of the file's content in bytes, or zero for a directory
+	Size int64
+	// ContentType is the MIME type of the file's content, or empty if it isn't known
+	ContentType string
+	// ContentHash identifies the file's content, such as a checksum or an ETag, or is empty if the Api
+	// doesn't provide one with the metadata
+	ContentHash string
 }
+
+// WatchType describes why a file is being watched
+type WatchType string
+
+const (
+	// WatchTypeExplicit is a file that is listed in the watchlist
+	WatchTypeExplicit WatchType = "explicit"
+	// WatchTypeImplicit is a file found beneath a directory that is listed in the watchlist
+	WatchTypeImplicit WatchType = "implicit"
+	// WatchTypeUnwatched is a file that was watched but has since moved out of the watched tree
+	WatchTypeUnwatched WatchType = "unwatched"
+)
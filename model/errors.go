@@ -0,0 +1,32 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned by an Api when the requested file does not exist
+var ErrNotFound = errors.New("file not found")
+
+// ErrCursorExpired is returned by an Api's change feed when a cursor is too old, or otherwise unknown, to
+// list the changes since it
+var ErrCursorExpired = errors.New("change cursor expired")
+
+// ErrThrottled is returned by an Api when the provider has rejected a call for going over its quota, as
+// with an HTTP 429.  An Api that knows how long the provider wants it to back off can return a
+// ThrottledError instead.
+var ErrThrottled = errors.New("call throttled")
+
+// ThrottledError is ErrThrottled along with how long the provider asked to wait before calling again
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrThrottled, e.RetryAfter)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrThrottled
+}
@@ -0,0 +1,18 @@
+package model
+
+// FileVersion is a version of a file that has been copied, or the tombstone of a file that was deleted
+type FileVersion struct {
+	FileId  FileId `json:"fileId"`
+	Version int    `json:"version"`
+	// LastModified is when the version was last modified at the source, or when the deletion was found for
+	// a tombstone, in milliseconds since the epoch
+	LastModified int64 `json:"lastModified"`
+	// CopiedAt is when the copy was made, or the tombstone recorded, in milliseconds since the epoch
+	CopiedAt int64 `json:"copiedAt"`
+	// Deleted is set on a tombstone, which has no copy
+	Deleted bool `json:"deleted,omitempty"`
+	// Size is the size of the version in bytes, or zero if it isn't known
+	Size int64 `json:"size,omitempty"`
+	// Location is where the api put the copy, or empty if the api doesn't say
+	Location string `json:"location,omitempty"`
+}
@@ -0,0 +1,81 @@
+package model
+
+import "encoding/json"
+
+// WatchOptions limits what is watched beneath a directory in the watchlist.  The zero value watches the
+// whole tree beneath the directory.
+type WatchOptions struct {
+	// MaxDepth is the number of levels beneath the directory that are watched: 1 watches only the
+	// directory's own children.  Zero means there is no limit.
+	MaxDepth int `json:"maxDepth,omitempty" mapstructure:"max_depth"`
+	// NonRecursive watches only the directory's own children, the same as a MaxDepth of 1
+	NonRecursive bool `json:"nonRecursive,omitempty" mapstructure:"non_recursive"`
+	// Include, if not empty, limits the files watched beneath the directory to those matching one of the
+	// patterns.  Directories are still scanned whether they match or not.
+	Include []string `json:"include,omitempty" mapstructure:"include"`
+	// Exclude skips the files and directories beneath the directory that match any of the patterns.  An
+	// excluded directory is never scanned, so nothing beneath it is watched.
+	Exclude []string `json:"exclude,omitempty" mapstructure:"exclude"`
+	// Priority raises, or lowers if negative, the priority of copying the files beneath the entry, between
+	// -100 and 100
+	Priority int `json:"priority,omitempty" mapstructure:"priority"`
+	// Retention limits the copied versions kept of each file beneath the entry.  Nil keeps every version.
+	Retention *RetentionPolicy `json:"retention,omitempty" mapstructure:"retention"`
+}
+
+// RetentionPolicy decides which copied versions of a file are kept.  A version is kept if any of the
+// policy's rules keeps it, and the latest version is always kept.  Periods are calendar days, weeks
+// starting on Monday, and months, in UTC.
+type RetentionPolicy struct {
+	// KeepLast keeps the latest N versions
+	KeepLast int `json:"keepLast,omitempty" mapstructure:"keep_last"`
+	// KeepDays keeps every version that was current at some point in the last D days, so the file can be
+	// restored to any time within them
+	KeepDays int `json:"keepDays,omitempty" mapstructure:"keep_days"`
+	// Daily, Weekly and Monthly thin out older versions grandfather-father-son style, keeping the version
+	// that was current at the end of each of the last Daily days, Weekly weeks and Monthly months
+	Daily   int `json:"daily,omitempty" mapstructure:"daily"`
+	Weekly  int `json:"weekly,omitempty" mapstructure:"weekly"`
+	Monthly int `json:"monthly,omitempty" mapstructure:"monthly"`
+}
+
+// WatchEntry is an id in the watchlist along with its options.  In JSON, an entry without options can
+// be written as just its id.
+type WatchEntry struct {
+	Id           FileId `json:"id" mapstructure:"id"`
+	WatchOptions `mapstructure:",squash"`
+}
+
+func (e *WatchEntry) UnmarshalJSON(data []byte) error {
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*e = WatchEntry{Id: FileId(id)}
+		return nil
+	}
+	type entry WatchEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+func (e WatchEntry) MarshalJSON() ([]byte, error) {
+	if e.WatchOptions.IsZero() {
+		return json.Marshal(e.Id)
+	}
+	type entry WatchEntry
+	return json.Marshal(entry(e))
+}
+
+// IsZero returns whether the options are the defaults: the whole tree is watched at the normal priority,
+// and every version is kept
+func (o WatchOptions) IsZero() bool {
+	return o.MaxDepth == 0 && !o.NonRecursive && len(o.Include) == 0 && len(o.Exclude) == 0 && o.Priority == 0 &&
+		o.Retention == nil
+}
+
+// WatchEntryIds returns the ids of the entries
+func WatchEntryIds(entries []WatchEntry) []FileId {
+	fileIds := make([]FileId, len(entries))
+	for i, entry := range entries {
+		fileIds[i] = entry.Id
+	}
+	return fileIds
+}
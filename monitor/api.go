@@ -1,6 +1,12 @@
 package monitor
 
-import "github.com/jsfinn/enfi-assessment/model"
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
 
 type Api interface {
 	// RetrieveMetadata returns the metadata for the file with the given ID. If the file does not exist, it returns an error.
@@ -12,3 +18,245 @@ type Api interface {
 	// GetChildren returns the children of the given file.  If FileID is empty, it returns the root directory.  If the file is not a directory, it returns an error.
 	GetChildren(fileId model.FileId) ([]model.Metadata, error)
 }
+
+// ContextApi is the context-aware version of Api used by the monitor.  Implementations should stop
+// work and return ctx.Err() as soon as the context is cancelled or its deadline passes.  A call the
+// provider rejected for going over its quota should return model.ErrThrottled, or a model.ThrottledError,
+// so that the monitor slows down.
+type ContextApi interface {
+	// RetrieveMetadata returns the metadata for the file with the given ID. If the file does not exist, it returns an error.
+	RetrieveMetadata(ctx context.Context, fileId model.FileId) (model.Metadata, error)
+
+	// CopyFile copies the file with the given ID.  If the file is a directory, it returns an error.  It must
+	// not return until it has stopped writing the copy, even when the context is done, since the monitor may
+	// copy the same file again as soon as it returns, and copies of one file must never overlap.
+	CopyFile(ctx context.Context, fileId model.FileId, lastUpdated int64, version int) error
+
+	// GetChildren returns the children of the given file.  If FileID is empty, it returns the root directory.  If the file is not a directory, it returns an error.
+	GetChildren(ctx context.Context, fileId model.FileId) ([]model.Metadata, error)
+}
+
+// AdaptApi wraps an Api that doesn't accept a context so that it can be used by the monitor.  The
+// wrapped call can't be interrupted, so when the context is done the adapter returns ctx.Err() straight
+// away and leaves the call to finish in the background, discarding its result.  The error says when the
+// call has returned (see detachedCallError), and a file whose copy was left running isn't copied again
+// until it has, so that copies of one file still never overlap.
+func AdaptApi(api Api) ContextApi {
+	return &contextAdapter{api: api, copying: make(map[model.FileId]chan struct{})}
+}
+
+type contextAdapter struct {
+	api Api
+
+	mu sync.Mutex
+	// copying holds a channel for each file being copied, closed once its copy returns
+	copying map[model.FileId]chan struct{}
+}
+
+// Unwrap returns the Api wrapped by the adapter
+func (a *contextAdapter) Unwrap() Api {
+	return a.api
+}
+
+func (a *contextAdapter) RetrieveMetadata(ctx context.Context, fileId model.FileId) (model.Metadata, error) {
+	return callWithContext(ctx, func() (model.Metadata, error) {
+		return a.api.RetrieveMetadata(fileId)
+	})
+}
+
+func (a *contextAdapter) CopyFile(ctx context.Context, fileId model.FileId, lastUpdated int64, version int) error {
+	release, err := a.holdCopy(ctx, fileId)
+	if err != nil {
+		return err
+	}
+	_, err = callWithContext(ctx, func() (struct{}, error) {
+		return struct{}{}, a.api.CopyFile(fileId, lastUpdated, version)
+	})
+	afterReturn(err, release)
+	return err
+}
+
+// holdCopy waits until no copy of the file is running, including one left running in the background by
+// an earlier call, and holds the file until the returned function is called
+func (a *contextAdapter) holdCopy(ctx context.Context, fileId model.FileId) (func(), error) {
+	for {
+		a.mu.Lock()
+		running, ok := a.copying[fileId]
+		if !ok {
+			returned := make(chan struct{})
+			a.copying[fileId] = returned
+			a.mu.Unlock()
+			return func() {
+				a.mu.Lock()
+				delete(a.copying, fileId)
+				a.mu.Unlock()
+				close(returned)
+			}, nil
+		}
+		a.mu.Unlock()
+
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (a *contextAdapter) GetChildren(ctx context.Context, fileId model.FileId) ([]model.Metadata, error) {
+	return callWithContext(ctx, func() ([]model.Metadata, error) {
+		return a.api.GetChildren(fileId)
+	})
+}
+
+// detachedCallError is returned by the adapter when the context is done before the wrapped call returns.
+// It unwraps to ctx.Err(), and returned is closed once the call, still running in the background, returns.
+type detachedCallError struct {
+	err      error
+	returned <-chan struct{}
+}
+
+func (e *detachedCallError) Error() string { return e.err.Error() }
+
+func (e *detachedCallError) Unwrap() error { return e.err }
+
+// afterReturn calls f once the call that returned err has returned, which is straight away unless err is
+// a detachedCallError
+func afterReturn(err error, f func()) {
+	var detached *detachedCallError
+	if !errors.As(err, &detached) {
+		f()
+		return
+	}
+	go func() {
+		<-detached.returned
+		f()
+	}()
+}
+
+// callWithContext runs the call, returning early with a detachedCallError if the context is done first
+func callWithContext[T any](ctx context.Context, call func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	// A context that can never be done doesn't need a goroutine to watch it
+	if ctx.Done() == nil {
+		return call()
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		value, err := call()
+		done <- result{value: value, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, &detachedCallError{err: ctx.Err(), returned: returned}
+	}
+}
+
+// BatchMetadataApi is an optional capability of an Api that can retrieve the metadata for many files in
+// a single call.  The monitor uses it instead of RetrieveMetadata when it's available.
+type BatchMetadataApi interface {
+	// BatchRetrieveMetadata returns the metadata for the files with the given IDs, keyed by ID.  Files that
+	// don't exist are left out of the result.
+	BatchRetrieveMetadata(ctx context.Context, fileIds []model.FileId) (map[model.FileId]model.Metadata, error)
+}
+
+// BatchChildrenApi is an optional capability of an Api that can retrieve the children of many
+// directories in a single call.  The monitor uses it instead of GetChildren when it's available.
+type BatchChildrenApi interface {
+	// BatchGetChildren returns the children of the directories with the given IDs, keyed by directory ID.
+	// Directories that don't exist are left out of the result.
+	BatchGetChildren(ctx context.Context, fileIds []model.FileId) (map[model.FileId][]model.Metadata, error)
+}
+
+// capability returns the api as the optional capability T, if it implements it.  An api wrapped by
+// AdaptApi is checked as well, so a legacy Api can still provide context-aware capabilities.
+func capability[T any](api ContextApi) (T, bool) {
+	if c, ok := api.(T); ok {
+		return c, true
+	}
+	if adapter, ok := api.(interface{ Unwrap() Api }); ok {
+		c, ok := adapter.Unwrap().(T)
+		return c, ok
+	}
+	var zero T
+	return zero, false
+}
+
+// DeleteApi is an optional capability of an Api that can mirror the deletion of a watched file, by
+// removing or marking its copies.  Without it, deletions are still recorded in the cache.
+type DeleteApi interface {
+	// DeleteCopy mirrors the deletion of the file with the given ID, recorded as the given version.
+	DeleteCopy(ctx context.Context, fileId model.FileId, version int) error
+}
+
+// MoveApi is an optional capability of an Api that can mirror a watched file moving to another parent
+// directory, without copying the file again.
+type MoveApi interface {
+	// MoveCopy mirrors the file with the given ID moving from one parent directory to another, recorded as
+	// the given version.
+	MoveCopy(ctx context.Context, fileId model.FileId, fromParentId model.FileId, toParentId model.FileId, version int) error
+}
+
+// HashApi is an optional capability of an Api that can compute a hash of a file's content.  It's only
+// used for files whose metadata doesn't already carry a ContentHash, to tell a file that was touched from
+// one whose content changed.
+type HashApi interface {
+	// ContentHash returns a hash of the content of the file with the given ID.  Equal content must give
+	// equal hashes.  If the file is a directory, it returns an error.
+	ContentHash(ctx context.Context, fileId model.FileId) (string, error)
+}
+
+// ModTimePropagationApi is an optional capability of an Api whose directories' LastModified moves forward
+// whenever anything beneath them changes, at any depth.  With it, the monitor skips retrieving the children
+// of directories that haven't changed since the last complete sweep.
+type ModTimePropagationApi interface {
+	// PropagatesModTimes returns whether a file being added, removed, moved, modified or touched anywhere
+	// beneath a directory always moves the directory's LastModified forward
+	PropagatesModTimes() bool
+}
+
+// ChangeFeedApi is an optional capability of an Api that lists the files changed since a cursor, as cloud
+// drives do, which is much cheaper than walking the watched tree.  The monitor follows the feed instead of
+// sweeping the whole watchlist when it's available.
+type ChangeFeedApi interface {
+	// ChangesSince returns the ids of the files and directories added, modified, moved or removed since the
+	// cursor was issued, along with the cursor to pass next time.  Removing a directory reports everything
+	// beneath it as removed too, but any other change to a directory only reports the directory itself.  An
+	// empty cursor returns no changes, only a cursor for the current end of the feed.  If the cursor has
+	// expired, it returns model.ErrCursorExpired.
+	ChangesSince(ctx context.Context, cursor string) (fileIds []model.FileId, next string, err error)
+}
+
+// CopyLocationApi is an optional capability of an Api that can say where it put the copy of a version, so
+// that the version catalog can record it
+type CopyLocationApi interface {
+	// CopyLocation returns where the copy of the given version of the file is kept
+	CopyLocation(fileId model.FileId, version int) string
+}
+
+// PruneApi is an optional capability of an Api that can remove the copy of a version that's no longer
+// kept by its retention policy.  Without it, pruned versions are only removed from the version catalog.
+type PruneApi interface {
+	// PruneCopy removes the copy of the given version.  A copy that has already been removed isn't an error.
+	PruneCopy(ctx context.Context, version model.FileVersion) error
+}
+
+// RestoreApi is an optional capability of an Api that can restore a file from one of its copies
+type RestoreApi interface {
+	// RestoreCopy replaces the content of the file with the copy of the given version.  The file is then
+	// modified like any other, so the restored content is copied again as a new version.
+	RestoreCopy(ctx context.Context, version model.FileVersion) error
+}
@@ -0,0 +1,135 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/samber/lo"
+)
+
+// retrieveMetadata returns the metadata for each of the given files that could be retrieved, along with
+// the ids of the files that don't exist.  ok is false if any call failed for another reason.  A batch call
+// is used when the api supports it, unless BatchSize is 1, otherwise each file is retrieved on its own.
+func (m *Monitor) retrieveMetadata(ctx context.Context, fileIds []model.FileId) (metadata []model.Metadata, missing []model.FileId, ok bool) {
+	ok = true
+
+	if m.batchMetadata == nil || m.options.BatchSize == 1 || len(fileIds) == 1 {
+		for _, fileId := range fileIds {
+			finish, err := m.metadataLimiter.wait(ctx)
+			if err != nil {
+				return metadata, missing, false
+			}
+			callCtx, cancel := callContext(ctx, m.options.MetadataTimeoutMs)
+			done := m.timeCall("retrieve_metadata")
+			result, err := m.api.RetrieveMetadata(callCtx, fileId)
+			done()
+			cancel()
+			finish(err)
+			m.metrics.Counter("metadata_retrieved_calls").Inc()
+
+			if err != nil {
+				m.metrics.Counter("files_watched").Inc()
+				log.Printf("Error retrieving metadata for FileId %s: %v", fileId, err)
+				if errors.Is(err, model.ErrNotFound) {
+					missing = append(missing, fileId)
+				} else {
+					ok = false
+				}
+				continue
+			}
+			metadata = append(metadata, result)
+		}
+		return metadata, missing, ok
+	}
+
+	finish, err := m.metadataLimiter.wait(ctx)
+	if err != nil {
+		return nil, nil, false
+	}
+	callCtx, cancel := callContext(ctx, m.options.MetadataTimeoutMs)
+	done := m.timeCall("batch_retrieve_metadata")
+	results, err := m.batchMetadata.BatchRetrieveMetadata(callCtx, fileIds)
+	done()
+	cancel()
+	finish(err)
+	m.metrics.Counter("batch_metadata_retrieved_calls").Inc()
+
+	if err != nil {
+		log.Printf("Error retrieving metadata for %d files: %v", len(fileIds), err)
+		return nil, nil, false
+	}
+
+	for _, fileId := range fileIds {
+		if result, found := results[fileId]; found {
+			metadata = append(metadata, result)
+		} else {
+			m.metrics.Counter("files_watched").Inc()
+			log.Printf("Error retrieving metadata for FileId %s: %v", fileId, model.ErrNotFound)
+			missing = append(missing, fileId)
+		}
+	}
+	return metadata, missing, ok
+}
+
+// retrieveChildren returns the children of each of the given directories that could be retrieved, keyed
+// by directory.  ok is false if any call failed for a reason other than the directory not existing.  Batch
+// calls of up to BatchSize directories are used when the api supports them, unless BatchSize is 1,
+// otherwise the children of each directory are retrieved on their own.
+func (m *Monitor) retrieveChildren(ctx context.Context, directories []model.FileId) (childrenById map[model.FileId][]model.Metadata, ok bool) {
+	childrenById = make(map[model.FileId][]model.Metadata, len(directories))
+	ok = true
+
+	if m.batchChildren == nil || m.options.BatchSize == 1 || len(directories) == 1 {
+		for _, directory := range directories {
+			finish, err := m.childrenLimiter.wait(ctx)
+			if err != nil {
+				return childrenById, false
+			}
+			callCtx, cancel := callContext(ctx, m.options.ChildrenTimeoutMs)
+			done := m.timeCall("get_children")
+			children, err := m.api.GetChildren(callCtx, directory)
+			done()
+			cancel()
+			finish(err)
+			m.metrics.Counter("get_children_calls").Inc()
+
+			if err != nil {
+				log.Printf("Error retrieving children for FileId %s: %v", directory, err)
+				ok = ok && errors.Is(err, model.ErrNotFound)
+				continue
+			}
+			childrenById[directory] = children
+		}
+		return childrenById, ok
+	}
+
+	for _, chunk := range lo.Chunk(directories, m.options.BatchSize) {
+		finish, err := m.childrenLimiter.wait(ctx)
+		if err != nil {
+			return childrenById, false
+		}
+		callCtx, cancel := callContext(ctx, m.options.ChildrenTimeoutMs)
+		done := m.timeCall("batch_get_children")
+		results, err := m.batchChildren.BatchGetChildren(callCtx, chunk)
+		done()
+		cancel()
+		finish(err)
+		m.metrics.Counter("batch_get_children_calls").Inc()
+
+		if err != nil {
+			log.Printf("Error retrieving children for %d directories: %v", len(chunk), err)
+			ok = false
+			continue
+		}
+		for _, directory := range chunk {
+			if children, found := results[directory]; found {
+				childrenById[directory] = children
+			} else {
+				log.Printf("Error retrieving children for FileId %s: %v", directory, model.ErrNotFound)
+			}
+		}
+	}
+	return childrenById, ok
+}
@@ -1,30 +1,113 @@
 package monitor
 
 import (
+	"sync"
+
 	"github.com/jsfinn/enfi-assessment/model"
 )
 
-// Cache is an interface that defines the methods for a cache
+// Cache is an interface that defines the methods for a cache.  The monitor's pipeline calls the cache
+// from several goroutines at once, so implementations must be safe for concurrent use: every method may
+// be called concurrently with any other, and each method must behave as a single atomic operation.
 type Cache interface {
-	// Get returns the metadata for the file with the given ID.
+	// Get returns the last modified time and version of the file with the given ID.  If the file is not
+	// in the cache, it returns zero for both and leaves the cache unchanged.
 	Get(id model.FileId) (lastModified int64, version int)
-	// Update updates the last modified time of the file with the given ID.
+	// Update updates the last modified time of the file with the given ID and bumps its version.
 	Update(id model.FileId, lastModified int64) (newVersion int)
+	// CompareAndUpdate updates the file and bumps its version only if metadata.LastModified is newer
+	// than the cached last modified time, storing the rest of the file's metadata along with it.  The
+	// comparison and the update happen atomically, so of two concurrent calls with the same LastModified
+	// only one will bump the version.  It returns the file's version after the call and whether it was
+	// updated.  A new version is left pending until MarkCopied is called with it.
+	CompareAndUpdate(metadata model.Metadata) (version int, updated bool)
+	// Touch updates the last modified time of the file without a new version, if metadata.LastModified is
+	// newer but metadata.ContentHash matches the hash of the file's latest version.  It returns whether the
+	// file was touched; nothing is recorded if either hash is empty, or the file is deleted.
+	Touch(metadata model.Metadata) (touched bool)
+	// Metadata returns the metadata of the file with the given ID as it was last recorded, and whether the
+	// file is in the cache
+	Metadata(id model.FileId) (metadata model.Metadata, found bool)
+	// ContentHash returns the content hash of the file's latest version, or empty if it isn't known
+	ContentHash(id model.FileId) string
+	// MarkCopied records that the given version of the file has been copied.  It returns whether the file
+	// was waiting for that version to be copied; a version that has since been superseded is ignored.
+	MarkCopied(id model.FileId, version int) (copied bool)
+	// PendingVersion returns the version of the file that is waiting to be copied, or zero if there isn't one
+	PendingVersion(id model.FileId) int
+	// Move records the file moving to the parent in metadata.ParentId as a new version, storing its new
+	// name and path along with it.  It returns the move's version, the previous parent and whether it was
+	// recorded; nothing is recorded if the file isn't in the cache, is deleted, or already has the parent.
+	Move(metadata model.Metadata) (version int, previousParentId model.FileId, moved bool)
+	// Delete records a tombstone for the file with the given ID as a new version, so that the deletion
+	// can be mirrored like any other change.  It returns the tombstone's version and whether it was
+	// recorded; nothing is recorded if the file isn't in the cache or is already deleted.  Any version
+	// waiting to be copied is no longer pending.  A later CompareAndUpdate always replaces the tombstone,
+	// whatever the last modified time.
+	Delete(id model.FileId) (version int, deleted bool)
+	// IsDeleted returns whether the latest version of the file with the given ID is a tombstone
+	IsDeleted(id model.FileId) bool
 	// GetAllCacheKeys returns all the keys in the cache
 	GetAllCacheKeys() []model.FileId
+	// Directory returns the last modified time and the children recorded for the directory with the given
+	// ID, and whether it has been recorded.  Directories are kept apart from files: they have no versions and
+	// aren't among the keys returned by GetAllCacheKeys.
+	Directory(id model.FileId) (lastModified int64, children []model.Metadata, found bool)
+	// SetDirectory records the last modified time and the children of the directory with the given ID
+	SetDirectory(id model.FileId, lastModified int64, children []model.Metadata)
+	// ForgetDirectories forgets every directory recorded
+	ForgetDirectories()
+	// Cursor returns the position in the api's change feed that the cache is up to date with, or empty if
+	// none has been recorded
+	Cursor() string
+	// SetCursor records the position in the api's change feed that the cache is up to date with
+	SetCursor(cursor string)
 }
 
 ////////////////////////
 // IMPLEMENTATION     //
 ////////////////////////
 
-// NewHistoryCache creates a new in-memory history cache
+// DefaultCacheShards is the number of shards used by NewHistoryCache
+const DefaultCacheShards = 64
+
+// NewHistoryCache creates a new in-memory history cache with the default number of shards
 func NewHistoryCache() *inMemoryHistoryCache {
-	return &inMemoryHistoryCache{history: make(map[model.FileId]*cacheItem)}
+	return NewShardedHistoryCache(DefaultCacheShards)
+}
+
+// NewShardedHistoryCache creates a new in-memory history cache split into the given number of shards.
+// Each shard has its own lock, so goroutines working on files in different shards don't contend.
+func NewShardedHistoryCache(shards int) *inMemoryHistoryCache {
+	if shards <= 0 {
+		shards = 1
+	}
+	hc := &inMemoryHistoryCache{shards: make([]*cacheShard, shards)}
+	for i := range hc.shards {
+		hc.shards[i] = &cacheShard{history: make(map[model.FileId]*cacheItem), directories: make(map[model.FileId]cachedDirectory)}
+	}
+	return hc
 }
 
 type inMemoryHistoryCache struct {
+	shards []*cacheShard
+
+	cursorMu sync.RWMutex
+	cursor   string
+}
+
+// cacheShard holds the portion of the cache for the files that hash to it
+type cacheShard struct {
+	mu      sync.RWMutex
 	history map[model.FileId]*cacheItem
+	// directories holds the last modified time and children of each directory
+	directories map[model.FileId]cachedDirectory
+}
+
+// cachedDirectory is a directory as it was last recorded
+type cachedDirectory struct {
+	lastModified int64
+	children     []model.Metadata
 }
 
 // History is a struct that holds the history of a file
@@ -32,29 +115,274 @@ type cacheItem struct {
 	id           model.FileId
 	lastModified int64
 	version      int
+	deleted      bool
+	parentId     model.FileId
+	contentHash  string
+	// name, path, size and contentType describe the file as it was last recorded
+	name        string
+	path        string
+	size        int64
+	contentType string
+	// pendingVersion is the version waiting to be copied, or zero if there isn't one
+	pendingVersion int
+}
+
+// describe stores the parts of the metadata that describe the file
+func (history *cacheItem) describe(metadata model.Metadata) {
+	history.name = metadata.Name
+	history.path = metadata.Path
+	history.size = metadata.Size
+	history.contentType = metadata.ContentType
+}
+
+// shard returns the shard that holds the file with the given ID
+func (hc *inMemoryHistoryCache) shard(id model.FileId) *cacheShard {
+	return hc.shards[partition(id, len(hc.shards))]
 }
 
 func (hc *inMemoryHistoryCache) Get(id model.FileId) (lastModified int64, version int) {
-	if _, ok := hc.history[id]; !ok {
-		hc.history[id] = &cacheItem{id: id, lastModified: 0, version: 0}
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if history, ok := shard.history[id]; ok {
+		return history.lastModified, history.version
 	}
-	return hc.history[id].lastModified, hc.history[id].version
+	return 0, 0
 }
 
 func (hc *inMemoryHistoryCache) Update(id model.FileId, lastModified int64) (newVersion int) {
-	if history, ok := hc.history[id]; ok {
-		history.lastModified = lastModified
-		history.version++
-	} else {
-		hc.history[id] = &cacheItem{id: id, lastModified: lastModified, version: 1}
+	shard := hc.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.update(id, lastModified)
+}
+
+func (hc *inMemoryHistoryCache) CompareAndUpdate(metadata model.Metadata) (version int, updated bool) {
+	shard := hc.shard(metadata.Id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if history, ok := shard.history[metadata.Id]; ok && !history.deleted && history.lastModified >= metadata.LastModified {
+		return history.version, false
+	}
+	version = shard.update(metadata.Id, metadata.LastModified)
+	history := shard.history[metadata.Id]
+	history.parentId = metadata.ParentId
+	history.contentHash = metadata.ContentHash
+	history.describe(metadata)
+	history.pendingVersion = version
+	return version, true
+}
+
+func (hc *inMemoryHistoryCache) Touch(metadata model.Metadata) (touched bool) {
+	shard := hc.shard(metadata.Id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	history, ok := shard.history[metadata.Id]
+	if !ok || history.deleted || history.lastModified >= metadata.LastModified ||
+		metadata.ContentHash == "" || history.contentHash != metadata.ContentHash {
+		return false
+	}
+	history.lastModified = metadata.LastModified
+	history.describe(metadata)
+	return true
+}
+
+func (hc *inMemoryHistoryCache) Metadata(id model.FileId) (metadata model.Metadata, found bool) {
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	history, ok := shard.history[id]
+	if !ok {
+		return model.Metadata{}, false
+	}
+	return model.Metadata{
+		Id:           history.id,
+		LastModified: history.lastModified,
+		ParentId:     history.parentId,
+		Name:         history.name,
+		Path:         history.path,
+		Size:         history.size,
+		ContentType:  history.contentType,
+		ContentHash:  history.contentHash,
+	}, true
+}
+
+func (hc *inMemoryHistoryCache) ContentHash(id model.FileId) string {
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if history, ok := shard.history[id]; ok {
+		return history.contentHash
+	}
+	return ""
+}
+
+func (hc *inMemoryHistoryCache) MarkCopied(id model.FileId, version int) (copied bool) {
+	shard := hc.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	history, ok := shard.history[id]
+	if !ok || history.pendingVersion == 0 || history.pendingVersion != version {
+		return false
+	}
+	history.pendingVersion = 0
+	return true
+}
+
+func (hc *inMemoryHistoryCache) PendingVersion(id model.FileId) int {
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if history, ok := shard.history[id]; ok {
+		return history.pendingVersion
+	}
+	return 0
+}
+
+func (hc *inMemoryHistoryCache) Move(metadata model.Metadata) (version int, previousParentId model.FileId, moved bool) {
+	shard := hc.shard(metadata.Id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	history, ok := shard.history[metadata.Id]
+	if !ok {
+		return 0, "", false
+	}
+	if history.deleted || history.parentId == metadata.ParentId {
+		return history.version, history.parentId, false
 	}
-	return hc.history[id].version
+	previousParentId = history.parentId
+	history.parentId = metadata.ParentId
+	history.name = metadata.Name
+	history.path = metadata.Path
+	history.version++
+	return history.version, previousParentId, true
+}
+
+func (hc *inMemoryHistoryCache) Delete(id model.FileId) (version int, deleted bool) {
+	shard := hc.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	history, ok := shard.history[id]
+	if !ok {
+		return 0, false
+	}
+	if history.deleted {
+		return history.version, false
+	}
+	history.deleted = true
+	history.pendingVersion = 0
+	history.version++
+	return history.version, true
+}
+
+func (hc *inMemoryHistoryCache) IsDeleted(id model.FileId) bool {
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	history, ok := shard.history[id]
+	return ok && history.deleted
 }
 
 func (hc *inMemoryHistoryCache) GetAllCacheKeys() []model.FileId {
-	keys := make([]model.FileId, 0, len(hc.history))
-	for k := range hc.history {
-		keys = append(keys, k)
+	keys := []model.FileId{}
+	for _, shard := range hc.shards {
+		shard.mu.RLock()
+		for k := range shard.history {
+			keys = append(keys, k)
+		}
+		shard.mu.RUnlock()
 	}
 	return keys
 }
+
+func (hc *inMemoryHistoryCache) Directory(id model.FileId) (lastModified int64, children []model.Metadata, found bool) {
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	directory, found := shard.directories[id]
+	return directory.lastModified, directory.children, found
+}
+
+func (hc *inMemoryHistoryCache) SetDirectory(id model.FileId, lastModified int64, children []model.Metadata) {
+	shard := hc.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.directories[id] = cachedDirectory{lastModified: lastModified, children: children}
+}
+
+func (hc *inMemoryHistoryCache) ForgetDirectories() {
+	for _, shard := range hc.shards {
+		shard.mu.Lock()
+		clear(shard.directories)
+		shard.mu.Unlock()
+	}
+}
+
+func (hc *inMemoryHistoryCache) Cursor() string {
+	hc.cursorMu.RLock()
+	defer hc.cursorMu.RUnlock()
+	return hc.cursor
+}
+
+func (hc *inMemoryHistoryCache) SetCursor(cursor string) {
+	hc.cursorMu.Lock()
+	defer hc.cursorMu.Unlock()
+	hc.cursor = cursor
+}
+
+// items returns a copy of every item in the cache
+func (hc *inMemoryHistoryCache) items() []cacheItem {
+	items := []cacheItem{}
+	for _, shard := range hc.shards {
+		shard.mu.RLock()
+		for _, item := range shard.history {
+			items = append(items, *item)
+		}
+		shard.mu.RUnlock()
+	}
+	return items
+}
+
+// directories returns every directory in the cache, keyed by id
+func (hc *inMemoryHistoryCache) directories() map[model.FileId]cachedDirectory {
+	directories := make(map[model.FileId]cachedDirectory)
+	for _, shard := range hc.shards {
+		shard.mu.RLock()
+		for id, directory := range shard.directories {
+			directories[id] = directory
+		}
+		shard.mu.RUnlock()
+	}
+	return directories
+}
+
+// item returns a copy of the item with the given ID
+func (hc *inMemoryHistoryCache) item(id model.FileId) (cacheItem, bool) {
+	shard := hc.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if item, ok := shard.history[id]; ok {
+		return *item, true
+	}
+	return cacheItem{}, false
+}
+
+// set replaces the item in the cache
+func (hc *inMemoryHistoryCache) set(item cacheItem) {
+	shard := hc.shard(item.id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.history[item.id] = &item
+}
+
+// update sets the last modified time, clears any tombstone and bumps the version.  Must be called with mu held.
+func (s *cacheShard) update(id model.FileId, lastModified int64) int {
+	if history, ok := s.history[id]; ok {
+		history.lastModified = lastModified
+		history.deleted = false
+		history.version++
+		return history.version
+	}
+	s.history[id] = &cacheItem{id: id, lastModified: lastModified, version: 1}
+	return 1
+}
@@ -0,0 +1,111 @@
+package monitor
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+func TestGetDoesNotCreateEntries(t *testing.T) {
+	cache := NewHistoryCache()
+
+	if lastModified, version := cache.Get("file1"); lastModified != 0 || version != 0 {
+		t.Errorf("got (%d, %d), want (0, 0)", lastModified, version)
+	}
+	if keys := cache.GetAllCacheKeys(); len(keys) != 0 {
+		t.Errorf("got keys %v, want none", keys)
+	}
+}
+
+func TestCompareAndUpdateIsAtomic(t *testing.T) {
+	cache := NewShardedHistoryCache(4)
+	ids := []model.FileId{"file1", "file2", "file3"}
+
+	// every goroutine tries to apply the same sequence of modifications, so each modification
+	// must bump the version exactly once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	updates := map[model.FileId]int{}
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lastModified := int64(1); lastModified <= 100; lastModified++ {
+				for _, id := range ids {
+					if _, updated := cache.CompareAndUpdate(model.Metadata{Id: id, LastModified: lastModified}); updated {
+						mu.Lock()
+						updates[id]++
+						mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		lastModified, version := cache.Get(id)
+		if lastModified != 100 || version != updates[id] {
+			t.Errorf("%s: got (%d, %d) after %d updates", id, lastModified, version, updates[id])
+		}
+		if version > 100 {
+			t.Errorf("%s: version %d bumped more than once per modification", id, version)
+		}
+	}
+
+	if version, updated := cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 50}); updated || version != updates["file1"] {
+		t.Errorf("stale CompareAndUpdate: got (%d, %v)", version, updated)
+	}
+}
+
+func TestPendingVersions(t *testing.T) {
+	cache := NewHistoryCache()
+
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 100})
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 200})
+	if version := cache.PendingVersion("file1"); version != 2 {
+		t.Errorf("got pending version %d, want 2", version)
+	}
+	// copying a superseded version leaves the latest pending
+	if cache.MarkCopied("file1", 1) || cache.PendingVersion("file1") != 2 {
+		t.Errorf("superseded version cleared the pending version")
+	}
+	if !cache.MarkCopied("file1", 2) || cache.PendingVersion("file1") != 0 {
+		t.Errorf("copied version is still pending")
+	}
+
+	// a deleted file has nothing left to copy
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 300})
+	cache.Delete("file1")
+	if version := cache.PendingVersion("file1"); version != 0 {
+		t.Errorf("got pending version %d after deletion, want none", version)
+	}
+}
+
+func TestTouchKeepsTheVersion(t *testing.T) {
+	cache := NewHistoryCache()
+
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 100, ContentHash: "a"})
+	if !cache.Touch(model.Metadata{Id: "file1", LastModified: 200, ContentHash: "a"}) {
+		t.Errorf("same content was not touched")
+	}
+	if lastModified, version := cache.Get("file1"); lastModified != 200 || version != 1 {
+		t.Errorf("got %d, version %d after touch, want 200, version 1", lastModified, version)
+	}
+
+	// a different or unknown hash is a change, and an older time is neither
+	for _, metadata := range []model.Metadata{
+		{Id: "file1", LastModified: 300, ContentHash: "b"},
+		{Id: "file1", LastModified: 300},
+		{Id: "file1", LastModified: 150, ContentHash: "a"},
+	} {
+		if cache.Touch(metadata) {
+			t.Errorf("%+v: touched, want it left for CompareAndUpdate", metadata)
+		}
+	}
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 300, ContentHash: "b"})
+	if hash := cache.ContentHash("file1"); hash != "b" {
+		t.Errorf("got content hash %q, want the latest version's", hash)
+	}
+}
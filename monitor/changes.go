@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"context"
+	"slices"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// ChangeSource is an optional source of change notifications, such as a filesystem watcher, that lets the
+// monitor pick up changes between sweeps instead of waiting for the next poll.  Notifications can be lost,
+// so sweeps are still needed to reconcile; a source signals on Overflows when it knows it has lost some.
+type ChangeSource interface {
+	// Changes returns the channel of ids that may have changed.  A directory id means its children may
+	// have changed.  The channel is closed when the source is closed.
+	Changes() <-chan model.FileId
+	// Overflows returns a channel that receives whenever notifications may have been lost
+	Overflows() <-chan struct{}
+}
+
+// WatchlistChangeSource is an optional capability of a ChangeSource that watches the ids in the watchlist,
+// such as a filesystem watcher, and so has to follow the watchlist as it changes
+type WatchlistChangeSource interface {
+	// UpdateWatchlist starts watching the ids added to the watchlist and stops watching those removed
+	UpdateWatchlist(added []model.FileId, removed []model.FileId)
+}
+
+// WatchChanges feeds the ids from the change source straight into the pipeline until the source is closed
+// or the monitor starts shutting down.  Changed ids are resolved like the watchlist, but the sweep only
+// covers the ids themselves, so deletions beneath a changed directory are left to the next full sweep.
+// When the source overflows, a full sweep is run straight away to catch up.  A source with
+// WatchlistChangeSource is given the watchlist straight away, and every change to it after that, until it
+// stops being watched.  Must be called after Start.
+func (m *Monitor) WatchChanges(source ChangeSource) {
+	ctx, stopped := m.ctx, m.intakeCtx
+	watchlistSource, followsWatchlist := source.(WatchlistChangeSource)
+	if followsWatchlist {
+		m.changeMu.Lock()
+		m.watchlistSources = append(m.watchlistSources, watchlistSource)
+		watchlistSource.UpdateWatchlist(m.Watchlist(), nil)
+		m.changeMu.Unlock()
+	}
+	go func() {
+		if followsWatchlist {
+			defer func() {
+				m.changeMu.Lock()
+				defer m.changeMu.Unlock()
+				m.watchlistSources = slices.DeleteFunc(m.watchlistSources, func(s WatchlistChangeSource) bool { return s == watchlistSource })
+			}()
+		}
+		for {
+			select {
+			case <-stopped.Done():
+				return
+			case <-source.Overflows():
+				m.metrics.Counter("change_overflows").Inc()
+				m.EvaluateWatchlistContext(ctx)
+			case fileId, ok := <-source.Changes():
+				if !ok {
+					return
+				}
+				m.evaluateChanges(ctx, m.drainChanges(source, fileId))
+			}
+		}
+	}()
+}
+
+// drainChanges coalesces the notifications already waiting on the source into a single batch of unique
+// ids, starting with the given id
+func (m *Monitor) drainChanges(source ChangeSource, fileId model.FileId) []model.FileId {
+	seen := map[model.FileId]bool{fileId: true}
+	fileIds := []model.FileId{fileId}
+	for len(fileIds) < m.options.BatchSize {
+		select {
+		case next, ok := <-source.Changes():
+			if !ok {
+				return fileIds
+			}
+			if !seen[next] {
+				seen[next] = true
+				fileIds = append(fileIds, next)
+			}
+		default:
+			return fileIds
+		}
+	}
+	return fileIds
+}
+
+// evaluateChanges runs a partial sweep over the changed ids
+func (m *Monitor) evaluateChanges(ctx context.Context, fileIds []model.FileId) {
+	m.metrics.Counter("change_notifications").Add(int64(len(fileIds)))
+	m.runSweep(ctx, fileIds, changeSweep)
+}
@@ -0,0 +1,170 @@
+package monitor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// DeadLetterKind is what a dead letter mirrors
+type DeadLetterKind string
+
+const (
+	// DeadLetterCopy is a copy of a new version of the file's content
+	DeadLetterCopy DeadLetterKind = ""
+	// DeadLetterDelete is the deletion of the file, mirrored through DeleteApi
+	DeadLetterDelete DeadLetterKind = "delete"
+	// DeadLetterMove is the move of the file to another parent directory, mirrored through MoveApi
+	DeadLetterMove DeadLetterKind = "move"
+)
+
+// DeadLetter is a copy that still failed after every retry, or the deletion or move of a file that
+// couldn't be mirrored.  The cache keeps a copy's version pending until the copy is replayed successfully or
+// superseded by a newer version.
+type DeadLetter struct {
+	FileId       model.FileId   `json:"fileId"`
+	Kind         DeadLetterKind `json:"kind,omitempty"`
+	LastModified int64          `json:"lastModified"`
+	Version      int            `json:"version"`
+	// FromParentId and ToParentId are the parents a move was between
+	FromParentId model.FileId `json:"fromParentId,omitempty"`
+	ToParentId   model.FileId `json:"toParentId,omitempty"`
+	// Attempts is the number of times the copy was tried before giving up
+	Attempts int `json:"attempts"`
+	// Error is the error returned by the last attempt
+	Error string `json:"error"`
+	// FailedAt is when the last attempt failed, in milliseconds since the epoch
+	FailedAt int64 `json:"failedAt"`
+}
+
+// DeadLetterStore holds the copies that have failed too many times to keep retrying, so they can be
+// inspected and replayed.  It holds at most one dead letter per file, and implementations must be safe
+// for concurrent use.
+type DeadLetterStore interface {
+	// Add stores the dead letter, replacing any earlier dead letter for the same file
+	Add(letter DeadLetter) error
+	// Remove removes the dead letter for the file with the given ID, returning it if there was one
+	Remove(fileId model.FileId) (letter DeadLetter, removed bool, err error)
+	// List returns every dead letter, sorted by FileId
+	List() []DeadLetter
+}
+
+////////////////////////
+// IMPLEMENTATION     //
+////////////////////////
+
+// NewDeadLetterStore creates a dead-letter store held in memory
+func NewDeadLetterStore() *inMemoryDeadLetterStore {
+	return &inMemoryDeadLetterStore{letters: make(map[model.FileId]DeadLetter)}
+}
+
+type inMemoryDeadLetterStore struct {
+	mu      sync.RWMutex
+	letters map[model.FileId]DeadLetter
+}
+
+func (s *inMemoryDeadLetterStore) Add(letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters[letter.FileId] = letter
+	return nil
+}
+
+func (s *inMemoryDeadLetterStore) Remove(fileId model.FileId) (letter DeadLetter, removed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letter, removed = s.letters[fileId]
+	delete(s.letters, fileId)
+	return letter, removed, nil
+}
+
+func (s *inMemoryDeadLetterStore) List() []DeadLetter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	letters := make([]DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	slices.SortFunc(letters, func(a, b DeadLetter) int { return strings.Compare(string(a.FileId), string(b.FileId)) })
+	return letters
+}
+
+// NewFileDeadLetterStore creates a dead-letter store persisted to the given file, loading any dead letters
+// already in it.  Dead letters should be rare, so the whole file is rewritten on every change, through a
+// temporary file that is renamed into place.
+func NewFileDeadLetterStore(path string) (*fileDeadLetterStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	fs := &fileDeadLetterStore{memory: NewDeadLetterStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var letters []DeadLetter
+	if err := json.Unmarshal(data, &letters); err != nil {
+		return nil, err
+	}
+	for _, letter := range letters {
+		fs.memory.Add(letter)
+	}
+	return fs, nil
+}
+
+type fileDeadLetterStore struct {
+	memory *inMemoryDeadLetterStore
+	path   string
+	// mu serializes changes so the file is written in the same order as memory is changed
+	mu sync.Mutex
+}
+
+func (fs *fileDeadLetterStore) Add(letter DeadLetter) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.memory.Add(letter)
+	return fs.write()
+}
+
+func (fs *fileDeadLetterStore) Remove(fileId model.FileId) (letter DeadLetter, removed bool, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	letter, removed, _ = fs.memory.Remove(fileId)
+	if !removed {
+		return letter, false, nil
+	}
+	return letter, true, fs.write()
+}
+
+func (fs *fileDeadLetterStore) List() []DeadLetter {
+	return fs.memory.List()
+}
+
+// write replaces the file with the dead letters in memory.  Must be called with mu held.
+func (fs *fileDeadLetterStore) write() error {
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(fs.memory.List()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
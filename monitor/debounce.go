@@ -0,0 +1,142 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// When QuietPeriodMs is set, a changed file is only copied once it has settled: once its LastModified is at
+// least the quiet period old, or has been seen unchanged for the quiet period, so a file that's still being
+// written isn't copied half-finished.  LastModified is read as Unix milliseconds, as model.Metadata
+// documents; if the provider's clock is ahead of the monitor's, the file settles on when it was seen.  Until then the change is deferred, and nothing is recorded in the
+// cache, so every change made while the file settles is merged into the one version bump made when it does.
+// A file that never stops changing is copied anyway once its first deferred change is MaxSettleDelayMs old,
+// if that's set.
+//
+// A deferred file is checked again by a change sweep of its own when it's due to settle, since nothing else
+// may look at it again: an incremental sweep skips its unchanged directory, and the change feed has already
+// reported it.  For the same reason, a monitor that shuts down with changes still settling forgets its
+// change feed cursor, so that the next Start sweeps the whole watchlist.
+
+// settling tracks the files whose changes are waiting to settle
+type settling struct {
+	mu    sync.Mutex
+	files map[model.FileId]*settlingFile
+}
+
+// settlingFile is a file whose change is waiting to settle
+type settlingFile struct {
+	// lastModified is the file's LastModified when it was last evaluated, and seenAt is when that was first seen
+	lastModified int64
+	seenAt       time.Time
+	// since is when the first deferred change was seen
+	since time.Time
+	// recheck runs the change sweep that checks the file again
+	recheck *time.Timer
+}
+
+// settled returns whether the changed file has settled and can be copied.  If it hasn't, a change sweep of
+// the file is scheduled for when it's due to settle.
+func (m *Monitor) settled(metadata model.Metadata) bool {
+	if m.options.QuietPeriodMs <= 0 {
+		return true
+	}
+	quiet := time.Duration(m.options.QuietPeriodMs) * time.Millisecond
+	maxDelay := time.Duration(m.options.MaxSettleDelayMs) * time.Millisecond
+	now := time.Now()
+
+	m.settling.mu.Lock()
+	defer m.settling.mu.Unlock()
+	if m.settling.files == nil {
+		m.settling.files = make(map[model.FileId]*settlingFile)
+	}
+	file, ok := m.settling.files[metadata.Id]
+	if !ok {
+		file = &settlingFile{lastModified: metadata.LastModified, seenAt: now, since: now}
+	} else if file.lastModified != metadata.LastModified {
+		m.metrics.Counter("changes_coalesced").Inc()
+		file.lastModified, file.seenAt = metadata.LastModified, now
+	}
+
+	// A file that was last modified long enough ago has settled without being seen to
+	quietFor := max(now.Sub(time.UnixMilli(metadata.LastModified)), now.Sub(file.seenAt))
+	capped := maxDelay > 0 && now.Sub(file.since) >= maxDelay
+	if quietFor >= quiet || capped {
+		if quietFor < quiet {
+			m.metrics.Counter("max_settle_delay_copies").Inc()
+		}
+		m.forgetSettling(metadata.Id)
+		return true
+	}
+
+	wait := quiet - quietFor
+	if maxDelay > 0 {
+		wait = min(wait, maxDelay-now.Sub(file.since))
+	}
+	if !ok {
+		m.metrics.Counter("changes_deferred").Inc()
+		m.settling.files[metadata.Id] = file
+		file.recheck = time.AfterFunc(wait, func() { m.recheckSettling(metadata.Id, quiet) })
+	} else {
+		file.recheck.Reset(wait)
+	}
+	return false
+}
+
+// recheckSettling runs a change sweep of a file that's due to settle.  If the file couldn't be retrieved,
+// it's checked again after another quiet period.
+func (m *Monitor) recheckSettling(fileId model.FileId, quiet time.Duration) {
+	s, err := m.runSweep(context.Background(), []model.FileId{fileId}, changeSweep)
+	if err != nil || s.resolved() {
+		return
+	}
+	m.settling.mu.Lock()
+	defer m.settling.mu.Unlock()
+	if file, ok := m.settling.files[fileId]; ok {
+		file.recheck.Reset(quiet)
+	}
+}
+
+// forgetSettling stops waiting for the file to settle, if it was.  Must be called with settling.mu held.
+func (m *Monitor) forgetSettling(fileId model.FileId) {
+	if file, ok := m.settling.files[fileId]; ok {
+		file.recheck.Stop()
+		delete(m.settling.files, fileId)
+	}
+}
+
+// stopSettling forgets every file still waiting to settle, returning how many there were.  The changes
+// weren't recorded in the cache, so a full sweep picks them up again, but the change feed has already
+// reported them, so its cursor is forgotten too.
+func (m *Monitor) stopSettling() int {
+	m.settling.mu.Lock()
+	unsettled := len(m.settling.files)
+	for fileId := range m.settling.files {
+		m.forgetSettling(fileId)
+	}
+	m.settling.mu.Unlock()
+
+	if unsettled > 0 && m.feed != nil {
+		m.feedMu.Lock()
+		defer m.feedMu.Unlock()
+		m.cache.SetCursor("")
+	}
+	return unsettled
+}
+
+// settlingCount returns the number of files whose changes are waiting to settle
+func (m *Monitor) settlingCount() int {
+	m.settling.mu.Lock()
+	defer m.settling.mu.Unlock()
+	return len(m.settling.files)
+}
+
+// removeSettling stops waiting for a file that has been deleted or has left the watched tree to settle
+func (m *Monitor) removeSettling(fileId model.FileId) {
+	m.settling.mu.Lock()
+	defer m.settling.mu.Unlock()
+	m.forgetSettling(fileId)
+}
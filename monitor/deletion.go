@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"context"
+	"log"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/samber/lo"
+)
+
+// Deletions are found in two ways.  A file in the watchlist is known to be deleted when retrieving its
+// metadata returns model.ErrNotFound.  A file found implicitly, beneath a watched directory, simply stops
+// appearing in its directory's children, so after a complete sweep any live file in the cache that was
+// watched but wasn't visited is checked; if it no longer exists, it has been deleted.  A file that still
+// exists has moved out of the watched tree, which is handled in moves.go.
+//
+// Either way, the deletion is passed through the evaluation and copy stages like any other change, so it
+// stays in order with the file's other versions.  The evaluation stage records a tombstone in the cache as
+// a new version, and in the version catalog, and the copy stage mirrors it through DeleteApi.DeleteCopy
+// when the api supports it, retrying and dead-lettering it like a copy.
+
+// detectRemovals looks for files in the cache that were watched but weren't visited by the sweep, since
+// they have either been deleted or moved out of the watched tree.  Once the files have been checked, the
+// files visited by the sweep become the watched files.
+func (m *Monitor) detectRemovals(s *sweep) {
+	candidates := lo.Filter(m.cache.GetAllCacheKeys(), func(fileId model.FileId, _ int) bool {
+		_, visited := s.visited[fileId]
+		return !visited && m.WatchType(fileId) != model.WatchTypeUnwatched && !m.cache.IsDeleted(fileId)
+	})
+
+	for _, chunk := range lo.Chunk(candidates, m.options.BatchSize) {
+		if s.ctx.Err() != nil {
+			return
+		}
+		found, missing, _ := m.retrieveMetadata(s.ctx, chunk)
+		for _, fileId := range missing {
+			m.enqueueDeletion(fileId)
+		}
+		for _, metadata := range found {
+			m.enqueueDeparture(metadata)
+		}
+	}
+
+	m.watchedMu.Lock()
+	defer m.watchedMu.Unlock()
+	m.watched = s.visited
+}
+
+// evaluateDeletion records a tombstone for a deleted file.  Files that were never copied, or are already
+// deleted, need no tombstone.
+func (m *Monitor) evaluateDeletion(fileId model.FileId) {
+	if m.ctx.Err() != nil {
+		return
+	}
+	m.removeSettling(fileId)
+	if version, deleted := m.cache.Delete(fileId); deleted {
+		m.metrics.Counter("files_deleted").Inc()
+		m.recordDeletion(fileId, version)
+		m.enqueueCopy(copyTask{fileId: fileId, version: version, kind: deleteVersion, priority: m.filePriority(fileId)})
+	}
+}
+
+// deleteCopy mirrors the deletion of a file, if the api supports it, retrying it like a copy
+func (m *Monitor) deleteCopy(task copyTask) {
+	if m.ctx.Err() != nil || m.deleter == nil {
+		return
+	}
+	m.copyWithRetry(m.ctx, task)
+}
+
+// tryDelete makes a single attempt at mirroring the deletion of a file.  Without DeleteApi, there's
+// nothing to mirror.
+func (m *Monitor) tryDelete(ctx context.Context, task copyTask) error {
+	if m.deleter == nil {
+		return nil
+	}
+	ctx, cancel := callContext(ctx, m.options.CopyTimeoutMs)
+	defer cancel()
+	done := m.timeCall("delete_copy")
+	err := m.deleter.DeleteCopy(ctx, task.fileId, task.version)
+	done()
+	m.metrics.Counter("delete_copy_calls").Inc()
+	if err != nil {
+		log.Printf("Error deleting copy of FileId %s version %d: %v", task.fileId, task.version, err)
+	}
+	return err
+}
@@ -0,0 +1,290 @@
+package monitor
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// When the api has a change feed (see ChangeFeedApi), EvaluateWatchlist follows the feed instead of
+// sweeping the whole watchlist: the ids changed since the cursor saved in the cache are resolved by a feed
+// sweep, and once their changes are in the cache the new cursor is saved.  If a call fails, the cursor is
+// left where it was and the same changes are fetched again next time.
+//
+// A full sweep is only run when there is no cursor yet, when the cursor has expired, or when the watchlist
+// has changed since the cursor was saved; the cursor is tagged with a fingerprint of the watchlist for that.
+// The cursor is taken before the sweep starts, so anything that changes during it is followed afterwards.
+//
+// A changed file whose parent isn't known to be watched is located by walking up its ancestors until one
+// is, or the root is reached, so the feed can be followed straight after a restart.  A watched file found
+// outside the watched tree is recorded as a departure, but a watched directory leaving the tree takes its
+// subtree with it, which only a full sweep can find, so one is run straight away.  Before the first
+// complete sweep since Start, every directory outside the tree is assumed to have been in it.
+
+// followFeed runs a feed sweep over the changes since the saved cursor, or a full sweep when the feed can't
+// be followed
+func (m *Monitor) followFeed(ctx context.Context) error {
+	if !m.running.Load() {
+		return ErrNotRunning
+	}
+	m.feedMu.Lock()
+	defer m.feedMu.Unlock()
+
+	fingerprint, cursor := decodeCursor(m.cache.Cursor())
+	if cursor == "" || fingerprint != watchlistFingerprint(m.WatchEntries()) {
+		return m.resync(ctx)
+	}
+
+	fileIds, next, err := m.changesSince(ctx, cursor)
+	if errors.Is(err, model.ErrCursorExpired) {
+		m.metrics.Counter("change_cursor_expired").Inc()
+		log.Printf("Change feed cursor has expired, sweeping the whole watchlist")
+		return m.resync(ctx)
+	} else if err != nil {
+		return err
+	}
+
+	m.metrics.Counter("change_feed_changes").Add(int64(len(fileIds)))
+	if len(fileIds) > 0 {
+		s, err := m.runSweep(ctx, fileIds, feedSweep)
+		if err != nil {
+			return err
+		}
+		if s.needsResync() {
+			return m.resync(ctx)
+		}
+		if !s.resolved() {
+			return nil
+		}
+	}
+	m.cache.SetCursor(encodeCursor(fingerprint, next))
+	return nil
+}
+
+// resync runs a full sweep, saving a cursor taken before it started once it completes
+func (m *Monitor) resync(ctx context.Context) error {
+	m.metrics.Counter("change_feed_resyncs").Inc()
+	fingerprint := watchlistFingerprint(m.WatchEntries())
+	_, cursor, err := m.changesSince(ctx, "")
+	if err != nil {
+		// The sweep still runs, and the feed is tried again next time
+		log.Printf("Error starting the change feed: %v", err)
+	}
+
+	s, sweepErr := m.runSweep(ctx, m.Watchlist(), fullSweep)
+	if sweepErr != nil {
+		return sweepErr
+	}
+	if err == nil && s.complete() {
+		m.cache.SetCursor(encodeCursor(fingerprint, cursor))
+	}
+	return nil
+}
+
+// changesSince calls the api's change feed
+func (m *Monitor) changesSince(ctx context.Context, cursor string) ([]model.FileId, string, error) {
+	ctx, cancel := callContext(ctx, m.options.MetadataTimeoutMs)
+	defer cancel()
+	stop := context.AfterFunc(m.ctx, cancel)
+	defer stop()
+
+	done := m.timeCall("changes_since")
+	fileIds, next, err := m.feed.ChangesSince(ctx, cursor)
+	done()
+	m.metrics.Counter("changes_since_calls").Inc()
+	if err != nil && !errors.Is(err, model.ErrCursorExpired) {
+		log.Printf("Error listing changes since cursor %q: %v", cursor, err)
+	}
+	return fileIds, next, err
+}
+
+// encodeCursor tags the feed's cursor with the fingerprint of the watchlist it was taken for
+func encodeCursor(fingerprint string, cursor string) string {
+	return fingerprint + ":" + cursor
+}
+
+// decodeCursor splits a saved cursor into the watchlist's fingerprint and the feed's cursor
+func decodeCursor(saved string) (fingerprint string, cursor string) {
+	fingerprint, cursor, _ = strings.Cut(saved, ":")
+	return fingerprint, cursor
+}
+
+// watchlistFingerprint returns a hash of the watchlist's entries and their options
+func watchlistFingerprint(entries []model.WatchEntry) string {
+	data, _ := json.Marshal(entries)
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// location is where a feed sweep found a file or directory: inTree is set if it's in the watched tree,
+// in which case scope is the scope its children are checked against
+type location struct {
+	scope  watchScope
+	inTree bool
+}
+
+// locate places a file reached by a feed sweep in the watched tree, beneath its parent.  It returns false
+// if the file has already been reached through its parent during the sweep, if it isn't in the watched
+// tree, or if it couldn't be located.
+func (m *Monitor) locate(s *sweep, metadata model.Metadata) bool {
+	parent, ok := m.locateParent(s, metadata)
+	if !ok {
+		return false
+	}
+	if parent.inTree && parent.scope.follows(metadata) {
+		return s.visit(metadata.Id, parent.scope.child())
+	}
+	m.leaveTree(s, metadata)
+	return false
+}
+
+// locateParent finds the location of the file's parent, retrieving the metadata of its ancestors until it
+// reaches one whose location is known.  It returns false if an ancestor couldn't be retrieved.
+func (m *Monitor) locateParent(s *sweep, metadata model.Metadata) (location, bool) {
+	ancestors := []model.Metadata{}
+	parentId := metadata.ParentId
+	for {
+		if found, known := m.knownLocation(s, parentId); known {
+			// Walk back down from the known ancestor, checking each directory against the one above it
+			for i := len(ancestors) - 1; i >= 0; i-- {
+				if found.inTree = found.inTree && found.scope.follows(ancestors[i]); found.inTree {
+					found.scope = found.scope.child()
+				}
+				s.locateAt(ancestors[i].Id, found)
+			}
+			return found, true
+		}
+
+		// A directory beneath itself would make the ancestors loop
+		if slices.ContainsFunc(ancestors, func(ancestor model.Metadata) bool { return ancestor.Id == parentId }) {
+			return location{}, true
+		}
+		found, _, _ := m.retrieveMetadata(s.ctx, []model.FileId{parentId})
+		if len(found) == 0 {
+			// The parent may have been removed since, in which case the feed will report the file too
+			s.markIncomplete()
+			return location{}, false
+		}
+		ancestors = append(ancestors, found[0])
+		parentId = found[0].ParentId
+	}
+}
+
+// knownLocation returns the location of the file or directory if the watchlist, the sweep, or the last
+// complete sweep knows it
+func (m *Monitor) knownLocation(s *sweep, fileId model.FileId) (location, bool) {
+	if options, ok := m.watchOptions(fileId); ok {
+		return location{scope: watchScope{options: options}, inTree: true}, true
+	}
+	if scope, ok := s.scope(fileId); ok {
+		return location{scope: scope, inTree: true}, true
+	}
+	if found, ok := s.location(fileId); ok {
+		return found, true
+	}
+	if fileId == "" {
+		// The root is outside the watched tree, unless it's in the watchlist
+		return location{}, true
+	}
+	m.watchedMu.RLock()
+	defer m.watchedMu.RUnlock()
+	if scope, ok := m.watched[fileId]; ok {
+		return location{scope: scope, inTree: true}, true
+	}
+	return location{}, false
+}
+
+// leaveTree handles a changed file found outside the watched tree.  A watched file is recorded as a
+// departure, and a watched directory needs a full sweep to find the files that left with it.
+func (m *Monitor) leaveTree(s *sweep, metadata model.Metadata) {
+	if m.WatchType(metadata.Id) == model.WatchTypeUnwatched {
+		return
+	}
+	s.leave(metadata.Id)
+	if metadata.IsDirectory {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.resync = true
+		return
+	}
+	m.enqueueDeparture(metadata)
+}
+
+// mergeWatched adds the files placed in the watched tree by a feed sweep to the watched files, and removes
+// those that have left it.  Before the first complete sweep, there are no watched files to merge into.
+func (m *Monitor) mergeWatched(s *sweep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.watchedMu.Lock()
+	defer m.watchedMu.Unlock()
+	if m.watched == nil {
+		return
+	}
+	for fileId, scope := range s.visited {
+		if !scope.unresolved {
+			m.watched[fileId] = scope
+		}
+	}
+	for fileId := range s.left {
+		delete(m.watched, fileId)
+	}
+}
+
+// flushEvaluations waits until every evaluation queued so far has been made, by queueing a barrier to each
+// evaluation worker.  It gives up if the context is done first.
+func (m *Monitor) flushEvaluations(ctx context.Context) {
+	barriers := make([]chan struct{}, 0, len(m.evaluationChannels))
+	for _, ch := range m.evaluationChannels {
+		barrier := make(chan struct{})
+		select {
+		case ch <- evaluationTask{kind: evaluateBarrier, barrier: barrier}:
+			barriers = append(barriers, barrier)
+		case <-ctx.Done():
+			return
+		}
+	}
+	for _, barrier := range barriers {
+		select {
+		case <-barrier:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// leave records that the file has left the watched tree, or no longer exists
+func (s *sweep) leave(fileId model.FileId) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.left[fileId] = true
+}
+
+// locateAt records the location of an ancestor looked up by the sweep
+func (s *sweep) locateAt(fileId model.FileId, found location) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.located[fileId] = found
+}
+
+// location returns the location of an ancestor looked up by the sweep
+func (s *sweep) location(fileId model.FileId) (location, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.located[fileId]
+	return found, ok
+}
+
+// needsResync returns whether the sweep found a change that only a full sweep can follow
+func (s *sweep) needsResync() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resync
+}
@@ -0,0 +1,458 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+const (
+	snapshotFileName = "history.snapshot"
+	logFileName      = "history.log"
+	cursorFileName   = "changes.cursor"
+
+	// DefaultSnapshotEvery is the number of log records written between snapshots when none is configured
+	DefaultSnapshotEvery = 10000
+)
+
+// NewFileHistoryCache creates a history cache that is persisted to the given directory, so that history
+// survives a restart.  Every update is appended to a log file, and every snapshotEvery updates the whole
+// cache is written to a snapshot file and the log is truncated.  When the cache is created, the snapshot
+// is loaded and the log is replayed on top of it.  The change feed cursor is kept in a file of its own
+// beside them.
+//
+// Records are written without an fsync, so they survive the process crashing but not the machine losing
+// power, except that the log is synced whenever the cursor is saved.  A record that was only partially
+// written when the process crashed is discarded on load.
+func NewFileHistoryCache(directory string, snapshotEvery int) (*fileHistoryCache, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+
+	fc := &fileHistoryCache{
+		memory:        NewHistoryCache(),
+		directory:     directory,
+		snapshotEvery: snapshotEvery,
+	}
+
+	if err := fc.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := fc.replayLog(); err != nil {
+		return nil, err
+	}
+	if err := fc.loadCursor(); err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+type fileHistoryCache struct {
+	// memory holds the current state of the cache; the files on disk are only read when loading
+	memory        *inMemoryHistoryCache
+	directory     string
+	snapshotEvery int
+
+	// mu serializes updates so that records are appended to the log in version order.  Reads go
+	// straight to memory, which is safe for concurrent use.
+	mu                   sync.Mutex
+	logFile              *os.File
+	recordsSinceSnapshot int
+}
+
+// cacheRecord is the on-disk representation of a cache entry, used in both the snapshot and the log
+type cacheRecord struct {
+	Id           model.FileId `json:"id"`
+	LastModified int64        `json:"lastModified"`
+	Version      int          `json:"version"`
+	Deleted      bool         `json:"deleted,omitempty"`
+	ParentId     model.FileId `json:"parentId,omitempty"`
+	ContentHash  string       `json:"contentHash,omitempty"`
+	Name         string       `json:"name,omitempty"`
+	Path         string       `json:"path,omitempty"`
+	Size         int64        `json:"size,omitempty"`
+	ContentType  string       `json:"contentType,omitempty"`
+	// PendingVersion is the version waiting to be copied, so copies interrupted by a restart can be resumed
+	PendingVersion int `json:"pendingVersion,omitempty"`
+	// Directory marks the last modified time and children of a directory, rather than an entry for a file
+	Directory bool             `json:"directory,omitempty"`
+	Children  []model.Metadata `json:"children,omitempty"`
+}
+
+func (fc *fileHistoryCache) Get(id model.FileId) (lastModified int64, version int) {
+	return fc.memory.Get(id)
+}
+
+func (fc *fileHistoryCache) Update(id model.FileId, lastModified int64) (newVersion int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	newVersion = fc.memory.Update(id, lastModified)
+	fc.appendRecord(fc.record(id))
+	return newVersion
+}
+
+func (fc *fileHistoryCache) CompareAndUpdate(metadata model.Metadata) (version int, updated bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	version, updated = fc.memory.CompareAndUpdate(metadata)
+	if updated {
+		fc.appendRecord(fc.record(metadata.Id))
+	}
+	return version, updated
+}
+
+func (fc *fileHistoryCache) Touch(metadata model.Metadata) (touched bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	touched = fc.memory.Touch(metadata)
+	if touched {
+		fc.appendRecord(fc.record(metadata.Id))
+	}
+	return touched
+}
+
+func (fc *fileHistoryCache) Metadata(id model.FileId) (metadata model.Metadata, found bool) {
+	return fc.memory.Metadata(id)
+}
+
+func (fc *fileHistoryCache) ContentHash(id model.FileId) string {
+	return fc.memory.ContentHash(id)
+}
+
+func (fc *fileHistoryCache) MarkCopied(id model.FileId, version int) (copied bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	copied = fc.memory.MarkCopied(id, version)
+	if copied {
+		fc.appendRecord(fc.record(id))
+	}
+	return copied
+}
+
+func (fc *fileHistoryCache) PendingVersion(id model.FileId) int {
+	return fc.memory.PendingVersion(id)
+}
+
+func (fc *fileHistoryCache) Move(metadata model.Metadata) (version int, previousParentId model.FileId, moved bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	version, previousParentId, moved = fc.memory.Move(metadata)
+	if moved {
+		fc.appendRecord(fc.record(metadata.Id))
+	}
+	return version, previousParentId, moved
+}
+
+func (fc *fileHistoryCache) Delete(id model.FileId) (version int, deleted bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	version, deleted = fc.memory.Delete(id)
+	if deleted {
+		fc.appendRecord(fc.record(id))
+	}
+	return version, deleted
+}
+
+func (fc *fileHistoryCache) IsDeleted(id model.FileId) bool {
+	return fc.memory.IsDeleted(id)
+}
+
+func (fc *fileHistoryCache) GetAllCacheKeys() []model.FileId {
+	return fc.memory.GetAllCacheKeys()
+}
+
+func (fc *fileHistoryCache) Directory(id model.FileId) (lastModified int64, children []model.Metadata, found bool) {
+	return fc.memory.Directory(id)
+}
+
+// SetDirectory only logs a directory whose last modified time has changed, since a directory that is
+// recorded again unchanged is one that was skipped
+func (fc *fileHistoryCache) SetDirectory(id model.FileId, lastModified int64, children []model.Metadata) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if recorded, _, found := fc.memory.Directory(id); found && recorded == lastModified {
+		return
+	}
+	fc.memory.SetDirectory(id, lastModified, children)
+	fc.appendRecord(cacheRecord{Id: id, LastModified: lastModified, Directory: true, Children: children})
+}
+
+// ForgetDirectories takes a snapshot straight away, since every record holds the state of a single entry
+// and so the log can't record that directories were forgotten
+func (fc *fileHistoryCache) ForgetDirectories() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.memory.ForgetDirectories()
+	if err := fc.snapshot(); err != nil {
+		log.Printf("Error writing cache snapshot: %v", err)
+	}
+}
+
+func (fc *fileHistoryCache) Cursor() string {
+	return fc.memory.Cursor()
+}
+
+// SetCursor replaces the cursor file through a temporary file that is renamed into place, so a crash leaves
+// either the old or the new cursor.  The log is synced before the cursor is written, so that even after the
+// machine loses power the cursor is never ahead of the history.  If the log can't be synced, the old cursor
+// is kept, and the changes since are reported again by the feed.
+func (fc *fileHistoryCache) SetCursor(cursor string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.memory.Cursor() == cursor {
+		return
+	}
+	fc.memory.SetCursor(cursor)
+	if err := fc.logFile.Sync(); err != nil {
+		log.Printf("Error syncing cache log, keeping the old change feed cursor: %v", err)
+		return
+	}
+	if err := fc.writeCursor(cursor); err != nil {
+		log.Printf("Error writing change feed cursor: %v", err)
+	}
+}
+
+// Close writes a final snapshot and closes the log file
+func (fc *fileHistoryCache) Close() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if err := fc.snapshot(); err != nil {
+		return err
+	}
+	return fc.logFile.Close()
+}
+
+// appendRecord writes the record to the log, taking a snapshot if enough records have been written.
+// Errors are logged rather than returned, since the Cache interface has no way to report them; the
+// in-memory state remains correct for the rest of the run.  Must be called with mu held.
+func (fc *fileHistoryCache) appendRecord(record cacheRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding cache record for FileId %s: %v", record.Id, err)
+		return
+	}
+	if _, err := fc.logFile.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing cache record for FileId %s: %v", record.Id, err)
+		return
+	}
+
+	fc.recordsSinceSnapshot++
+	if fc.recordsSinceSnapshot >= fc.snapshotEvery {
+		if err := fc.snapshot(); err != nil {
+			log.Printf("Error writing cache snapshot: %v", err)
+		}
+	}
+}
+
+// snapshot writes the whole cache to the snapshot file and truncates the log.  The snapshot is written
+// to a temporary file and renamed into place, so a crash leaves either the old or the new snapshot.  If
+// the process crashes before the log is truncated, replaying the log on load is harmless since each
+// record holds the absolute state of an entry.  Must be called with mu held.
+func (fc *fileHistoryCache) snapshot() error {
+	records := fc.records()
+
+	tmp, err := os.CreateTemp(fc.directory, snapshotFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(records); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(fc.directory, snapshotFileName)); err != nil {
+		return err
+	}
+
+	if err := fc.logFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fc.logFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fc.recordsSinceSnapshot = 0
+	return nil
+}
+
+// records returns every entry in the cache
+func (fc *fileHistoryCache) records() []cacheRecord {
+	items := fc.memory.items()
+	records := make([]cacheRecord, 0, len(items))
+	for _, item := range items {
+		records = append(records, recordFromItem(item))
+	}
+	for id, directory := range fc.memory.directories() {
+		records = append(records, cacheRecord{Id: id, LastModified: directory.lastModified, Directory: true, Children: directory.children})
+	}
+	return records
+}
+
+// record returns the current state of a single entry in the cache
+func (fc *fileHistoryCache) record(id model.FileId) cacheRecord {
+	item, _ := fc.memory.item(id)
+	return recordFromItem(item)
+}
+
+// restore sets the in-memory state of an entry from a persisted record
+func (fc *fileHistoryCache) restore(record cacheRecord) {
+	if record.Directory {
+		fc.memory.SetDirectory(record.Id, record.LastModified, record.Children)
+		return
+	}
+	fc.memory.set(cacheItem{
+		id:             record.Id,
+		lastModified:   record.LastModified,
+		version:        record.Version,
+		deleted:        record.Deleted,
+		parentId:       record.ParentId,
+		contentHash:    record.ContentHash,
+		name:           record.Name,
+		path:           record.Path,
+		size:           record.Size,
+		contentType:    record.ContentType,
+		pendingVersion: record.PendingVersion,
+	})
+}
+
+func recordFromItem(item cacheItem) cacheRecord {
+	return cacheRecord{
+		Id:             item.id,
+		LastModified:   item.lastModified,
+		Version:        item.version,
+		Deleted:        item.deleted,
+		ParentId:       item.parentId,
+		ContentHash:    item.contentHash,
+		Name:           item.name,
+		Path:           item.path,
+		Size:           item.size,
+		ContentType:    item.contentType,
+		PendingVersion: item.pendingVersion,
+	}
+}
+
+// writeCursor writes the cursor file.  Must be called with mu held.
+func (fc *fileHistoryCache) writeCursor(cursor string) error {
+	tmp, err := os.CreateTemp(fc.directory, cursorFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(cursor); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(fc.directory, cursorFileName))
+}
+
+// loadCursor loads the cursor file, if there is one
+func (fc *fileHistoryCache) loadCursor() error {
+	data, err := os.ReadFile(filepath.Join(fc.directory, cursorFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fc.memory.SetCursor(string(data))
+	return nil
+}
+
+// loadSnapshot loads the snapshot file, if there is one
+func (fc *fileHistoryCache) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(fc.directory, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var records []cacheRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("reading cache snapshot: %w", err)
+	}
+	for _, record := range records {
+		fc.restore(record)
+	}
+	return nil
+}
+
+// replayLog applies every record in the log on top of the snapshot and leaves the log open for appending.
+// If the last record is incomplete, the log is truncated to the end of the last complete record.
+func (fc *fileHistoryCache) replayLog() error {
+	logFile, err := os.OpenFile(filepath.Join(fc.directory, logFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var validLength int64
+	reader := bufio.NewReader(logFile)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding incomplete cache record at offset %d", validLength)
+			}
+			break
+		} else if err != nil {
+			logFile.Close()
+			return err
+		}
+
+		var record cacheRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("Discarding corrupt cache record at offset %d: %v", validLength, err)
+			break
+		}
+		fc.restore(record)
+		fc.recordsSinceSnapshot++
+		validLength += int64(len(line))
+	}
+
+	if err := logFile.Truncate(validLength); err != nil {
+		logFile.Close()
+		return err
+	}
+	if _, err := logFile.Seek(validLength, io.SeekStart); err != nil {
+		logFile.Close()
+		return err
+	}
+
+	fc.logFile = logFile
+	return nil
+}
@@ -0,0 +1,300 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+func TestFileHistoryCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 3)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.Update("file1", 100)
+	cache.Update("file1", 200)
+	cache.Update("file2", 150)
+	cache.Update("file1", 300) // written to the log after the first snapshot
+	cache.Get("file3")         // never updated, so never persisted
+
+	// simulate a crash by closing the log without the final snapshot
+	cache.logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 3)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+
+	if lastModified, version := reopened.Get("file1"); lastModified != 300 || version != 3 {
+		t.Errorf("file1: got (%d, %d), want (300, 3)", lastModified, version)
+	}
+	if lastModified, version := reopened.Get("file2"); lastModified != 150 || version != 1 {
+		t.Errorf("file2: got (%d, %d), want (150, 1)", lastModified, version)
+	}
+	if version := reopened.Update("file2", 250); version != 2 {
+		t.Errorf("file2 update: got version %d, want 2", version)
+	}
+}
+
+func TestFileHistoryCacheDiscardsIncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.Update("file1", 100)
+	cache.logFile.Close()
+
+	// append half a record, as if the process crashed mid-write
+	logFile, _ := os.OpenFile(filepath.Join(dir, logFileName), os.O_APPEND|os.O_WRONLY, 0o644)
+	logFile.WriteString(`{"id":"file1","lastMod`)
+	logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+
+	if lastModified, version := reopened.Get("file1"); lastModified != 100 || version != 1 {
+		t.Errorf("file1: got (%d, %d), want (100, 1)", lastModified, version)
+	}
+	if version := reopened.Update("file1", 200); version != 2 {
+		t.Errorf("file1 update: got version %d, want 2", version)
+	}
+}
+
+func TestFileHistoryCachePersistsTombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.Update("file1", 100)
+	cache.Delete("file1")
+	cache.logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+
+	if !reopened.IsDeleted("file1") {
+		t.Errorf("file1: expected a tombstone")
+	}
+	if _, version := reopened.Get("file1"); version != 2 {
+		t.Errorf("file1: got version %d, want 2", version)
+	}
+}
+
+func TestFileDeadLetterStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letters.json")
+
+	store, err := NewFileDeadLetterStore(path)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	store.Add(DeadLetter{FileId: "file2", Version: 3, Attempts: 5, Error: "transfer failed"})
+	store.Add(DeadLetter{FileId: "file1", Version: 1, Attempts: 5, Error: "transfer failed"})
+	store.Remove("file2")
+
+	reopened, err := NewFileDeadLetterStore(path)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	if letters := reopened.List(); len(letters) != 1 || letters[0].FileId != "file1" || letters[0].Version != 1 {
+		t.Errorf("got dead letters %+v, want file1 version 1", letters)
+	}
+}
+
+func TestFileHistoryCachePersistsPendingVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 100})
+	cache.CompareAndUpdate(model.Metadata{Id: "file2", LastModified: 100})
+	cache.MarkCopied("file2", 1)
+	cache.logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+
+	if version := reopened.PendingVersion("file1"); version != 1 {
+		t.Errorf("file1: got pending version %d, want 1", version)
+	}
+	if version := reopened.PendingVersion("file2"); version != 0 {
+		t.Errorf("file2: got pending version %d, want none", version)
+	}
+}
+
+func TestFileHistoryCachePersistsContentHashes(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 100, ContentHash: "a"})
+	cache.Touch(model.Metadata{Id: "file1", LastModified: 200, ContentHash: "a"})
+	cache.logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+
+	if lastModified, version := reopened.Get("file1"); lastModified != 200 || version != 1 {
+		t.Errorf("file1: got %d, version %d, want the touch at 200 on version 1", lastModified, version)
+	}
+	if hash := reopened.ContentHash("file1"); hash != "a" {
+		t.Errorf("file1: got content hash %q, want a", hash)
+	}
+}
+
+func TestFileHistoryCachePersistsMetadata(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.CompareAndUpdate(model.Metadata{Id: "file1", LastModified: 100, ParentId: "dir1", Name: "a.txt", Path: "dir1/a.txt", Size: 12, ContentType: "text/plain"})
+	cache.Move(model.Metadata{Id: "file1", LastModified: 100, ParentId: "dir2", Name: "a.txt", Path: "dir2/a.txt", Size: 12})
+	cache.logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+
+	want := model.Metadata{Id: "file1", LastModified: 100, ParentId: "dir2", Name: "a.txt", Path: "dir2/a.txt", Size: 12, ContentType: "text/plain"}
+	if metadata, found := reopened.Metadata("file1"); !found || metadata != want {
+		t.Errorf("file1: got metadata %+v, found %v, want %+v", metadata, found, want)
+	}
+	if _, found := reopened.Metadata("file2"); found {
+		t.Errorf("file2: found metadata for a file that was never recorded")
+	}
+}
+
+func TestFileHistoryCachePersistsDirectories(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	cache.Update("file1", 100)
+	cache.SetDirectory("dir1", 100, []model.Metadata{{Id: "dir1/file2", ParentId: "dir1"}})
+	cache.SetDirectory("dir1", 200, []model.Metadata{{Id: "dir1/file3", ParentId: "dir1"}})
+	cache.SetDirectory("dir2", 100, nil)
+	cache.logFile.Close()
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	if lastModified, children, found := reopened.Directory("dir1"); !found || lastModified != 200 ||
+		len(children) != 1 || children[0].Id != "dir1/file3" {
+		t.Errorf("dir1: got %d with children %v, want 200 with dir1/file3", lastModified, children)
+	}
+	if keys := reopened.GetAllCacheKeys(); len(keys) != 1 || keys[0] != "file1" {
+		t.Errorf("got keys %v, want only file1", keys)
+	}
+
+	// forgotten directories stay forgotten after a restart
+	reopened.ForgetDirectories()
+	reopened.logFile.Close()
+	forgotten, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer forgotten.Close()
+	if _, _, found := forgotten.Directory("dir2"); found {
+		t.Errorf("dir2: still recorded after being forgotten")
+	}
+	if _, version := forgotten.Get("file1"); version != 1 {
+		t.Errorf("file1: got version %d, want 1", version)
+	}
+}
+
+func TestFileVersionCatalogSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versions.log")
+
+	catalog, err := NewFileVersionCatalog(path)
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+	catalog.Add(model.FileVersion{FileId: "file1", Version: 2, LastModified: 200, Size: 20})
+	catalog.Add(model.FileVersion{FileId: "file1", Version: 1, LastModified: 100, Size: 10})
+	catalog.Add(model.FileVersion{FileId: "file2", Version: 1, LastModified: 150})
+	catalog.Close()
+
+	// append half a record, as if the process crashed mid-write
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	file.WriteString(`{"fileId":"file1","vers`)
+	file.Close()
+
+	reopened, err := NewFileVersionCatalog(path)
+	if err != nil {
+		t.Fatalf("Error reopening catalog: %v", err)
+	}
+	defer reopened.Close()
+
+	versions := reopened.Versions("file1")
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 || versions[1].Size != 20 {
+		t.Errorf("got versions %+v, want 1 and 2 in order", versions)
+	}
+	reopened.Add(model.FileVersion{FileId: "file1", Version: 3, LastModified: 300})
+	if versions := reopened.Versions("file1"); len(versions) != 3 {
+		t.Errorf("got %d versions after adding one, want 3", len(versions))
+	}
+}
+
+func TestFileVersionCatalogCompactsPrunedVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versions.log")
+
+	catalog, err := NewFileVersionCatalog(path)
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+	for version := 1; version <= 3; version++ {
+		catalog.Add(model.FileVersion{FileId: "file1", Version: version, LastModified: int64(version * 100)})
+	}
+	catalog.Remove("file1", 1)
+	catalog.Remove("file1", 2)
+	catalog.Close()
+
+	reopened, err := NewFileVersionCatalog(path)
+	if err != nil {
+		t.Fatalf("Error reopening catalog: %v", err)
+	}
+	defer reopened.Close()
+
+	if versions := reopened.Versions("file1"); len(versions) != 1 || versions[0].Version != 3 {
+		t.Errorf("got versions %+v, want only 3", versions)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("expected the file to be compacted to one record, got %q", data)
+	}
+	reopened.Add(model.FileVersion{FileId: "file1", Version: 4, LastModified: 400})
+	if versions := reopened.Versions("file1"); len(versions) != 2 {
+		t.Errorf("got %d versions after adding one, want 2", len(versions))
+	}
+}
@@ -0,0 +1,127 @@
+package monitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/samber/lo"
+)
+
+// Health describes the state of the monitor's pipeline
+type Health struct {
+	// Running is true once the monitor has started, until it's shut down
+	Running bool `json:"running"`
+	// QueueDepths is the number of tasks waiting in each stage's queues, keyed by stage
+	QueueDepths map[string]int `json:"queueDepths"`
+	// SweepsInProgress is the number of sweeps currently resolving ids, including partial sweeps for changes
+	SweepsInProgress int `json:"sweepsInProgress"`
+	// LastSweep is the outcome of the last sweep of the whole watchlist, or nil before the first one finishes
+	LastSweep *SweepStatus `json:"lastSweep,omitempty"`
+}
+
+// SweepStatus is the outcome of a sweep of the whole watchlist
+type SweepStatus struct {
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// Complete is true if every id in the watched tree was resolved
+	Complete bool `json:"complete"`
+	// Error is set if the sweep was cancelled
+	Error string `json:"error,omitempty"`
+}
+
+// sweepTracker records the sweeps in progress and the outcome of the last full sweep
+type sweepTracker struct {
+	mu         sync.Mutex
+	inProgress int
+	last       *SweepStatus
+}
+
+// begin records a sweep starting, returning a function that records its outcome
+func (t *sweepTracker) begin(full bool) func(s *sweep, err error) {
+	startedAt := time.Now()
+	t.mu.Lock()
+	t.inProgress++
+	t.mu.Unlock()
+
+	return func(s *sweep, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.inProgress--
+		if !full {
+			return
+		}
+		t.last = &SweepStatus{StartedAt: startedAt, DurationMs: time.Since(startedAt).Milliseconds(), Complete: s.complete()}
+		if err != nil {
+			t.last.Error = err.Error()
+		}
+	}
+}
+
+// Health returns the state of the monitor's pipeline
+func (m *Monitor) Health() Health {
+	health := Health{Running: m.running.Load(), QueueDepths: map[string]int{}}
+	for _, stage := range stages {
+		health.QueueDepths[stage] = m.queueDepth(stage)
+	}
+
+	m.sweeps.mu.Lock()
+	defer m.sweeps.mu.Unlock()
+	health.SweepsInProgress = m.sweeps.inProgress
+	if m.sweeps.last != nil {
+		last := *m.sweeps.last
+		health.LastSweep = &last
+	}
+	return health
+}
+
+// stages are the names of the pipeline's stages, in order
+var stages = []string{"discovery", "evaluation", "copy"}
+
+// queueDepth returns the number of tasks waiting in the queues of the given stage
+func (m *Monitor) queueDepth(stage string) int {
+	m.queuesMu.RLock()
+	defer m.queuesMu.RUnlock()
+	switch stage {
+	case "discovery":
+		return len(m.discoveryChannel)
+	case "evaluation":
+		return lo.SumBy(m.evaluationChannels, func(c chan evaluationTask) int { return len(c) })
+	case "copy":
+		if m.copyQueue == nil {
+			return 0
+		}
+		return m.copyQueue.len()
+	}
+	return 0
+}
+
+// FileStatus is the state of a single file in the cache
+type FileStatus struct {
+	FileId       model.FileId `json:"fileId"`
+	Version      int          `json:"version"`
+	LastModified int64        `json:"lastModified"`
+	Deleted      bool         `json:"deleted"`
+	// PendingVersion is the version waiting to be copied, or zero if there isn't one
+	PendingVersion int             `json:"pendingVersion,omitempty"`
+	WatchType      model.WatchType `json:"watchType"`
+	// ContentHash is the content hash of the latest version, if it's known
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+// FileStatus returns the state of the file with the given ID, and whether it is in the cache
+func (m *Monitor) FileStatus(fileId model.FileId) (FileStatus, bool) {
+	lastModified, version := m.cache.Get(fileId)
+	if version == 0 {
+		return FileStatus{}, false
+	}
+	return FileStatus{
+		FileId:         fileId,
+		Version:        version,
+		LastModified:   lastModified,
+		Deleted:        m.cache.IsDeleted(fileId),
+		PendingVersion: m.cache.PendingVersion(fileId),
+		WatchType:      m.WatchType(fileId),
+		ContentHash:    m.cache.ContentHash(fileId),
+	}, true
+}
@@ -0,0 +1,86 @@
+package monitor
+
+import (
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// When the api propagates directory modification times up the tree (see ModTimePropagationApi), a
+// directory whose LastModified hasn't moved since the last complete sweep has nothing new beneath it, so
+// its subtree doesn't need to be scanned again.  Instead, the sweep visits the files and directories the
+// last complete sweep found beneath it, so they're still treated as watched and aren't mistaken for
+// removals.  Only directories that a complete sweep has scanned can be skipped; any directory beneath a
+// skipped one that wasn't scanned, for example because the watch options have changed since, is scanned
+// as usual.
+//
+// The modification times and the children of the directories are kept in the cache, so that a persistent
+// cache can skip unchanged directories from the first sweep after a restart.  They're only recorded once a
+// sweep completes and the files it found have been evaluated, since a directory that was only partly
+// scanned may still hide changes, and only while no change is settling, since a deferred change isn't in
+// the cache yet.  For the same reason, a monitor that shuts down without draining its pipeline, or with
+// changes still settling, forgets them.
+
+// skipUnchanged returns the ids of the directories that need their children retrieved.  The subtrees of
+// the rest are visited from the children recorded in the cache.
+func (m *Monitor) skipUnchanged(s *sweep, directories []model.Metadata) []model.FileId {
+	scan := make([]model.FileId, 0, len(directories))
+	rescan := []watchTarget{}
+	for _, directory := range directories {
+		lastModified, children, found := m.cache.Directory(directory.Id)
+		if !found || directory.LastModified == 0 || lastModified != directory.LastModified {
+			scan = append(scan, directory.Id)
+			continue
+		}
+		m.metrics.Counter("directories_skipped").Inc()
+		scope, _ := s.scope(directory.Id)
+		rescan = m.replaySubtree(s, directory.Id, lastModified, children, scope, rescan)
+	}
+	m.enqueueDiscovery(s, rescan, true)
+	return scan
+}
+
+// replaySubtree visits the children recorded for the directory, and the subtrees of its children
+// directories, appending any directory the cache doesn't hold to rescan.  The directories replayed keep the
+// modification times they were scanned with.
+func (m *Monitor) replaySubtree(s *sweep, directory model.FileId, lastModified int64, children []model.Metadata, scope watchScope, rescan []watchTarget) []watchTarget {
+	s.recordChildren(directory, children, lastModified)
+	for _, child := range children {
+		if !scope.follows(child) {
+			continue
+		}
+		if !child.IsDirectory {
+			s.visit(child.Id, scope.child())
+			continue
+		}
+		childModified, grandchildren, found := m.cache.Directory(child.Id)
+		if !found {
+			rescan = append(rescan, watchTarget{fileId: child.Id, scope: scope.child()})
+		} else if s.visit(child.Id, scope.child()) {
+			rescan = m.replaySubtree(s, child.Id, childModified, grandchildren, scope.child(), rescan)
+		}
+	}
+	return rescan
+}
+
+// recordTree records the modification times and children of the directories scanned by a complete sweep in
+// the cache, for the sweeps that follow.  It waits for the files the sweep found to be evaluated first.
+func (m *Monitor) recordTree(s *sweep) {
+	if !m.incremental {
+		return
+	}
+	m.flushEvaluations(s.ctx)
+	if s.ctx.Err() != nil || m.settlingCount() > 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for directory, lastModified := range s.modTimes {
+		m.cache.SetDirectory(directory, lastModified, s.children[directory])
+	}
+}
+
+// forgetTree forgets the directories recorded in the cache, so that the next sweep scans everything
+func (m *Monitor) forgetTree() {
+	if m.incremental {
+		m.cache.ForgetDirectories()
+	}
+}
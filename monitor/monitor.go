@@ -1,119 +1,370 @@
 package monitor
 
 import (
-	"errors"
+	"context"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jsfinn/enfi-assessment/metrics"
 	"github.com/jsfinn/enfi-assessment/model"
 	"github.com/samber/lo"
 )
 
 type Monitor struct {
-	api               Api
-	cache             Cache
-	watchlist         map[model.FileId]bool
-	evaluationChannel chan model.Metadata
-	simpleCounter     *SimpleCounter
+	api                ContextApi
+	cache              Cache
+	watchlist          map[model.FileId]model.WatchOptions
+	watchlistMu        sync.RWMutex
+	watchlistStore     WatchlistStore
+	options            Options
+	discoveryChannel   chan discoveryTask
+	evaluationChannels []chan evaluationTask
+	copyQueue          *copyQueue
+	pipelineDone       chan struct{}
+	metrics            *metrics.Registry
+	deadLetters        DeadLetterStore
+	versions           VersionCatalog
+
+	// changeMu serializes changes to the watchlist while they're saved and passed on, and guards
+	// watchlistSources, the change sources told about every change.  watchlistMu is only held to swap the
+	// watchlist, so sweeps aren't held up by a change.
+	changeMu         sync.Mutex
+	watchlistSources []WatchlistChangeSource
+
+	// limiters for the calls to each Api operation
+	metadataLimiter *limiter
+	childrenLimiter *limiter
+	copyLimiter     *limiter
+
+	// optional capabilities of the api, nil if the api doesn't provide them
+	batchMetadata BatchMetadataApi
+	batchChildren BatchChildrenApi
+	deleter       DeleteApi
+	mover         MoveApi
+	hasher        HashApi
+	feed          ChangeFeedApi
+	locator       CopyLocationApi
+	restorer      RestoreApi
+	pruner        PruneApi
+	// incremental is set if the api propagates directory modification times
+	incremental bool
+
+	// ctx is cancelled by ShutDown to interrupt in-flight Api calls, once the pipeline has drained or the
+	// shutdown deadline has passed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// intakeCtx is cancelled as soon as ShutDown is called, to stop new sweeps from starting
+	intakeCtx  context.Context
+	stopIntake context.CancelFunc
+	// lifecycle serializes Start and ShutDown, and running is set between them
+	lifecycle sync.Mutex
+	running   atomic.Bool
+	// watched holds the files visited by the last complete sweep with their scopes, or nil before the first one
+	watchedMu sync.RWMutex
+	watched   map[model.FileId]watchScope
+
+	// sweeps tracks the sweeps in progress for Health
+	sweeps sweepTracker
+	// scheduler runs the sweeps scheduled every IntervalMs
+	scheduler scheduler
+	// settling holds the changed files waiting for QuietPeriodMs to pass before they're copied
+	settling settling
+	// feedMu serializes following the change feed, so that its cursor only moves forward
+	feedMu sync.Mutex
+
+	// queuesMu guards the pipeline's channels while they're replaced, so their depths can be read at any time
+	queuesMu sync.RWMutex
+
+	// intake is held for reading by every sweep while it sends to the discovery channel, and for
+	// writing by Start and ShutDown while they replace or close the channel
+	intake sync.RWMutex
 }
 
-// Create a new monitor with the given API and watchlist
-func NewMonitor(api Api, fileIds []model.FileId, cache Cache, simpleCounter *SimpleCounter) *Monitor {
-	return &Monitor{
-		api:           api,
-		watchlist:     lo.Associate(fileIds, func(fileId model.FileId) (model.FileId, bool) { return fileId, true }),
-		cache:         cache,
-		simpleCounter: simpleCounter,
+// Create a new monitor with the given API and watchlist.  An Api that doesn't accept a context can be
+// wrapped with AdaptApi.  The monitor records its metrics in the given registry.
+func NewMonitor(api ContextApi, fileIds []model.FileId, cache Cache, registry *metrics.Registry, options Options) *Monitor {
+	watchlist := make(map[model.FileId]model.WatchOptions, len(fileIds))
+	for _, fileId := range fileIds {
+		watchlist[fileId] = model.WatchOptions{}
+	}
+	m := &Monitor{
+		api:       api,
+		watchlist: watchlist,
+		cache:     cache,
+		options:   options.withDefaults(),
+		metrics:   registry,
+
+		deadLetters: NewDeadLetterStore(),
+		versions:    NewVersionCatalog(),
 	}
+	m.metadataLimiter = newLimiter("retrieve_metadata", m.options.MetadataLimit, registry)
+	m.childrenLimiter = newLimiter("get_children", m.options.ChildrenLimit, registry)
+	m.copyLimiter = newLimiter("copy_file", m.options.CopyLimit, registry)
+	m.batchMetadata, _ = capability[BatchMetadataApi](api)
+	m.batchChildren, _ = capability[BatchChildrenApi](api)
+	m.deleter, _ = capability[DeleteApi](api)
+	m.mover, _ = capability[MoveApi](api)
+	m.hasher, _ = capability[HashApi](api)
+	m.feed, _ = capability[ChangeFeedApi](api)
+	m.locator, _ = capability[CopyLocationApi](api)
+	m.restorer, _ = capability[RestoreApi](api)
+	m.pruner, _ = capability[PruneApi](api)
+	if propagation, ok := capability[ModTimePropagationApi](api); ok {
+		m.incremental = propagation.PropagatesModTimes()
+	}
+	return m
+}
+
+// SetDeadLetterStore replaces the in-memory store that copies are sent to once they run out of retries.
+// It must be called before Start.
+func (m *Monitor) SetDeadLetterStore(store DeadLetterStore) {
+	m.deadLetters = store
 }
 
-// Start the monitor
+// Start the monitor.  Any copies left pending in the cache by an earlier run are queued again, unless
+// they're in the dead-letter store.  If IntervalMs is set, the monitor starts sweeping the watchlist, and
+// copied versions are pruned every PruneIntervalMs.  Calling Start on a running monitor does nothing, and a
+// monitor that has been shut down can be started again.
 func (m *Monitor) Start() {
-	evaluationChannel := make(chan model.Metadata, 100)
-	m.evaluationChannel = evaluationChannel
-	go func() {
-		for val := range evaluationChannel {
-			m.evaluateMetadata(val)
-		}
-	}()
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	if m.running.Load() {
+		return
+	}
+
+	m.intake.Lock()
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.intakeCtx, m.stopIntake = context.WithCancel(m.ctx)
+	m.queuesMu.Lock()
+	m.startPipeline()
+	m.queuesMu.Unlock()
+	m.intake.Unlock()
+
+	m.running.Store(true)
+	m.registerGauges()
+	m.resumePendingCopies()
+	m.startScheduler()
+	m.startPruner()
 }
 
-// Shut down the monitor and clean up resources
-func (m *Monitor) ShutDown() {
-	close(m.evaluationChannel)
-	m.evaluationChannel = nil
+// discover resolves the file ids of a discovery task.  Files are passed to the evaluation stage, while
+// directories have their children files passed to the evaluation stage and their children directories
+// queued for discovery, as far as the watch options of each directory allow.
+func (m *Monitor) discover(task discoveryTask) {
+	defer task.sweep.pending.Done()
+
+	ctx := task.sweep.ctx
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Retrieve the metadata for the files associated with the fileIds
+	found, missing, ok := m.retrieveMetadata(ctx, task.fileIds)
+	if !ok {
+		task.sweep.markIncomplete()
+	}
+
+	// Any file that no longer exists may need a tombstone
+	for _, fileId := range missing {
+		task.sweep.leave(fileId)
+		m.enqueueDeletion(fileId)
+	}
+
+	directories := []model.Metadata{}
+	for _, metadata := range found {
+		// A file reached by a change sweep is only watched if it belongs to the watched tree
+		if _, resolved := task.sweep.scope(metadata.Id); !resolved && !m.resolveScope(task.sweep, metadata) {
+			continue
+		}
+		if metadata.IsDirectory {
+			directories = append(directories, metadata)
+		} else {
+			// If the file is not a directory, add it's metadata to the evaluation stage
+			scope, _ := task.sweep.scope(metadata.Id)
+			m.enqueueEvaluation(metadata, m.copyPriority(metadata.Id, scope))
+		}
+	}
+	if len(directories) == 0 {
+		return
+	}
+
+	// Retrieve the children of the directories, skipping those that haven't changed
+	scan := lo.Map(directories, func(directory model.Metadata, _ int) model.FileId { return directory.Id })
+	if m.incremental {
+		scan = m.skipUnchanged(task.sweep, directories)
+	}
+	childrenById, ok := m.retrieveChildren(ctx, scan)
+	if !ok {
+		task.sweep.markIncomplete()
+	}
+	if m.incremental {
+		for _, directory := range directories {
+			if children, found := childrenById[directory.Id]; found {
+				task.sweep.recordChildren(directory.Id, children, directory.LastModified)
+			}
+		}
+	}
+
+	childDirectories := []watchTarget{}
+	for _, directory := range scan {
+		scope, _ := task.sweep.scope(directory)
+		for _, child := range childrenById[directory] {
+			if !scope.follows(child) {
+				// Excluded or too deep, so the child is ignored and a directory is never scanned
+				continue
+			}
+			if child.IsDirectory {
+				// If the child is a directory, queue it for discovery unless it's already been visited
+				childDirectories = append(childDirectories, watchTarget{fileId: child.Id, scope: scope.child()})
+			} else if task.sweep.visit(child.Id, scope.child()) {
+				// If the child is a file, add it to the evaluation stage, as we've already got the metadata
+				m.enqueueEvaluation(child, m.copyPriority(child.Id, scope.child()))
+			}
+		}
+	}
+	m.enqueueDiscovery(task.sweep, childDirectories, true)
 }
 
 // Evaluate the metadata for the given file.  If the file has been modified since the last evaluation,
-// it will copy the file with a new verion identifier.
-func (m *Monitor) evaluateMetadata(metadata model.Metadata) {
-	if lastModified, _ := m.cache.Get(metadata.Id); lastModified < metadata.LastModified {
-		version := m.cache.Update(metadata.Id, metadata.LastModified)
-		m.api.CopyFile(metadata.Id, metadata.LastModified, version)
-		m.simpleCounter.IncrementStat("copy_file_calls")
+// it will queue a copy of the file with a new verion identifier once it has settled, unless its content
+// hash shows that it was only touched.
+func (m *Monitor) evaluateMetadata(metadata model.Metadata, priority int) {
+	if m.ctx.Err() != nil {
+		return
+	}
+	if lastModified, _ := m.cache.Get(metadata.Id); metadata.LastModified > lastModified || m.cache.IsDeleted(metadata.Id) {
+		if !m.settled(metadata) {
+			return
+		}
+		metadata.ContentHash = m.contentHash(metadata)
+		if m.cache.Touch(metadata) {
+			// The content is the same as the latest version's, so there's nothing new to copy
+			m.metrics.Counter("files_touched_unchanged").Inc()
+			m.recordMove(metadata)
+			return
+		}
+	}
+	if version, updated := m.cache.CompareAndUpdate(metadata); updated {
+		// A modified file is copied to wherever it is now, which covers any move as well
+		m.enqueueCopy(copyTask{fileId: metadata.Id, lastModified: metadata.LastModified, size: metadata.Size, version: version, kind: copyVersion, priority: priority})
+	} else {
+		m.recordMove(metadata)
+	}
+}
+
+// contentHash returns the hash of the file's content, from its metadata if the api provided one, or
+// computed with HashApi if the api supports it.  It returns empty if the hash isn't known, in which case
+// the file is treated as changed.
+func (m *Monitor) contentHash(metadata model.Metadata) string {
+	if metadata.ContentHash != "" || m.hasher == nil {
+		return metadata.ContentHash
+	}
+	ctx, cancel := callContext(m.ctx, m.options.MetadataTimeoutMs)
+	defer cancel()
+	done := m.timeCall("content_hash")
+	hash, err := m.hasher.ContentHash(ctx, metadata.Id)
+	done()
+	m.metrics.Counter("content_hash_calls").Inc()
+	if err != nil {
+		log.Printf("Error hashing FileId %s: %v", metadata.Id, err)
+		return ""
+	}
+	return hash
+}
+
+// copyFile copies a single version of a file, retrying if the copy fails
+func (m *Monitor) copyFile(task copyTask) {
+	if m.ctx.Err() != nil {
+		return
 	}
+	m.copyWithRetry(m.ctx, task)
 }
 
-// Performs the main evaluation task on the watchlist.  This function will iterate over the watchlist
-// and evaluate the metadata for each file.  If the file has been modified since the last evaluation, it will
-// copy the file.
+// Performs the main evaluation task on the watchlist.  Every id in the watchlist is queued for discovery,
+// and any directories found will have their children directories queued as well.  Each directory is only
+// scanned once per call.  This function returns once every id has been resolved; evaluating and copying
+// the files found continues in the later stages of the pipeline.
 func (m *Monitor) EvaluateWatchlist() error {
-	m.simpleCounter.IncrementStat("evaluate_watchlist_calls")
+	return m.EvaluateWatchlistContext(context.Background())
+}
 
-	if m.evaluationChannel == nil {
-		return errors.New("monitor not started")
+// EvaluateWatchlistContext is EvaluateWatchlist with a context.  If the context is cancelled, or the
+// monitor's shut down deadline passes, ids that haven't been resolved yet are skipped and the context's
+// error is returned.  A monitor that isn't running returns ErrNotRunning.
+func (m *Monitor) EvaluateWatchlistContext(ctx context.Context) error {
+	m.metrics.Counter("evaluate_watchlist_calls").Inc()
+	if m.feed != nil {
+		return m.followFeed(ctx)
 	}
+	_, err := m.runSweep(ctx, m.Watchlist(), fullSweep)
+	return err
+}
 
-	// Create a local watchlist of all files and directories to evaluate
-	watchlist := []model.FileId{}
+// runSweep resolves the given ids and passes the files found to the evaluation stage, returning the sweep
+// once every id has been resolved.  A full sweep covers the whole watchlist, so once it has visited the
+// whole watched tree it also looks for files that have disappeared from the tree.
+func (m *Monitor) runSweep(ctx context.Context, fileIds []model.FileId, kind sweepKind) (*sweep, error) {
+	m.intake.RLock()
+	defer m.intake.RUnlock()
 
-	// Add all files in the configured watchlist to the local watchlist
-	for key := range m.watchlist {
-		watchlist = append(watchlist, key)
+	if m.discoveryChannel == nil || m.intakeCtx.Err() != nil {
+		return nil, ErrNotRunning
 	}
 
-	// iterate over the local watchlist.  Any directories found will have their children
-	// directories added to the local watchlist.
-	for len(watchlist) > 0 {
-		fileId := watchlist[0]
-		watchlist = watchlist[1:]
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(m.ctx, cancel)
+	defer stop()
 
-		// Retrieve the metadata for the file associated with the fileId
-		metadata, err := m.api.RetrieveMetadata(fileId)
-		m.simpleCounter.IncrementStat("metadata_retrieved_calls")
+	s := newSweep(ctx, kind)
+	finished := m.sweeps.begin(kind == fullSweep)
+	m.enqueueDiscovery(s, m.sweepTargets(fileIds, kind), false)
+	s.pending.Wait()
 
-		if err != nil {
-			m.simpleCounter.IncrementStat("files_watched")
-			log.Printf("Error retrieving metadata for FileId %s: %v", fileId, err)
-			continue
-		}
+	// Only a sweep that visited the whole watched tree can tell which files have disappeared from it
+	if s.complete() {
+		m.detectRemovals(s)
+		m.recordTree(s)
+	}
+	if kind == feedSweep {
+		m.mergeWatched(s)
+	}
+	// A sweep that moves the feed's cursor forward waits for its files to be evaluated, so that the cursor
+	// is never saved ahead of the cache
+	if m.feed != nil && kind != changeSweep {
+		m.flushEvaluations(ctx)
+	}
 
-		// If the file is a directory
-		if metadata.IsDirectory {
+	err := ctx.Err()
+	s.finish()
+	finished(s, err)
+	return s, err
+}
 
-			// Retrieve the children of the directory
-			children, err := m.api.GetChildren(fileId)
-			m.simpleCounter.IncrementStat("get_children_calls")
-			if err != nil {
-				log.Printf("Error retrieving children for FileId %s: %v", fileId, err)
-				continue
-			}
+// timeCall starts timing a call to the api, returning a function that records the call's latency
+func (m *Monitor) timeCall(call string) func() {
+	start := time.Now()
+	return func() {
+		m.metrics.Histogram("api_call_duration_seconds", "call", call).Observe(time.Since(start).Seconds())
+	}
+}
 
-			for _, child := range children {
-				// If the child is a directory and not already in the configured watchlist, add it to the watchlist
-				if child.IsDirectory {
-					if _, ok := m.watchlist[child.Id]; !ok {
-						watchlist = append(watchlist, child.Id)
-					}
-					// If the child is a file, add it to the evaluation channel, as we've already got the metadata
-				} else {
-					m.evaluationChannel <- child
-				}
-			}
-			// If the file is not a directory, add it's metadata to the evaluation channel
-		} else {
-			m.evaluationChannel <- metadata
+// registerGauges reports the depth of each stage's queues and the size of the watchlist whenever the
+// metrics are read
+func (m *Monitor) registerGauges() {
+	m.metrics.GaugeFunc("watchlist_size", func() float64 {
+		m.watchlistMu.RLock()
+		defer m.watchlistMu.RUnlock()
+		return float64(len(m.watchlist))
+	})
+	for _, stage := range stages {
+		m.metrics.GaugeFunc("queue_depth", func() float64 { return float64(m.queueDepth(stage)) }, "stage", stage)
+	}
+	for _, l := range []*limiter{m.metadataLimiter, m.childrenLimiter, m.copyLimiter} {
+		if l.limit.PerSecond > 0 {
+			m.metrics.GaugeFunc("rate_limit_per_second", l.currentRate, "operation", l.operation)
 		}
 	}
-
-	return nil
 }
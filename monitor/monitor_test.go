@@ -1,14 +1,52 @@
 package monitor
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jsfinn/enfi-assessment/metrics"
 	"github.com/jsfinn/enfi-assessment/mock"
 	"github.com/jsfinn/enfi-assessment/model"
 )
 
+// drain waits until every evaluation queued so far has been made and the copies it queued have all been
+// made too, failing the test if that takes too long
+func drain(t *testing.T, monitor *Monitor) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	monitor.flushEvaluations(ctx)
+	if ctx.Err() != nil {
+		t.Fatalf("timed out waiting for the evaluations to be made")
+	}
+	waitFor(t, "the copies to be made", func() bool {
+		queue := monitor.copyQueue
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		return len(queue.files) == 0
+	})
+}
+
+// waitFor polls the condition until it holds, failing the test if it still doesn't after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestMonitor(t *testing.T) {
 
 	fp := mock.NewFileProvider(0, 0)
@@ -21,24 +59,23 @@ func TestMonitor(t *testing.T) {
 
 	historyCache := NewHistoryCache()
 	watchList := []model.FileId{"dir1"}
-	simpleCounter := NewSimpleCounter()
+	registry := metrics.NewRegistry()
 
 	log.Printf("watchList: %v", watchList)
 
-	monitor := NewMonitor(fp, watchList, historyCache, simpleCounter)
+	monitor := NewMonitor(AdaptApi(fp), watchList, historyCache, registry, DefaultOptions())
 	monitor.Start()
 
 	monitor.EvaluateWatchlist()
-	time.Sleep(10 * time.Millisecond)
+	drain(t, monitor)
 	log.Printf("-------------------")
-	time.Sleep(10 * time.Millisecond)
 	monitor.EvaluateWatchlist()
+	drain(t, monitor)
 	log.Printf("-------------------")
-	time.Sleep(10 * time.Millisecond)
 	fp.UpdateLastModified("file2")
 	monitor.EvaluateWatchlist()
+	drain(t, monitor)
 	log.Printf("-------------------")
-	time.Sleep(10 * time.Millisecond)
 	fp.UpdateLastModified("file2")
 	monitor.EvaluateWatchlist()
 
@@ -51,7 +88,7 @@ func TestMonitorWithScale(t *testing.T) {
 	directoryCount := 100
 	watchCount := 100
 
-	simpleCounter := NewSimpleCounter()
+	registry := metrics.NewRegistry()
 	fp := mock.NewFileProvider(fileCount, directoryCount)
 
 	historyCache := NewHistoryCache()
@@ -59,7 +96,7 @@ func TestMonitorWithScale(t *testing.T) {
 	// 500 files to watch
 	watchList := fp.CreateWatchList(watchCount)
 
-	monitor := NewMonitor(fp, watchList, historyCache, simpleCounter)
+	monitor := NewMonitor(AdaptApi(fp), watchList, historyCache, registry, DefaultOptions())
 	monitor.Start()
 
 	// check the watchlist 100 times
@@ -70,6 +107,1637 @@ func TestMonitorWithScale(t *testing.T) {
 			_ = append(ids, fp.UpdateAny())
 		}
 		monitor.EvaluateWatchlist()
-		time.Sleep(1000 * time.Millisecond)
+		drain(t, monitor)
+	}
+	monitor.ShutDown()
+}
+
+// recordingApi wraps an Api and records the versions passed to CopyFile for each file
+type recordingApi struct {
+	Api
+	mu     sync.Mutex
+	copies map[model.FileId][]int
+}
+
+func (r *recordingApi) CopyFile(fileId model.FileId, lastModified int64, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.copies[fileId] = append(r.copies[fileId], version)
+	return nil
+}
+
+func TestPipelinePreservesPerFileOrder(t *testing.T) {
+	fp := mock.NewFileProvider(200, 10)
+	api := &recordingApi{Api: fp, copies: make(map[model.FileId][]int)}
+	watchList := fp.CreateWatchList(50)
+
+	monitor := NewMonitor(AdaptApi(api), watchList, NewHistoryCache(), metrics.NewRegistry(),
+		Options{DiscoveryWorkers: 3, EvaluationWorkers: 5, CopyWorkers: 7, QueueSize: 1})
+	monitor.Start()
+
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 100; j++ {
+			fp.UpdateAny()
+		}
+		monitor.EvaluateWatchlist()
+	}
+	monitor.ShutDown()
+	<-monitor.pipelineDone
+
+	// a copy interrupted by the shut down may still be recording in the background
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.copies) == 0 {
+		t.Fatalf("expected files to be copied")
+	}
+	for fileId, versions := range api.copies {
+		for i, version := range versions {
+			if version != i+1 {
+				t.Fatalf("file %s copied out of order: %v", fileId, versions)
+			}
+		}
+	}
+}
+
+// hangingApi is an Api whose calls block until released
+type hangingApi struct {
+	Api
+	release chan struct{}
+}
+
+func (h *hangingApi) RetrieveMetadata(fileId model.FileId) (model.Metadata, error) {
+	<-h.release
+	return h.Api.RetrieveMetadata(fileId)
+}
+
+func TestEvaluateWatchlistHonoursCancellation(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	api := &hangingApi{Api: fp, release: make(chan struct{})}
+	defer close(api.release)
+
+	// per-call timeout
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1"}, NewHistoryCache(), metrics.NewRegistry(),
+		Options{MetadataTimeoutMs: 20})
+	monitor.Start()
+	start := time.Now()
+	if err := monitor.EvaluateWatchlist(); err != nil {
+		t.Errorf("expected the sweep to complete, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("metadata timeout not honoured, sweep took %v", elapsed)
+	}
+
+	// caller's context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	monitor.options.MetadataTimeoutMs = 0
+	if err := monitor.EvaluateWatchlistContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// a shut down that reaches its deadline interrupts a sweep in flight
+	done := make(chan error)
+	go func() { done <- monitor.EvaluateWatchlist() }()
+	waitFor(t, "the sweep to start", func() bool { return monitor.Health().SweepsInProgress == 1 })
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShutdown()
+	if report := monitor.ShutDownContext(shutdownCtx); report.Drained {
+		t.Errorf("expected the shut down to give up waiting for the sweep")
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("shut down did not interrupt the sweep")
+	}
+}
+
+// hangingCopyApi is an Api whose copies block until released, counting the copies running at once
+type hangingCopyApi struct {
+	Api
+	release chan struct{}
+	mu      sync.Mutex
+	running int
+	calls   int
+	overlap bool
+}
+
+func (h *hangingCopyApi) CopyFile(fileId model.FileId, lastModified int64, version int) error {
+	h.mu.Lock()
+	h.calls++
+	h.running++
+	h.overlap = h.overlap || h.running > 1
+	h.mu.Unlock()
+	<-h.release
+	h.mu.Lock()
+	h.running--
+	h.mu.Unlock()
+	return h.Api.CopyFile(fileId, lastModified, version)
+}
+
+func TestAdapterHoldsFileUntilDetachedCopyReturns(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	api := &hangingCopyApi{Api: fp, release: make(chan struct{})}
+	adapter := AdaptApi(api)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := adapter.CopyFile(ctx, "file1", 1, 1)
+	var detached *detachedCallError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &detached) {
+		t.Fatalf("got %v from a copy that timed out, want a detached deadline exceeded", err)
+	}
+
+	// the copy is still running, so a retry waits for it rather than copying alongside it
+	retryCtx, cancelRetry := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelRetry()
+	if err := adapter.CopyFile(retryCtx, "file1", 1, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v retrying while the copy was running, want deadline exceeded", err)
+	}
+
+	close(api.release)
+	<-detached.returned
+	if err := adapter.CopyFile(context.Background(), "file1", 1, 1); err != nil {
+		t.Errorf("got %v once the copy had returned", err)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.calls != 2 || api.overlap {
+		t.Errorf("got %d copies, overlapping %v, want 2 that never overlap", api.calls, api.overlap)
+	}
+}
+
+// singleCallApi hides the optional batch capabilities of the wrapped Api
+type singleCallApi struct {
+	Api
+}
+
+func TestBatchCallsMatchSingleCalls(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir2", "dir1")
+	fp.AddDirectory("dir3", "")
+	watchList := []model.FileId{"dir1", "dir3"}
+	for i := 0; i < 30; i++ {
+		fileId := model.FileId(fmt.Sprintf("file%d", i))
+		fp.AddFile(fileId, []model.FileId{"", "dir1", "dir2", "dir3"}[i%4])
+		if i%4 == 0 {
+			watchList = append(watchList, fileId)
+		}
+	}
+
+	// a single discovery worker keeps the discovery stats exact
+	options := Options{DiscoveryWorkers: 1, BatchSize: 4}
+
+	run := func(api ContextApi, options Options) (*metrics.Registry, []model.FileId) {
+		counter := metrics.NewRegistry()
+		cache := NewHistoryCache()
+		monitor := NewMonitor(api, watchList, cache, counter, options)
+		monitor.Start()
+		monitor.EvaluateWatchlist()
+		monitor.ShutDown()
+		keys := cache.GetAllCacheKeys()
+		slices.Sort(keys)
+		return counter, keys
+	}
+
+	singleCounter, singleKeys := run(AdaptApi(&singleCallApi{Api: fp}), options)
+	batchCounter, batchKeys := run(AdaptApi(fp), options)
+	unbatchedOptions := options
+	unbatchedOptions.BatchSize = 1
+	unbatchedCounter, unbatchedKeys := run(AdaptApi(fp), unbatchedOptions)
+
+	if !slices.Equal(singleKeys, batchKeys) {
+		t.Errorf("batch evaluated %v, single evaluated %v", batchKeys, singleKeys)
+	}
+	if !slices.Equal(singleKeys, unbatchedKeys) {
+		t.Errorf("batch size 1 evaluated %v, single evaluated %v", unbatchedKeys, singleKeys)
+	}
+	if singleCounter.Counter("batch_metadata_retrieved_calls").Value() != 0 || singleCounter.Counter("batch_get_children_calls").Value() != 0 {
+		t.Errorf("batch calls made to an api without batch support")
+	}
+	if unbatchedCounter.Counter("batch_metadata_retrieved_calls").Value() != 0 || unbatchedCounter.Counter("batch_get_children_calls").Value() != 0 {
+		t.Errorf("batch calls made with a batch size of 1")
+	}
+	if calls := batchCounter.Counter("batch_get_children_calls").Value(); calls == 0 {
+		t.Errorf("no batch children calls made to an api with batch support")
+	}
+	// 10 ids in the watchlist in batches of 4, then dir2 on its own
+	if calls := batchCounter.Counter("batch_metadata_retrieved_calls").Value(); calls != 3 {
+		t.Errorf("batch metadata calls: got %d, want 3", calls)
+	}
+	if calls := batchCounter.Counter("metadata_retrieved_calls").Value(); calls != 1 {
+		t.Errorf("single metadata calls: got %d, want 1", calls)
+	}
+	if calls := singleCounter.Counter("metadata_retrieved_calls").Value(); calls != 11 {
+		t.Errorf("metadata calls without batching: got %d, want 11", calls)
+	}
+}
+
+// deletionRecordingApi wraps an Api and records the calls to DeleteCopy, failing them while failing is set
+type deletionRecordingApi struct {
+	Api
+	mu      sync.Mutex
+	deletes map[model.FileId]int
+	failing bool
+}
+
+func (d *deletionRecordingApi) DeleteCopy(ctx context.Context, fileId model.FileId, version int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failing {
+		return errors.New("tombstone failed")
+	}
+	d.deletes[fileId] = version
+	return nil
+}
+
+func TestDeletionsRecordTombstones(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir2", "dir1")
+	fp.AddFile("file1", "")
+	fp.AddFile("file2", "dir1")
+	fp.AddFile("file3", "dir2")
+	fp.AddFile("file4", "dir2")
+	api := &deletionRecordingApi{Api: fp, deletes: make(map[model.FileId]int)}
+
+	cache := NewHistoryCache()
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1", "dir1"}, cache, metrics.NewRegistry(), DefaultOptions())
+	monitor.Start()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	// an explicit file, an implicit file, and a directory with an implicit file beneath it
+	fp.RemoveFile("file1")
+	fp.RemoveFile("file2")
+	fp.RemoveFile("dir2")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	// a file that comes back is copied again
+	fp.AddFile("file2", "dir1")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	monitor.ShutDown()
+	<-monitor.pipelineDone
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for _, fileId := range []model.FileId{"file1", "file2", "file3", "file4"} {
+		if version := api.deletes[fileId]; version != 2 {
+			t.Errorf("%s: got tombstone version %d, want 2", fileId, version)
+		}
+	}
+	for fileId, want := range map[model.FileId]bool{"file1": true, "file2": false, "file3": true, "file4": true} {
+		if deleted := cache.IsDeleted(fileId); deleted != want {
+			t.Errorf("%s: got deleted %v, want %v", fileId, deleted, want)
+		}
+	}
+	if _, version := cache.Get("file2"); version != 3 {
+		t.Errorf("file2: got version %d after it was recreated, want 3", version)
+	}
+}
+
+func TestFailedDeletionsAreRetriedAndDeadLettered(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	api := &deletionRecordingApi{Api: fp, deletes: make(map[model.FileId]int), failing: true}
+
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.CopyAttempts = 3
+	options.RetryBaseDelayMs = 1
+	options.RetryMaxDelayMs = 5
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1"}, NewHistoryCache(), registry, options)
+	monitor.Start()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	fp.RemoveFile("file1")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	letters := monitor.deadLetters.List()
+	if len(letters) != 1 || letters[0].FileId != "file1" || letters[0].Kind != DeadLetterDelete || letters[0].Version != 2 || letters[0].Attempts != 3 {
+		t.Errorf("got dead letters %+v", letters)
+	}
+	if retries := registry.Counter("copy_retries").Value(); retries != 2 {
+		t.Errorf("got %d retries, want 2", retries)
+	}
+
+	// once the api recovers, replaying the dead letter records the tombstone
+	api.mu.Lock()
+	api.failing = false
+	api.mu.Unlock()
+	if replayed := monitor.ReplayDeadLetters(context.Background()); replayed != 1 {
+		t.Errorf("replayed %d dead letters, want 1", replayed)
+	}
+	api.mu.Lock()
+	if version := api.deletes["file1"]; version != 2 {
+		t.Errorf("file1: got tombstone version %d after replay, want 2", version)
+	}
+	api.mu.Unlock()
+	if letters := monitor.deadLetters.List(); len(letters) != 0 {
+		t.Errorf("got dead letters %+v after replay", letters)
+	}
+
+	monitor.ShutDown()
+}
+
+// moveRecordingApi wraps an Api and records the calls to CopyFile and MoveCopy, failing moves while failing
+// is set
+type moveRecordingApi struct {
+	Api
+	mu      sync.Mutex
+	copies  map[model.FileId]int
+	moves   map[model.FileId][]model.FileId
+	failing bool
+}
+
+func (r *moveRecordingApi) CopyFile(fileId model.FileId, lastModified int64, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.copies[fileId]++
+	return nil
+}
+
+func (r *moveRecordingApi) MoveCopy(ctx context.Context, fileId model.FileId, fromParentId model.FileId, toParentId model.FileId, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failing {
+		return errors.New("move failed")
+	}
+	r.moves[fileId] = append(r.moves[fileId], toParentId)
+	return nil
+}
+
+func TestMovesAreTracked(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir2", "dir1")
+	fp.AddDirectory("outside", "")
+	fp.AddFile("file1", "")
+	fp.AddFile("file2", "dir1")
+	fp.AddFile("file3", "dir1")
+	api := &moveRecordingApi{Api: fp, copies: make(map[model.FileId]int), moves: make(map[model.FileId][]model.FileId)}
+
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1", "dir1"}, NewHistoryCache(), metrics.NewRegistry(), DefaultOptions())
+	monitor.Start()
+	sweep := func() {
+		monitor.EvaluateWatchlist()
+		drain(t, monitor)
+	}
+
+	sweep()
+	fp.MoveFile("file1", "dir1")    // explicit, stays explicit
+	fp.MoveFile("file2", "dir2")    // within the watched tree
+	fp.MoveFile("file3", "outside") // out of the watched tree
+	sweep()
+
+	if watchType := monitor.WatchType("file1"); watchType != model.WatchTypeExplicit {
+		t.Errorf("file1: got %v, want explicit", watchType)
+	}
+	if watchType := monitor.WatchType("file3"); watchType != model.WatchTypeUnwatched {
+		t.Errorf("file3: got %v, want unwatched", watchType)
+	}
+
+	fp.MoveFile("file3", "dir2") // back into the watched tree
+	sweep()
+	sweep()
+
+	if watchType := monitor.WatchType("file3"); watchType != model.WatchTypeImplicit {
+		t.Errorf("file3: got %v, want implicit", watchType)
+	}
+
+	monitor.ShutDown()
+	<-monitor.pipelineDone
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	want := map[model.FileId][]model.FileId{"file1": {"dir1"}, "file2": {"dir2"}, "file3": {"outside", "dir2"}}
+	for fileId, moves := range want {
+		if !slices.Equal(api.moves[fileId], moves) {
+			t.Errorf("%s: got moves %v, want %v", fileId, api.moves[fileId], moves)
+		}
+		if api.copies[fileId] != 1 {
+			t.Errorf("%s: copied %d times, want 1", fileId, api.copies[fileId])
+		}
+	}
+}
+
+func TestFailedMovesAreRetriedAndDeadLettered(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir2", "dir1")
+	fp.AddFile("file1", "dir1")
+	api := &moveRecordingApi{Api: fp, copies: make(map[model.FileId]int), moves: make(map[model.FileId][]model.FileId), failing: true}
+
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.CopyAttempts = 3
+	options.RetryBaseDelayMs = 1
+	options.RetryMaxDelayMs = 5
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"dir1"}, NewHistoryCache(), registry, options)
+	monitor.Start()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	fp.MoveFile("file1", "dir2")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	letters := monitor.deadLetters.List()
+	if len(letters) != 1 || letters[0].FileId != "file1" || letters[0].Kind != DeadLetterMove || letters[0].Version != 2 ||
+		letters[0].FromParentId != "dir1" || letters[0].ToParentId != "dir2" || letters[0].Attempts != 3 {
+		t.Errorf("got dead letters %+v", letters)
+	}
+	if retries := registry.Counter("copy_retries").Value(); retries != 2 {
+		t.Errorf("got %d retries, want 2", retries)
+	}
+
+	// once the api recovers, replaying the dead letter moves the copy
+	api.mu.Lock()
+	api.failing = false
+	api.mu.Unlock()
+	if replayed := monitor.ReplayDeadLetters(context.Background()); replayed != 1 {
+		t.Errorf("replayed %d dead letters, want 1", replayed)
+	}
+	api.mu.Lock()
+	if moves := api.moves["file1"]; !slices.Equal(moves, []model.FileId{"dir2"}) {
+		t.Errorf("file1: got moves %v after replay, want [dir2]", moves)
+	}
+	api.mu.Unlock()
+	if letters := monitor.deadLetters.List(); len(letters) != 0 {
+		t.Errorf("got dead letters %+v after replay", letters)
+	}
+
+	monitor.ShutDown()
+}
+
+// channelChangeSource is a ChangeSource driven by the test
+type channelChangeSource struct {
+	changes   chan model.FileId
+	overflows chan struct{}
+}
+
+func (c *channelChangeSource) Changes() <-chan model.FileId { return c.changes }
+func (c *channelChangeSource) Overflows() <-chan struct{}   { return c.overflows }
+
+func TestChangeNotificationsAreEvaluated(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("file1", "dir1")
+	fp.AddFile("file2", "dir1")
+	source := &channelChangeSource{changes: make(chan model.FileId), overflows: make(chan struct{})}
+
+	cache := NewHistoryCache()
+	counter := metrics.NewRegistry()
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, cache, counter, DefaultOptions())
+	monitor.Start()
+	defer monitor.ShutDown()
+	monitor.WatchChanges(source)
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	// a notification is picked up without a sweep
+	fp.UpdateLastModified("file1")
+	source.changes <- "file1"
+	waitFor(t, "file1 version 2", func() bool { _, version := cache.Get("file1"); return version == 2 })
+
+	// an overflow runs a full sweep
+	fp.UpdateLastModified("file2")
+	source.overflows <- struct{}{}
+	waitFor(t, "file2 version 2", func() bool { _, version := cache.Get("file2"); return version == 2 })
+	if calls := counter.Counter("evaluate_watchlist_calls").Value(); calls != 2 {
+		t.Errorf("got %d sweeps, want 2", calls)
+	}
+}
+
+// watchlistChangeSource is a channelChangeSource that records the watchlist it's given
+type watchlistChangeSource struct {
+	channelChangeSource
+	mu        sync.Mutex
+	watchlist []model.FileId
+}
+
+func (w *watchlistChangeSource) UpdateWatchlist(added []model.FileId, removed []model.FileId) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watchlist = slices.DeleteFunc(w.watchlist, func(fileId model.FileId) bool { return slices.Contains(removed, fileId) })
+	w.watchlist = slices.Sorted(slices.Values(append(w.watchlist, added...)))
+}
+
+func TestChangeSourceFollowsWatchlist(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("file1", "")
+	source := &watchlistChangeSource{channelChangeSource: channelChangeSource{changes: make(chan model.FileId), overflows: make(chan struct{})}}
+
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, NewHistoryCache(), metrics.NewRegistry(), DefaultOptions())
+	monitor.Start()
+	defer monitor.ShutDown()
+	monitor.WatchChanges(source)
+
+	watchlist := func() []model.FileId {
+		source.mu.Lock()
+		defer source.mu.Unlock()
+		return source.watchlist
+	}
+	if got := watchlist(); !slices.Equal(got, []model.FileId{"dir1"}) {
+		t.Errorf("got watchlist %v once watching changes, want [dir1]", got)
+	}
+	monitor.AddToWatchlist("file1")
+	monitor.RemoveFromWatchlist("dir1")
+	if got := watchlist(); !slices.Equal(got, []model.FileId{"file1"}) {
+		t.Errorf("got watchlist %v after changing it, want [file1]", got)
+	}
+
+	// a closed source is no longer told
+	close(source.changes)
+	waitFor(t, "the source to stop being watched", func() bool {
+		monitor.changeMu.Lock()
+		defer monitor.changeMu.Unlock()
+		return len(monitor.watchlistSources) == 0
+	})
+	monitor.AddToWatchlist("dir1")
+	if got := watchlist(); !slices.Equal(got, []model.FileId{"file1"}) {
+		t.Errorf("got watchlist %v after the source closed, want [file1]", got)
+	}
+}
+
+// failingCopyApi wraps an Api and fails the first failures[fileId] copies of each file
+type failingCopyApi struct {
+	Api
+	mu       sync.Mutex
+	failures map[model.FileId]int
+}
+
+func (f *failingCopyApi) CopyFile(fileId model.FileId, lastModified int64, version int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures[fileId] > 0 {
+		f.failures[fileId]--
+		return errors.New("transfer failed")
+	}
+	return nil
+}
+
+func TestFailedCopiesAreRetriedAndDeadLettered(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	fp.AddFile("file2", "")
+	api := &failingCopyApi{Api: fp, failures: map[model.FileId]int{"file1": 2, "file2": 100}}
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.CopyAttempts = 3
+	options.RetryBaseDelayMs = 1
+	options.RetryMaxDelayMs = 5
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1", "file2"}, cache, registry, options)
+	monitor.Start()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	if version := cache.PendingVersion("file1"); version != 0 {
+		t.Errorf("file1: got pending version %d after it was retried, want none", version)
+	}
+	if version := cache.PendingVersion("file2"); version != 1 {
+		t.Errorf("file2: got pending version %d, want 1", version)
+	}
+	letters := monitor.deadLetters.List()
+	if len(letters) != 1 || letters[0].FileId != "file2" || letters[0].Version != 1 || letters[0].Attempts != 3 {
+		t.Errorf("got dead letters %+v", letters)
+	}
+	if retries := registry.Counter("copy_retries").Value(); retries != 4 {
+		t.Errorf("got %d retries, want 4", retries)
+	}
+
+	// once the api recovers, replaying the dead letter copies the pending version
+	api.mu.Lock()
+	api.failures["file2"] = 0
+	api.mu.Unlock()
+	if replayed := monitor.ReplayDeadLetters(context.Background()); replayed != 1 {
+		t.Errorf("replayed %d dead letters, want 1", replayed)
+	}
+	if version := cache.PendingVersion("file2"); version != 0 {
+		t.Errorf("file2: got pending version %d after replay, want none", version)
+	}
+	if letters := monitor.deadLetters.List(); len(letters) != 0 {
+		t.Errorf("got dead letters %+v after replay", letters)
+	}
+
+	monitor.ShutDown()
+}
+
+// blockingWatchlistStore is a WatchlistStore whose Save waits until release is closed
+type blockingWatchlistStore struct {
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingWatchlistStore) Load() ([]model.WatchEntry, bool, error) { return nil, false, nil }
+
+func (b *blockingWatchlistStore) Save(entries []model.WatchEntry) error {
+	close(b.saving)
+	<-b.release
+	return nil
+}
+
+func TestWatchlistReadableWhileSaving(t *testing.T) {
+	store := &blockingWatchlistStore{saving: make(chan struct{}), release: make(chan struct{})}
+	monitor := NewMonitor(AdaptApi(mock.NewFileProvider(0, 0)), []model.FileId{"file1"}, NewHistoryCache(), metrics.NewRegistry(), DefaultOptions())
+	monitor.SetWatchlistStore(store)
+
+	added := make(chan error)
+	go func() { added <- monitor.AddToWatchlist("file2") }()
+	<-store.saving
+
+	// the pipeline can still read the watchlist while the change is being saved
+	read := make(chan []model.FileId)
+	go func() { read <- monitor.Watchlist() }()
+	select {
+	case watchlist := <-read:
+		if !slices.Equal(watchlist, []model.FileId{"file1"}) {
+			t.Errorf("got watchlist %v while saving, want [file1]", watchlist)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("reading the watchlist was blocked by the save")
+	}
+
+	close(store.release)
+	if err := <-added; err != nil {
+		t.Fatalf("Error adding to watchlist: %v", err)
+	}
+	if watchlist := monitor.Watchlist(); !slices.Equal(watchlist, []model.FileId{"file1", "file2"}) {
+		t.Errorf("got watchlist %v once saved, want [file1 file2]", watchlist)
+	}
+}
+
+func TestWatchlistChangesWhileRunning(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("file1", "")
+	fp.AddFile("file2", "dir1")
+
+	cache := NewHistoryCache()
+	store := NewFileWatchlistStore(filepath.Join(t.TempDir(), "watchlist.json"))
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"file1"}, cache, metrics.NewRegistry(), DefaultOptions())
+	monitor.SetWatchlistStore(store)
+	monitor.Start()
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	// sweeps keep running while the watchlist changes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			monitor.EvaluateWatchlist()
+		}
+	}()
+	if err := monitor.AddToWatchlist("dir1"); err != nil {
+		t.Fatalf("Error adding to watchlist: %v", err)
+	}
+	if err := monitor.RemoveFromWatchlist("file1"); err != nil {
+		t.Fatalf("Error removing from watchlist: %v", err)
+	}
+	<-done
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	monitor.ShutDown()
+
+	if _, version := cache.Get("file2"); version != 1 {
+		t.Errorf("file2: got version %d, want 1 once dir1 was added", version)
+	}
+	// the removed file keeps its history but is no longer watched
+	if _, version := cache.Get("file1"); version != 1 {
+		t.Errorf("file1: got version %d, want its history kept", version)
+	}
+	if watchType := monitor.WatchType("file1"); watchType != model.WatchTypeUnwatched {
+		t.Errorf("file1: got watch type %v, want unwatched", watchType)
+	}
+	if cache.IsDeleted("file1") {
+		t.Errorf("file1: removing it from the watchlist recorded a tombstone")
+	}
+
+	saved, found, err := store.Load()
+	if err != nil || !found || !slices.Equal(model.WatchEntryIds(saved), []model.FileId{"dir1"}) {
+		t.Errorf("got saved watchlist %v (%v, %v), want [dir1]", saved, found, err)
+	}
+}
+
+// slowApi is an Api whose metadata calls take delay to return
+type slowApi struct {
+	Api
+	delay time.Duration
+}
+
+func (s *slowApi) RetrieveMetadata(fileId model.FileId) (model.Metadata, error) {
+	time.Sleep(s.delay)
+	return s.Api.RetrieveMetadata(fileId)
+}
+
+func TestScheduledSweepsSkipTicksWhileRunning(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	api := &slowApi{Api: fp, delay: 30 * time.Millisecond}
+
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.IntervalMs = 10
+	options.JitterMs = 2
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1"}, NewHistoryCache(), registry, options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := monitor.Run(ctx); err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Run returned after %v, before its context was done", elapsed)
+	}
+
+	sweeps := registry.Counter("evaluate_watchlist_calls").Value()
+	if sweeps < 2 || sweeps > 10 {
+		t.Errorf("got %d sweeps, want one at a time every 30ms or so", sweeps)
+	}
+	if skipped := registry.Counter("scheduled_sweeps_skipped").Value(); skipped == 0 {
+		t.Errorf("expected ticks to be skipped while a sweep was running")
+	}
+	if overruns := registry.Counter("sweep_overruns").Value(); overruns == 0 {
+		t.Errorf("expected sweeps to overrun the interval")
+	}
+}
+
+func TestShutDownDrainsThePipeline(t *testing.T) {
+	fp := mock.NewFileProvider(200, 10)
+	api := &recordingApi{Api: fp, copies: make(map[model.FileId][]int)}
+	watchList := fp.CreateWatchList(50)
+
+	cache := NewHistoryCache()
+	monitor := NewMonitor(AdaptApi(api), watchList, cache, metrics.NewRegistry(), Options{QueueSize: 1, CopyWorkers: 1})
+	monitor.ShutDown() // never started
+
+	monitor.Start()
+	monitor.Start()
+	monitor.EvaluateWatchlist()
+	report := monitor.ShutDown()
+	if !report.Drained || report.PendingCopies != 0 {
+		t.Errorf("got report %+v, want everything copied", report)
+	}
+	if again := monitor.ShutDown(); !again.Drained {
+		t.Errorf("second shut down got %+v", again)
+	}
+	if err := monitor.EvaluateWatchlist(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("sweep after shut down: got %v, want ErrNotRunning", err)
+	}
+
+	// every file found by the sweep was copied before ShutDown returned
+	api.mu.Lock()
+	for _, fileId := range cache.GetAllCacheKeys() {
+		if len(api.copies[fileId]) != 1 {
+			t.Errorf("%s: got copies %v, want one", fileId, api.copies[fileId])
+		}
+	}
+	api.mu.Unlock()
+
+	// a monitor that has been shut down can be started again
+	monitor.Start()
+	defer monitor.ShutDown()
+	if err := monitor.EvaluateWatchlist(); err != nil {
+		t.Errorf("sweep after restart: got %v", err)
+	}
+}
+
+// childrenRecordingApi records the directories whose children are retrieved
+type childrenRecordingApi struct {
+	Api
+	mu      sync.Mutex
+	scanned map[model.FileId]int
+}
+
+func (c *childrenRecordingApi) GetChildren(fileId model.FileId) ([]model.Metadata, error) {
+	c.mu.Lock()
+	c.scanned[fileId]++
+	c.mu.Unlock()
+	return c.Api.GetChildren(fileId)
+}
+
+func TestWatchOptionsLimitTheTree(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/a.txt", "dir1")
+	fp.AddFile("dir1/b.log", "dir1")
+	fp.AddDirectory("dir1/sub", "dir1")
+	fp.AddFile("dir1/sub/c.txt", "dir1/sub")
+	fp.AddDirectory("dir1/sub/deep", "dir1/sub")
+	fp.AddFile("dir1/sub/deep/d.txt", "dir1/sub/deep")
+	fp.AddDirectory("dir1/skip", "dir1")
+	fp.AddFile("dir1/skip/e.txt", "dir1/skip")
+	fp.AddDirectory("dir2", "")
+	fp.AddFile("dir2/f.txt", "dir2")
+	fp.AddDirectory("dir2/inner", "dir2")
+	fp.AddFile("dir2/inner/g.txt", "dir2/inner")
+	api := &childrenRecordingApi{Api: fp, scanned: make(map[model.FileId]int)}
+	source := &channelChangeSource{changes: make(chan model.FileId), overflows: make(chan struct{})}
+
+	cache := NewHistoryCache()
+	monitor := NewMonitor(AdaptApi(api), nil, cache, metrics.NewRegistry(), DefaultOptions())
+	if err := monitor.Watch(model.WatchEntry{Id: "dir1", WatchOptions: model.WatchOptions{Exclude: []string{"[bad"}}}); !errors.Is(err, ErrInvalidWatchOptions) {
+		t.Errorf("bad pattern: got %v, want ErrInvalidWatchOptions", err)
+	}
+	err := monitor.Watch(
+		model.WatchEntry{Id: "dir1", WatchOptions: model.WatchOptions{MaxDepth: 2, Include: []string{"*.txt"}, Exclude: []string{"skip"}}},
+		model.WatchEntry{Id: "dir2", WatchOptions: model.WatchOptions{NonRecursive: true}},
+	)
+	if err != nil {
+		t.Fatalf("Error watching: %v", err)
+	}
+	monitor.Start()
+	defer monitor.ShutDown()
+	monitor.WatchChanges(source)
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	keys := cache.GetAllCacheKeys()
+	slices.Sort(keys)
+	if want := []model.FileId{"dir1/a.txt", "dir1/sub/c.txt", "dir2/f.txt"}; !slices.Equal(keys, want) {
+		t.Errorf("got files %v, want %v", keys, want)
+	}
+	api.mu.Lock()
+	for _, fileId := range []model.FileId{"dir1/skip", "dir1/sub/deep", "dir2/inner"} {
+		if api.scanned[fileId] != 0 {
+			t.Errorf("%s: children retrieved, want it never scanned", fileId)
+		}
+	}
+	api.mu.Unlock()
+
+	// a change beneath an excluded directory is ignored, while one in the watched tree is picked up
+	fp.UpdateLastModified("dir1/skip/e.txt")
+	fp.UpdateLastModified("dir1/a.txt")
+	source.changes <- "dir1/skip/e.txt"
+	source.changes <- "dir1/a.txt"
+	waitFor(t, "dir1/a.txt version 2", func() bool { _, version := cache.Get("dir1/a.txt"); return version == 2 })
+	drain(t, monitor)
+	if _, version := cache.Get("dir1/skip/e.txt"); version != 0 {
+		t.Errorf("dir1/skip/e.txt: got version %d, want it ignored", version)
+	}
+	if _, version := cache.Get("dir1/a.txt"); version != 2 {
+		t.Errorf("dir1/a.txt: got version %d, want 2", version)
+	}
+}
+
+func TestTouchedFilesAreNotCopied(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("file1", "dir1")
+	fp.AddFile("file2", "dir1")
+	api := &recordingApi{Api: fp, copies: make(map[model.FileId][]int)}
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"dir1"}, cache, registry, DefaultOptions())
+	monitor.Start()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	fp.TouchFile("file1")
+	fp.UpdateLastModified("file2")
+	monitor.EvaluateWatchlist()
+	monitor.ShutDown()
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if copies := api.copies["file1"]; !slices.Equal(copies, []int{1}) {
+		t.Errorf("file1: got copies %v, want only the first", copies)
+	}
+	if copies := api.copies["file2"]; !slices.Equal(copies, []int{1, 2}) {
+		t.Errorf("file2: got copies %v, want both versions", copies)
+	}
+	if touched := registry.Counter("files_touched_unchanged").Value(); touched != 1 {
+		t.Errorf("got %d touched files, want 1", touched)
+	}
+	if metadata, _ := fp.RetrieveMetadata("file1"); cache.ContentHash("file1") != metadata.ContentHash {
+		t.Errorf("file1: got content hash %q, want %q", cache.ContentHash("file1"), metadata.ContentHash)
+	} else if lastModified, _ := cache.Get("file1"); lastModified != metadata.LastModified {
+		t.Errorf("file1: the touch wasn't recorded")
+	}
+}
+
+// propagatingChildrenApi is a childrenRecordingApi over an api that propagates modification times
+type propagatingChildrenApi struct {
+	*childrenRecordingApi
+	ModTimePropagationApi
+}
+
+func TestUnchangedDirectoriesAreSkipped(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/file1", "dir1")
+	fp.AddDirectory("dir1/sub", "dir1")
+	fp.AddFile("dir1/sub/file2", "dir1/sub")
+	fp.AddDirectory("dir2", "")
+	fp.AddFile("dir2/file3", "dir2")
+	recording := &childrenRecordingApi{Api: fp, scanned: make(map[model.FileId]int)}
+	api := &propagatingChildrenApi{childrenRecordingApi: recording, ModTimePropagationApi: fp}
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"dir1", "dir2"}, cache, registry, DefaultOptions())
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	scans := func() int {
+		recording.mu.Lock()
+		defer recording.mu.Unlock()
+		total := 0
+		for _, count := range recording.scanned {
+			total += count
+		}
+		return total
+	}
+
+	monitor.EvaluateWatchlist()
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	if calls := scans(); calls != 3 {
+		t.Errorf("got %d directories scanned, want only the first sweep's 3", calls)
+	}
+	if skipped := registry.Counter("directories_skipped").Value(); skipped != 2 {
+		t.Errorf("got %d directories skipped, want 2", skipped)
+	}
+	// the files beneath skipped directories are still watched
+	if watchType := monitor.WatchType("dir1/sub/file2"); watchType != model.WatchTypeImplicit {
+		t.Errorf("dir1/sub/file2: got watch type %v, want implicit", watchType)
+	}
+
+	// a change deep in dir1 rescans the directories above it, but not dir2
+	fp.UpdateLastModified("dir1/sub/file2")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	if calls := scans(); calls != 5 {
+		t.Errorf("got %d directories scanned, want dir1 and dir1/sub again", calls)
+	}
+	if _, version := cache.Get("dir1/sub/file2"); version != 2 {
+		t.Errorf("dir1/sub/file2: got version %d, want 2", version)
+	}
+
+	// a removal is found even though dir1/sub is skipped
+	fp.RemoveFile("dir1/file1")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	if !cache.IsDeleted("dir1/file1") || cache.IsDeleted("dir1/sub/file2") {
+		t.Errorf("got deleted %v and %v, want only dir1/file1", cache.IsDeleted("dir1/file1"), cache.IsDeleted("dir1/sub/file2"))
+	}
+	if calls := scans(); calls != 6 {
+		t.Errorf("got %d directories scanned, want only dir1 again", calls)
+	}
+}
+
+func TestUnchangedDirectoriesAreSkippedAfterRestart(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/file1", "dir1")
+	fp.AddDirectory("dir1/sub", "dir1")
+	fp.AddFile("dir1/sub/file2", "dir1/sub")
+	// without the mock's change feed, so that each run sweeps the watchlist
+	api := &propagatingChildrenApi{
+		childrenRecordingApi:  &childrenRecordingApi{Api: fp, scanned: make(map[model.FileId]int)},
+		ModTimePropagationApi: fp,
+	}
+	dir := t.TempDir()
+
+	run := func() *metrics.Registry {
+		cache, err := NewFileHistoryCache(dir, 100)
+		if err != nil {
+			t.Fatalf("Error creating cache: %v", err)
+		}
+		defer cache.Close()
+		registry := metrics.NewRegistry()
+		monitor := NewMonitor(AdaptApi(api), []model.FileId{"dir1"}, cache, registry, DefaultOptions())
+		monitor.Start()
+		monitor.EvaluateWatchlist()
+		monitor.ShutDown()
+		return registry
+	}
+
+	if scans := run().Counter("get_children_calls").Value(); scans != 2 {
+		t.Fatalf("got %d directories scanned by the first run, want 2", scans)
+	}
+	registry := run()
+	if scans := registry.Counter("get_children_calls").Value(); scans != 0 {
+		t.Errorf("got %d directories scanned after a restart, want none", scans)
+	}
+	if skipped := registry.Counter("directories_skipped").Value(); skipped != 1 {
+		t.Errorf("got %d directories skipped after a restart, want dir1", skipped)
+	}
+}
+
+func TestChangeFeedReplacesSweeps(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/file1", "dir1")
+	fp.AddDirectory("dir1/sub", "dir1")
+	fp.AddFile("dir1/sub/file2", "dir1/sub")
+	fp.AddDirectory("dir2", "")
+	fp.AddFile("dir2/file3", "dir2")
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, cache, registry, DefaultOptions())
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	// the first evaluation has no cursor, so it sweeps the whole watchlist
+	monitor.EvaluateWatchlist()
+	scans := registry.Counter("get_children_calls").Value()
+	if resyncs := registry.Counter("change_feed_resyncs").Value(); resyncs != 1 || scans == 0 {
+		t.Fatalf("got %d full sweeps scanning %d directories, want one", resyncs, scans)
+	}
+
+	// changes beneath the watched tree are followed without scanning it, and changes outside it are ignored
+	fp.UpdateLastModified("dir1/sub/file2")
+	fp.AddDirectory("dir1/new", "dir1")
+	fp.AddFile("dir1/new/file4", "dir1/new")
+	fp.UpdateLastModified("dir2/file3")
+	monitor.EvaluateWatchlist()
+	if _, version := cache.Get("dir1/sub/file2"); version != 2 {
+		t.Errorf("dir1/sub/file2: got version %d, want 2", version)
+	}
+	if _, version := cache.Get("dir1/new/file4"); version != 1 {
+		t.Errorf("dir1/new/file4: got version %d, want 1", version)
+	}
+	if _, version := cache.Get("dir2/file3"); version != 0 {
+		t.Errorf("dir2/file3: got version %d, want it unwatched", version)
+	}
+	// only the new directory is scanned
+	if calls := registry.Counter("get_children_calls").Value(); calls != scans+1 {
+		t.Errorf("got %d directories scanned, want %d", calls, scans+1)
+	}
+
+	// a file moving out of the tree is a departure, and a file beneath a new directory is watched
+	fp.MoveFile("dir1/file1", "dir2")
+	fp.UpdateLastModified("dir1/new/file4")
+	monitor.EvaluateWatchlist()
+	if watchType := monitor.WatchType("dir1/file1"); watchType != model.WatchTypeUnwatched {
+		t.Errorf("dir1/file1: got watch type %v, want unwatched", watchType)
+	}
+	if moved := registry.Counter("files_moved").Value(); moved != 1 {
+		t.Errorf("got %d moves, want 1", moved)
+	}
+	if _, version := cache.Get("dir1/new/file4"); version != 2 {
+		t.Errorf("dir1/new/file4: got version %d, want 2", version)
+	}
+
+	// removing a directory removes everything beneath it
+	fp.RemoveFile("dir1/sub")
+	monitor.EvaluateWatchlist()
+	if !cache.IsDeleted("dir1/sub/file2") {
+		t.Errorf("dir1/sub/file2: expected a tombstone")
+	}
+
+	// an expired cursor falls back to a full sweep
+	fp.ExpireChanges()
+	monitor.EvaluateWatchlist()
+	if expired := registry.Counter("change_cursor_expired").Value(); expired != 1 {
+		t.Errorf("got %d expired cursors, want 1", expired)
+	}
+	if resyncs := registry.Counter("change_feed_resyncs").Value(); resyncs != 2 {
+		t.Errorf("got %d full sweeps, want 2", resyncs)
+	}
+}
+
+func TestChangeFeedCursorSurvivesRestart(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir1/sub", "dir1")
+	fp.AddFile("dir1/sub/file1", "dir1/sub")
+	fp.AddDirectory("dir2", "")
+	fp.AddFile("dir2/file2", "dir2")
+	dir := t.TempDir()
+
+	cache, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, cache, metrics.NewRegistry(), DefaultOptions())
+	monitor.Start()
+	monitor.EvaluateWatchlist()
+	monitor.ShutDown()
+	cache.Close()
+
+	fp.UpdateLastModified("dir1/sub/file1")
+
+	reopened, err := NewFileHistoryCache(dir, 100)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	defer reopened.Close()
+	registry := metrics.NewRegistry()
+	monitor = NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, reopened, registry, DefaultOptions())
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	// the feed picks up where the last run left off, locating the file beneath dir1
+	monitor.EvaluateWatchlist()
+	if resyncs := registry.Counter("change_feed_resyncs").Value(); resyncs != 0 {
+		t.Errorf("got %d full sweeps, want none", resyncs)
+	}
+	if _, version := reopened.Get("dir1/sub/file1"); version != 2 {
+		t.Errorf("dir1/sub/file1: got version %d, want 2", version)
+	}
+
+	// a change to the watchlist needs a full sweep
+	monitor.AddToWatchlist("dir2")
+	monitor.EvaluateWatchlist()
+	if resyncs := registry.Counter("change_feed_resyncs").Value(); resyncs != 1 {
+		t.Errorf("got %d full sweeps, want 1", resyncs)
+	}
+	if _, version := reopened.Get("dir2/file2"); version != 1 {
+		t.Errorf("dir2/file2: got version %d, want 1", version)
+	}
+}
+
+func TestRestoreToPointInTime(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/file1", "dir1")
+
+	cache := NewHistoryCache()
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, cache, metrics.NewRegistry(), DefaultOptions())
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	fp.UpdateLastModified("dir1/file1")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+
+	versions := monitor.Versions("dir1/file1")
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+		t.Fatalf("got versions %+v, want 1 and 2", versions)
+	}
+	if location := versions[0].Location; location != "mock://copies/dir1/file1/v1" {
+		t.Errorf("got location %q for version 1", location)
+	}
+	first, second := versions[0], versions[1]
+	if version, _ := monitor.VersionAt("dir1/file1", second.LastModified-1); version.Version != 1 {
+		t.Errorf("got version %d just before the second, want 1", version.Version)
+	}
+	if version, _ := monitor.VersionAt("dir1/file1", second.LastModified); version.Version != 2 {
+		t.Errorf("got version %d at the second, want 2", version.Version)
+	}
+	if _, found := monitor.VersionAt("dir1/file1", first.LastModified-1); found {
+		t.Errorf("expected no version before the first")
+	}
+
+	// restoring the first version's content makes a third version with the same content
+	hash := cache.ContentHash("dir1/file1")
+	if restored, err := monitor.Restore(context.Background(), "dir1/file1", second.LastModified-1); err != nil || restored.Version != 1 {
+		t.Fatalf("got version %d (%v) restored, want 1", restored.Version, err)
+	}
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	if _, version := cache.Get("dir1/file1"); version != 3 || cache.ContentHash("dir1/file1") == hash {
+		t.Errorf("got version %d with hash %s, want version 3 with the first version's content", version, cache.ContentHash("dir1/file1"))
+	}
+
+	if _, err := monitor.Restore(context.Background(), "dir1/file1", first.LastModified-1); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("got %v restoring before the first version, want ErrNoVersion", err)
+	}
+
+	// once the file is deleted, there's nothing to restore it to, but it can still go back to before then.
+	// The tombstone is dated by the clock, so the clock has to pass the restored version first.
+	restoredAt, _ := cache.Get("dir1/file1")
+	waitFor(t, "the clock to pass the restored version", func() bool { return time.Now().UnixMilli() > restoredAt })
+	fp.RemoveFile("dir1/file1")
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	versions = monitor.Versions("dir1/file1")
+	if tombstone := versions[len(versions)-1]; !tombstone.Deleted || tombstone.Version != 4 {
+		t.Fatalf("got versions %+v, want a tombstone as version 4", versions)
+	}
+	if _, err := monitor.Restore(context.Background(), "dir1/file1", time.Now().UnixMilli()); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("got %v restoring after the deletion, want ErrNoVersion", err)
+	}
+	if version, found := monitor.VersionAt("dir1/file1", second.LastModified); !found || version.Version != 2 {
+		t.Errorf("got version %d before the deletion, want 2", version.Version)
+	}
+}
+
+func TestPruneByRetentionPolicy(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/file1", "dir1")
+	fp.AddFile("file2", "")
+
+	registry := metrics.NewRegistry()
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"file2"}, NewHistoryCache(), registry, DefaultOptions())
+	monitor.Watch(model.WatchEntry{Id: "dir1", WatchOptions: model.WatchOptions{Retention: &model.RetentionPolicy{KeepLast: 2}}})
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	for range 4 {
+		monitor.EvaluateWatchlist()
+		drain(t, monitor)
+		fp.UpdateLastModified("dir1/file1")
+		fp.UpdateLastModified("file2")
+	}
+
+	// only the file beneath the entry with a policy is pruned
+	if pruned := monitor.Prune(context.Background()); pruned != 2 {
+		t.Errorf("pruned %d versions, want 2", pruned)
+	}
+	versions := monitor.Versions("dir1/file1")
+	if len(versions) != 2 || versions[0].Version != 3 || versions[1].Version != 4 {
+		t.Errorf("got versions %+v, want 3 and 4", versions)
+	}
+	if copied := fp.CopiedVersions("dir1/file1"); !slices.Equal(copied, []int{3, 4}) {
+		t.Errorf("got copies of versions %v, want 3 and 4", copied)
+	}
+	if versions := monitor.Versions("file2"); len(versions) != 4 {
+		t.Errorf("got %d versions of file2, want all 4", len(versions))
+	}
+	if pruned := registry.Counter("versions_pruned").Value(); pruned != 2 {
+		t.Errorf("got %d versions_pruned, want 2", pruned)
+	}
+	if pruned := monitor.Prune(context.Background()); pruned != 0 {
+		t.Errorf("pruned %d versions the second time, want 0", pruned)
+	}
+}
+
+func TestRetainedVersions(t *testing.T) {
+	now := time.Date(2024, time.October, 16, 12, 0, 0, 0, time.UTC) // a Wednesday
+	day := func(year int, month time.Month, day int, hour int) int64 {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC).UnixMilli()
+	}
+	versions := []model.FileVersion{
+		{Version: 1, LastModified: day(2024, time.August, 10, 9)},
+		{Version: 2, LastModified: day(2024, time.August, 20, 9)},
+		{Version: 3, LastModified: day(2024, time.September, 30, 9)},
+		{Version: 4, LastModified: day(2024, time.October, 8, 9)},
+		{Version: 5, LastModified: day(2024, time.October, 14, 9)},
+		{Version: 6, LastModified: day(2024, time.October, 15, 9)},
+		{Version: 7, LastModified: day(2024, time.October, 15, 18)},
+		{Version: 8, LastModified: day(2024, time.October, 16, 9)},
+	}
+
+	tests := []struct {
+		name   string
+		policy model.RetentionPolicy
+		want   []int
+	}{
+		{"empty policy keeps the latest", model.RetentionPolicy{}, []int{8}},
+		{"last 3", model.RetentionPolicy{KeepLast: 3}, []int{6, 7, 8}},
+		// version 5 was current two days ago, at the start of the window
+		{"2 days", model.RetentionPolicy{KeepDays: 2}, []int{5, 6, 7, 8}},
+		{"3 daily", model.RetentionPolicy{Daily: 3}, []int{5, 7, 8}},
+		{"3 weekly", model.RetentionPolicy{Weekly: 3}, []int{3, 4, 8}},
+		{"3 monthly", model.RetentionPolicy{Monthly: 3}, []int{2, 3, 8}},
+		{"combined", model.RetentionPolicy{KeepLast: 2, Monthly: 2}, []int{3, 7, 8}},
+	}
+	for _, test := range tests {
+		kept := retained(test.policy, versions, now)
+		got := slices.Sorted(maps.Keys(kept))
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: kept %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// a tombstone isn't counted as one of the last versions, and is kept along with the version it ends
+	deleted := append(slices.Clone(versions[:4]), model.FileVersion{Version: 5, LastModified: day(2024, time.October, 10, 9), Deleted: true})
+	if got := slices.Sorted(maps.Keys(retained(model.RetentionPolicy{KeepLast: 1}, deleted, now))); !slices.Equal(got, []int{4, 5}) {
+		t.Errorf("last 1 of a deleted file: kept %v, want [4 5]", got)
+	}
+	if got := slices.Sorted(maps.Keys(retained(model.RetentionPolicy{Monthly: 2}, deleted, now))); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("2 monthly of a deleted file: kept %v, want [3 4 5]", got)
+	}
+}
+
+func TestChangesSettleBeforeCopying(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddFile("dir1/file1", "dir1")
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.QuietPeriodMs = 100
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"dir1"}, cache, registry, options)
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	// a file last modified longer ago than the quiet period is copied straight away
+	waitFor(t, "the file to be older than the quiet period", func() bool {
+		metadata, _ := fp.RetrieveMetadata("dir1/file1")
+		return time.Since(time.UnixMilli(metadata.LastModified)) >= 100*time.Millisecond
+	})
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	if _, version := cache.Get("dir1/file1"); version != 1 {
+		t.Fatalf("got version %d, want 1", version)
+	}
+
+	// changes in quick succession are deferred and merged into one version
+	for range 3 {
+		fp.UpdateLastModified("dir1/file1")
+		monitor.EvaluateWatchlist()
+		drain(t, monitor)
+	}
+	if _, version := cache.Get("dir1/file1"); version != 1 {
+		t.Errorf("got version %d while the file was changing, want 1", version)
+	}
+	if deferred, coalesced := registry.Counter("changes_deferred").Value(), registry.Counter("changes_coalesced").Value(); deferred != 1 || coalesced != 2 {
+		t.Errorf("got %d changes deferred and %d coalesced, want 1 and 2", deferred, coalesced)
+	}
+
+	// the file is checked again once it has settled, without another sweep
+	waitFor(t, "version 2 to be copied", func() bool {
+		_, version := cache.Get("dir1/file1")
+		return version == 2 && cache.PendingVersion("dir1/file1") == 0
+	})
+}
+
+func TestMaxSettleDelay(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.QuietPeriodMs = 1000
+	options.MaxSettleDelayMs = 60
+	monitor := NewMonitor(AdaptApi(fp), []model.FileId{"file1"}, cache, registry, options)
+	monitor.Start()
+
+	// a file that never stops changing is copied once its first change is the maximum delay old
+	monitor.EvaluateWatchlist()
+	waitFor(t, "the file to be copied while it's changing", func() bool {
+		fp.UpdateLastModified("file1")
+		_, version := cache.Get("file1")
+		return version == 1
+	})
+	if copies := registry.Counter("max_settle_delay_copies").Value(); copies != 1 {
+		t.Errorf("got %d copies at the maximum delay, want 1", copies)
+	}
+
+	// a change still settling at shut down is reported, and left for the next sweep
+	fp.UpdateLastModified("file1")
+	monitor.EvaluateWatchlist()
+	if report := monitor.ShutDown(); report.UnsettledChanges != 1 {
+		t.Errorf("got %d unsettled changes at shut down, want 1", report.UnsettledChanges)
+	}
+}
+
+func TestCopyQueueOrdersByPriority(t *testing.T) {
+	queue := newCopyQueue(10, time.Hour)
+	queue.push(copyTask{fileId: "a", version: 1})
+	queue.push(copyTask{fileId: "b", version: 1, priority: 10})
+	queue.push(copyTask{fileId: "c", version: 1})
+	queue.push(copyTask{fileId: "a", version: 2, priority: 20})
+
+	// a's second copy makes it due first, but its copies are still made in order, one at a time
+	first, _, _ := queue.pop()
+	second, _, _ := queue.pop()
+	if first.fileId != "a" || first.version != 1 || second.fileId != "b" {
+		t.Errorf("got %s v%d then %s, want a v1 then b while a is being copied", first.fileId, first.version, second.fileId)
+	}
+	queue.done("a")
+	queue.done("b")
+	third, _, _ := queue.pop()
+	queue.done(third.fileId)
+	fourth, _, _ := queue.pop()
+	queue.done(fourth.fileId)
+	if third.fileId != "a" || third.version != 2 || fourth.fileId != "c" {
+		t.Errorf("got %s v%d then %s, want a v2 then c", third.fileId, third.version, fourth.fileId)
+	}
+
+	queue.close()
+	if _, _, ok := queue.pop(); ok || queue.len() != 0 {
+		t.Errorf("expected a closed, empty queue to stop the workers")
+	}
+}
+
+func TestCopyQueueAgesLowPriorityCopies(t *testing.T) {
+	queue := newCopyQueue(10, time.Millisecond)
+	queue.push(copyTask{fileId: "low"})
+	time.Sleep(20 * time.Millisecond)
+	queue.push(copyTask{fileId: "high", priority: 10})
+
+	// the low-priority copy has waited longer than ten levels of priority are worth
+	if task, waited, _ := queue.pop(); task.fileId != "low" || waited < 20*time.Millisecond {
+		t.Errorf("got %s after waiting %v, want the low-priority copy first", task.fileId, waited)
+	}
+}
+
+// gatedCopyApi wraps an Api, recording the order of its copies and holding the first until the gate is opened
+type gatedCopyApi struct {
+	Api
+	gate   chan struct{}
+	mu     sync.Mutex
+	copied []model.FileId
+}
+
+func (g *gatedCopyApi) CopyFile(fileId model.FileId, lastModified int64, version int) error {
+	g.mu.Lock()
+	first := len(g.copied) == 0
+	g.copied = append(g.copied, fileId)
+	g.mu.Unlock()
+	if first {
+		<-g.gate
+	}
+	return nil
+}
+
+func TestExplicitFilesAreCopiedFirst(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddDirectory("dir1", "")
+	fp.AddDirectory("dir2", "")
+	for i := range 10 {
+		fp.AddFile(model.FileId(fmt.Sprintf("dir1/file%d", i)), "dir1")
+	}
+	fp.AddFile("dir2/file1", "dir2")
+	fp.AddFile("file1", "")
+	api := &gatedCopyApi{Api: fp, gate: make(chan struct{})}
+
+	options := DefaultOptions()
+	options.CopyWorkers = 1
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"dir1", "file1"}, NewHistoryCache(), metrics.NewRegistry(), options)
+	monitor.Watch(model.WatchEntry{Id: "dir2", WatchOptions: model.WatchOptions{Priority: 5}})
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	// the first copy holds up the only worker until everything else is queued
+	monitor.EvaluateWatchlist()
+	monitor.flushEvaluations(context.Background())
+	close(api.gate)
+	drain(t, monitor)
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.copied) != 12 {
+		t.Fatalf("got %d copies, want 12", len(api.copied))
+	}
+	// the explicit file comes first, then the file beneath the entry with a priority, unless either was the
+	// copy holding up the worker
+	want := slices.DeleteFunc([]model.FileId{"file1", "dir2/file1"}, func(fileId model.FileId) bool { return fileId == api.copied[0] })
+	if queued := api.copied[1:]; !slices.Equal(queued[:len(want)], want) {
+		t.Errorf("got copies in order %v, want %v ahead of the rest", api.copied, want)
+	}
+}
+
+func TestLimiterCapsRateAndCalls(t *testing.T) {
+	registry := metrics.NewRegistry()
+	ctx := context.Background()
+
+	// a burst of one at 100 calls a second spaces the calls 10ms apart
+	rated := newLimiter("retrieve_metadata", RateLimit{PerSecond: 100, Burst: 1}, registry)
+	start := time.Now()
+	for range 5 {
+		finish, _ := rated.wait(ctx)
+		finish(nil)
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("made 5 calls in %v, want at least 40ms", elapsed)
+	}
+	if waits := registry.Histogram("throttle_wait_seconds", "operation", "retrieve_metadata").Count(); waits != 4 {
+		t.Errorf("got %d throttle waits, want 4", waits)
+	}
+
+	// a second call waits for the first to finish
+	capped := newLimiter("copy_file", RateLimit{MaxInFlight: 1}, registry)
+	finish, _ := capped.wait(ctx)
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := capped.wait(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v waiting for a second call, want the deadline to pass", err)
+	}
+	finish(nil)
+	if finish, err := capped.wait(ctx); err != nil {
+		t.Errorf("got %v once the first call finished", err)
+	} else {
+		finish(nil)
+	}
+
+	// a call left running in the background keeps its slot until it returns
+	finish, _ = capped.wait(ctx)
+	returned := make(chan struct{})
+	finish(&detachedCallError{err: context.DeadlineExceeded, returned: returned})
+	waitCtx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := capped.wait(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v waiting while a detached call was running, want the deadline to pass", err)
+	}
+	close(returned)
+	waitCtx, cancel = context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if finish, err := capped.wait(waitCtx); err != nil {
+		t.Errorf("got %v once the detached call returned", err)
+	} else {
+		finish(nil)
+	}
+}
+
+func TestLimiterAdaptsToThrottling(t *testing.T) {
+	registry := metrics.NewRegistry()
+	l := newLimiter("get_children", RateLimit{PerSecond: 1000}, registry)
+
+	finish, _ := l.wait(context.Background())
+	finish(fmt.Errorf("listing: %w", &model.ThrottledError{RetryAfter: 30 * time.Millisecond}))
+	if rate := l.currentRate(); rate != 500 {
+		t.Errorf("got rate %v after throttling, want 500", rate)
+	}
+
+	// every call waits out the pause the provider asked for, and the rate recovers as calls succeed
+	start := time.Now()
+	finish, _ = l.wait(context.Background())
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("waited %v after throttling, want 30ms", elapsed)
+	}
+	finish(nil)
+	if rate := l.currentRate(); rate != 510 {
+		t.Errorf("got rate %v after a success, want 510", rate)
+	}
+	if throttled := registry.Counter("throttled_calls", "operation", "get_children").Value(); throttled != 1 {
+		t.Errorf("got %d throttled calls, want 1", throttled)
+	}
+}
+
+// throttlingApi wraps an Api, throttling the first copy of each file, or every copy if always is set
+type throttlingApi struct {
+	Api
+	always    bool
+	mu        sync.Mutex
+	throttled map[model.FileId]bool
+}
+
+func (a *throttlingApi) CopyFile(fileId model.FileId, lastModified int64, version int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.always || !a.throttled[fileId] {
+		a.throttled[fileId] = true
+		return &model.ThrottledError{RetryAfter: 20 * time.Millisecond}
+	}
+	return a.Api.CopyFile(fileId, lastModified, version)
+}
+
+func TestThrottledCopiesAreRetried(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	api := &throttlingApi{Api: fp, throttled: make(map[model.FileId]bool)}
+
+	cache := NewHistoryCache()
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.RetryBaseDelayMs = 1
+	// being throttled doesn't use up the only attempt
+	options.CopyAttempts = 1
+	options.CopyLimit = RateLimit{PerSecond: 100}
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1"}, cache, registry, options)
+	monitor.Start()
+	defer monitor.ShutDown()
+
+	monitor.EvaluateWatchlist()
+	drain(t, monitor)
+	if cache.PendingVersion("file1") != 0 || registry.Counter("throttled_calls", "operation", "copy_file").Value() != 1 {
+		t.Errorf("expected the copy to be made after being throttled once")
+	}
+	if waits := registry.Histogram("throttle_wait_seconds", "operation", "copy_file").Count(); waits != 1 {
+		t.Errorf("got %d throttle waits, want the retry to wait out the pause", waits)
+	}
+}
+
+func TestThrottledCopiesRunOutOfAttempts(t *testing.T) {
+	fp := mock.NewFileProvider(0, 0)
+	fp.AddFile("file1", "")
+	api := &throttlingApi{Api: fp, always: true, throttled: make(map[model.FileId]bool)}
+
+	registry := metrics.NewRegistry()
+	options := DefaultOptions()
+	options.ThrottledCopyAttempts = 3
+	monitor := NewMonitor(AdaptApi(api), []model.FileId{"file1"}, NewHistoryCache(), registry, options)
+	monitor.Start()
+	monitor.EvaluateWatchlist()
+	monitor.ShutDown()
+
+	letters := monitor.deadLetters.List()
+	if len(letters) != 1 || letters[0].FileId != "file1" || letters[0].Attempts != 3 {
+		t.Errorf("got dead letters %+v, want file1 after 3 throttled attempts", letters)
+	}
+	if calls := registry.Counter("throttled_calls", "operation", "copy_file").Value(); calls != 3 {
+		t.Errorf("got %d throttled copies, want 3", calls)
 	}
 }
@@ -0,0 +1,76 @@
+package monitor
+
+import (
+	"context"
+	"log"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// A file moves when its parent directory changes between sweeps.  The cache stores the parent of every
+// file along with its last modified time, so when a file's metadata arrives with a different parent the
+// move is recorded as a new version and mirrored through MoveApi.MoveCopy, rather than copying the file
+// again, retrying and dead-lettering the call like a copy.  If the file was also modified, the new version
+// is copied instead, which covers the move.
+//
+// A file that moves out of the watched tree is found by detectRemovals.  Its move is recorded the same
+// way, but it is never copied, and it becomes unwatched until it moves back into the watched tree.
+
+// WatchType returns why the file with the given ID is watched.  Files in the watchlist are explicit, files
+// found beneath a watched directory by the last complete sweep are implicit, and any other file is
+// unwatched.  Before the first complete sweep, every file not in the watchlist is assumed to be implicit.
+func (m *Monitor) WatchType(fileId model.FileId) model.WatchType {
+	if m.inWatchlist(fileId) {
+		return model.WatchTypeExplicit
+	}
+
+	m.watchedMu.RLock()
+	defer m.watchedMu.RUnlock()
+	if _, watched := m.watched[fileId]; m.watched == nil || watched {
+		return model.WatchTypeImplicit
+	}
+	return model.WatchTypeUnwatched
+}
+
+// evaluateDeparture records the move of a file that has left the watched tree
+func (m *Monitor) evaluateDeparture(metadata model.Metadata) {
+	if m.ctx.Err() != nil {
+		return
+	}
+	m.removeSettling(metadata.Id)
+	m.recordMove(metadata)
+}
+
+// recordMove records the file moving to the parent in its metadata, if that isn't the cached parent
+func (m *Monitor) recordMove(metadata model.Metadata) {
+	if version, previousParentId, moved := m.cache.Move(metadata); moved {
+		m.metrics.Counter("files_moved").Inc()
+		m.enqueueCopy(copyTask{fileId: metadata.Id, version: version, kind: moveVersion, fromParentId: previousParentId, toParentId: metadata.ParentId, priority: m.filePriority(metadata.Id)})
+	}
+}
+
+// moveCopy mirrors the move of a file, if the api supports it
+func (m *Monitor) moveCopy(task copyTask) {
+	if m.ctx.Err() != nil || m.mover == nil {
+		return
+	}
+	m.copyWithRetry(m.ctx, task)
+}
+
+// tryMove makes a single attempt at mirroring the move of a file.  Without MoveApi, there's nothing to
+// mirror.
+func (m *Monitor) tryMove(ctx context.Context, task copyTask) error {
+	if m.mover == nil {
+		return nil
+	}
+	ctx, cancel := callContext(ctx, m.options.CopyTimeoutMs)
+	defer cancel()
+	done := m.timeCall("move_copy")
+	err := m.mover.MoveCopy(ctx, task.fileId, task.fromParentId, task.toParentId, task.version)
+	done()
+	m.metrics.Counter("move_copy_calls").Inc()
+	if err != nil {
+		log.Printf("Error moving copy of FileId %s version %d: %v", task.fileId, task.version, err)
+	}
+	return err
+}
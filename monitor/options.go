@@ -0,0 +1,147 @@
+package monitor
+
+import (
+	"context"
+	"time"
+)
+
+// Options configures the monitor's evaluation pipeline.  Any value left at zero is replaced by the
+// corresponding value from DefaultOptions when the monitor is created.
+type Options struct {
+	// DiscoveryWorkers is the number of goroutines resolving watchlist ids into file metadata
+	DiscoveryWorkers int `mapstructure:"discovery_workers"`
+	// EvaluationWorkers is the number of goroutines comparing metadata against the cache
+	EvaluationWorkers int `mapstructure:"evaluation_workers"`
+	// CopyWorkers is the number of goroutines calling Api.CopyFile
+	CopyWorkers int `mapstructure:"copy_workers"`
+	// QueueSize is the buffer size of each channel between the pipeline stages
+	QueueSize int `mapstructure:"queue_size"`
+
+	// MetadataTimeoutMs is the deadline for each Api.RetrieveMetadata call; zero means no deadline
+	MetadataTimeoutMs int64 `mapstructure:"metadata_timeout_ms"`
+	// ChildrenTimeoutMs is the deadline for each Api.GetChildren call; zero means no deadline
+	ChildrenTimeoutMs int64 `mapstructure:"children_timeout_ms"`
+	// CopyTimeoutMs is the deadline for each Api.CopyFile call; zero means no deadline
+	CopyTimeoutMs int64 `mapstructure:"copy_timeout_ms"`
+
+	// IntervalMs is how often the monitor sweeps the watchlist on its own; zero means the monitor only
+	// sweeps when EvaluateWatchlist is called
+	IntervalMs int64 `mapstructure:"interval_ms"`
+	// JitterMs is the most each scheduled sweep is randomly delayed by
+	JitterMs int64 `mapstructure:"jitter_ms"`
+
+	// ShutdownTimeoutMs is how long ShutDown waits for queued work to finish before dropping it
+	ShutdownTimeoutMs int64 `mapstructure:"shutdown_timeout_ms"`
+
+	// BatchSize is the maximum number of ids sent in a single batch call, when the Api supports batching.
+	// A batch size of 1 disables batching.
+	BatchSize int `mapstructure:"batch_size"`
+
+	// CopyAttempts is the number of times a copy is tried before it's sent to the dead-letter store
+	CopyAttempts int `mapstructure:"copy_attempts"`
+	// ThrottledCopyAttempts is the number of times a copy can be throttled by the provider before it's sent
+	// to the dead-letter store.  Throttled tries don't count towards CopyAttempts.
+	ThrottledCopyAttempts int `mapstructure:"throttled_copy_attempts"`
+	// RetryBaseDelayMs is the delay before the first retry of a failed copy, which doubles with each retry
+	RetryBaseDelayMs int64 `mapstructure:"retry_base_delay_ms"`
+	// RetryMaxDelayMs caps the delay between retries
+	RetryMaxDelayMs int64 `mapstructure:"retry_max_delay_ms"`
+
+	// QuietPeriodMs is how long a changed file's LastModified must be stable before it's copied; zero copies
+	// changes straight away
+	QuietPeriodMs int64 `mapstructure:"quiet_period_ms"`
+	// MaxSettleDelayMs caps how long a file that keeps changing waits to settle; zero means there is no cap
+	MaxSettleDelayMs int64 `mapstructure:"max_settle_delay_ms"`
+
+	// MetadataLimit, ChildrenLimit and CopyLimit limit the RetrieveMetadata, GetChildren and CopyFile calls,
+	// batch calls included.  The zero value doesn't limit the calls.
+	MetadataLimit RateLimit `mapstructure:"metadata_limit"`
+	ChildrenLimit RateLimit `mapstructure:"children_limit"`
+	CopyLimit     RateLimit `mapstructure:"copy_limit"`
+
+	// PriorityAgingMs is how long a queued copy waits to gain one level of priority, so that low-priority
+	// copies still get made
+	PriorityAgingMs int64 `mapstructure:"priority_aging_ms"`
+
+	// PruneIntervalMs is how often copied versions are pruned by their watchlist entry's retention policy
+	PruneIntervalMs int64 `mapstructure:"prune_interval_ms"`
+}
+
+// RateLimit limits the calls made to a single Api operation, with a token bucket and a cap on the calls in
+// progress at once
+type RateLimit struct {
+	// PerSecond is the number of calls allowed per second, on average; zero means there is no limit
+	PerSecond float64 `mapstructure:"per_second"`
+	// Burst is the number of calls that can be made at once after a quiet spell; zero means a second's worth
+	Burst int `mapstructure:"burst"`
+	// MaxInFlight caps the calls in progress at once; zero means there is no cap
+	MaxInFlight int `mapstructure:"max_in_flight"`
+}
+
+// DefaultOptions returns the options used when none are configured
+func DefaultOptions() Options {
+	return Options{
+		DiscoveryWorkers:      4,
+		EvaluationWorkers:     4,
+		CopyWorkers:           4,
+		QueueSize:             100,
+		BatchSize:             100,
+		ShutdownTimeoutMs:     30000,
+		CopyAttempts:          5,
+		ThrottledCopyAttempts: 20,
+		RetryBaseDelayMs:      100,
+		RetryMaxDelayMs:       10000,
+		PriorityAgingMs:       1000,
+		PruneIntervalMs:       60000,
+	}
+}
+
+// withDefaults returns a copy of the options with any unset value replaced by its default
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.DiscoveryWorkers <= 0 {
+		o.DiscoveryWorkers = defaults.DiscoveryWorkers
+	}
+	if o.EvaluationWorkers <= 0 {
+		o.EvaluationWorkers = defaults.EvaluationWorkers
+	}
+	if o.CopyWorkers <= 0 {
+		o.CopyWorkers = defaults.CopyWorkers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaults.QueueSize
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaults.BatchSize
+	}
+	if o.ShutdownTimeoutMs <= 0 {
+		o.ShutdownTimeoutMs = defaults.ShutdownTimeoutMs
+	}
+	if o.CopyAttempts <= 0 {
+		o.CopyAttempts = defaults.CopyAttempts
+	}
+	if o.ThrottledCopyAttempts <= 0 {
+		o.ThrottledCopyAttempts = defaults.ThrottledCopyAttempts
+	}
+	if o.RetryBaseDelayMs <= 0 {
+		o.RetryBaseDelayMs = defaults.RetryBaseDelayMs
+	}
+	if o.RetryMaxDelayMs <= 0 {
+		o.RetryMaxDelayMs = defaults.RetryMaxDelayMs
+	}
+	if o.PriorityAgingMs <= 0 {
+		o.PriorityAgingMs = defaults.PriorityAgingMs
+	}
+	if o.PruneIntervalMs <= 0 {
+		o.PruneIntervalMs = defaults.PruneIntervalMs
+	}
+	return o
+}
+
+// callContext derives the context for a single Api call from the parent, applying the timeout if one is set
+func callContext(parent context.Context, timeoutMs int64) (context.Context, context.CancelFunc) {
+	if timeoutMs <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(timeoutMs)*time.Millisecond)
+}
@@ -0,0 +1,345 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/samber/lo"
+)
+
+// The pipeline is made up of three stages, each with its own pool of workers:
+//
+//	[ discovery ] -> [ evaluation ] -> [ copy ]
+//
+// Discovery workers share a single channel, since the order in which ids are resolved doesn't matter.
+// The evaluation stage is partitioned by FileId: every worker owns a channel, and a file is always routed
+// to the same worker.  This keeps the updates for a single file in order, so two versions of the same file
+// are never evaluated out of order.  Copy workers share a priority queue, which hands out each file's
+// copies one at a time and in order (see priority.go).
+
+// discoveryTask is a group of file ids to resolve as part of a sweep
+type discoveryTask struct {
+	fileIds []model.FileId
+	sweep   *sweep
+}
+
+// evaluationKind is the kind of change an evaluation task describes
+type evaluationKind int
+
+const (
+	// evaluateChange is the latest metadata of a file in the watched tree
+	evaluateChange evaluationKind = iota
+	// evaluateDeletion is notice that a file no longer exists
+	evaluateDeletion
+	// evaluateDeparture is the latest metadata of a file that has moved out of the watched tree
+	evaluateDeparture
+	// evaluateBarrier is closed once the worker has evaluated everything queued before it
+	evaluateBarrier
+)
+
+// evaluationTask is a change to a file, to be compared against the cache
+type evaluationTask struct {
+	metadata model.Metadata
+	kind     evaluationKind
+	// priority is the priority of a copy of a changed file, from the scope it was reached with
+	priority int
+	barrier  chan struct{}
+}
+
+// copyKind is the kind of version a copy task mirrors
+type copyKind int
+
+const (
+	// copyVersion is a new version of the file's content
+	copyVersion copyKind = iota
+	// deleteVersion is the tombstone of a deleted file
+	deleteVersion
+	// moveVersion is the file moving to another parent directory
+	moveVersion
+)
+
+// copyTask is a single version of a file to be mirrored by the api
+type copyTask struct {
+	fileId       model.FileId
+	lastModified int64
+	// size is the size of a new version, or zero if it isn't known
+	size         int64
+	version      int
+	kind         copyKind
+	fromParentId model.FileId
+	toParentId   model.FileId
+	// priority orders the copy in the copy queue
+	priority int
+}
+
+// sweepKind is what a sweep covers
+type sweepKind int
+
+const (
+	// fullSweep covers the whole watchlist
+	fullSweep sweepKind = iota
+	// changeSweep covers the ids from a ChangeSource
+	changeSweep
+	// feedSweep covers the ids from the api's change feed
+	feedSweep
+)
+
+// sweep tracks the state of a single EvaluateWatchlist call
+type sweep struct {
+	ctx     context.Context
+	kind    sweepKind
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	// visited holds the scope each file or directory was first reached with during the sweep
+	visited map[model.FileId]watchScope
+	// children and modTimes hold the children and the last modified time of each directory scanned by the
+	// sweep, when the api propagates modification times
+	children map[model.FileId][]model.Metadata
+	modTimes map[model.FileId]int64
+	// located holds the ancestors a feed sweep looked up to place its files in the watched tree, and left
+	// holds the files it found had left the tree
+	located map[model.FileId]location
+	left    map[model.FileId]bool
+	// resync is set when a feed sweep finds a change that only a full sweep can follow
+	resync bool
+	// incomplete is set when a call fails for any reason other than the file not existing, in which case
+	// files that weren't visited may still exist in the watched tree
+	incomplete bool
+	// finished is set once the sweep has returned, after which its context is always done
+	finished bool
+}
+
+func newSweep(ctx context.Context, kind sweepKind) *sweep {
+	return &sweep{
+		ctx:      ctx,
+		kind:     kind,
+		visited:  make(map[model.FileId]watchScope),
+		children: make(map[model.FileId][]model.Metadata),
+		modTimes: make(map[model.FileId]int64),
+		located:  make(map[model.FileId]location),
+		left:     make(map[model.FileId]bool),
+	}
+}
+
+// markIncomplete records that part of the watched tree couldn't be scanned
+func (s *sweep) markIncomplete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incomplete = true
+}
+
+// complete returns whether every file in the watched tree was visited
+func (s *sweep) complete() bool {
+	return s.kind == fullSweep && s.resolved()
+}
+
+// resolved returns whether every id the sweep covered was resolved
+func (s *sweep) resolved() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.incomplete && (s.finished || s.ctx.Err() == nil)
+}
+
+// finish records the outcome of the sweep before its context is cancelled
+func (s *sweep) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incomplete = s.incomplete || s.ctx.Err() != nil
+	s.finished = true
+}
+
+// visit marks the file as visited with the given scope, returning false if it was already visited during
+// this sweep.  A file visited with an unresolved scope can be visited again once its scope is known.
+func (s *sweep) visit(fileId model.FileId, scope watchScope) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, visited := s.visited[fileId]; visited && (scope.unresolved || !existing.unresolved) {
+		return false
+	}
+	s.visited[fileId] = scope
+	return true
+}
+
+// scope returns the scope the file was visited with, and whether it was visited with a resolved scope
+func (s *sweep) scope(fileId model.FileId) (watchScope, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scope, visited := s.visited[fileId]
+	return scope, visited && !scope.unresolved
+}
+
+// recordChildren records the children of the directory, and its last modified time if it's known
+func (s *sweep) recordChildren(directory model.FileId, children []model.Metadata, lastModified int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.children[directory] = children
+	if lastModified != 0 {
+		s.modTimes[directory] = lastModified
+	}
+}
+
+// partition returns the index of the worker (or cache shard) responsible for the given file.  The FNV-1a
+// hash is computed inline to avoid allocating a hasher on every call.
+func partition(fileId model.FileId, workers int) int {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(fileId); i++ {
+		hash ^= uint32(fileId[i])
+		hash *= prime32
+	}
+	return int(hash % uint32(workers))
+}
+
+// startPipeline creates the channels and queue for each stage and starts the workers.  When the discovery
+// channel is closed, each stage closes the channels or queue of the next stage once its own workers have
+// finished.
+func (m *Monitor) startPipeline() {
+	opts := m.options
+
+	m.discoveryChannel = make(chan discoveryTask, opts.QueueSize)
+	m.evaluationChannels = make([]chan evaluationTask, opts.EvaluationWorkers)
+	for i := range m.evaluationChannels {
+		m.evaluationChannels[i] = make(chan evaluationTask, opts.QueueSize)
+	}
+	m.copyQueue = newCopyQueue(opts.QueueSize*opts.CopyWorkers, time.Duration(opts.PriorityAgingMs)*time.Millisecond)
+
+	discoveryChannel := m.discoveryChannel
+	evaluationChannels := m.evaluationChannels
+	copyQueue := m.copyQueue
+
+	var discoveryWorkers, evaluationWorkers, copyWorkers sync.WaitGroup
+
+	for i := 0; i < opts.DiscoveryWorkers; i++ {
+		discoveryWorkers.Add(1)
+		go func() {
+			defer discoveryWorkers.Done()
+			for task := range discoveryChannel {
+				m.discover(task)
+			}
+		}()
+	}
+
+	for _, ch := range evaluationChannels {
+		evaluationWorkers.Add(1)
+		go func() {
+			defer evaluationWorkers.Done()
+			for task := range ch {
+				switch task.kind {
+				case evaluateChange:
+					m.evaluateMetadata(task.metadata, task.priority)
+				case evaluateDeletion:
+					m.evaluateDeletion(task.metadata.Id)
+				case evaluateDeparture:
+					m.evaluateDeparture(task.metadata)
+				case evaluateBarrier:
+					close(task.barrier)
+				}
+			}
+		}()
+	}
+
+	for range opts.CopyWorkers {
+		copyWorkers.Add(1)
+		go func() {
+			defer copyWorkers.Done()
+			for {
+				task, waited, ok := copyQueue.pop()
+				if !ok {
+					return
+				}
+				m.metrics.Histogram("copy_queue_wait_seconds").Observe(waited.Seconds())
+				switch task.kind {
+				case copyVersion:
+					m.copyFile(task)
+				case deleteVersion:
+					m.deleteCopy(task)
+				case moveVersion:
+					m.moveCopy(task)
+				}
+				copyQueue.done(task.fileId)
+			}
+		}()
+	}
+
+	pipelineDone := make(chan struct{})
+	m.pipelineDone = pipelineDone
+	go func() {
+		discoveryWorkers.Wait()
+		for _, ch := range evaluationChannels {
+			close(ch)
+		}
+		evaluationWorkers.Wait()
+		copyQueue.close()
+		copyWorkers.Wait()
+		close(pipelineDone)
+	}()
+}
+
+// enqueueDiscovery queues the targets for discovery as part of the sweep.  Ids that have already been
+// visited during the sweep are ignored, and the rest are grouped into tasks of up to discoveryBatchSize
+// ids, whatever their scope.  When called from a discovery worker, the send must not block, since every
+// worker could end up waiting on a full channel; if the channel is full the task is resolved inline instead.
+func (m *Monitor) enqueueDiscovery(s *sweep, targets []watchTarget, fromWorker bool) {
+	unvisited := lo.FilterMap(targets, func(target watchTarget, _ int) (model.FileId, bool) {
+		return target.fileId, s.visit(target.fileId, target.scope)
+	})
+
+	for _, chunk := range lo.Chunk(unvisited, m.discoveryBatchSize()) {
+		s.pending.Add(1)
+		task := discoveryTask{fileIds: chunk, sweep: s}
+		if !fromWorker {
+			select {
+			case m.discoveryChannel <- task:
+			case <-s.ctx.Done():
+				s.pending.Done()
+			}
+			continue
+		}
+		select {
+		case m.discoveryChannel <- task:
+		default:
+			m.discover(task)
+		}
+	}
+}
+
+// discoveryBatchSize returns the number of ids resolved by each discovery task.  Without a batch metadata
+// call, each id gets its own task so that the ids are spread across the discovery workers.
+func (m *Monitor) discoveryBatchSize() int {
+	if m.batchMetadata == nil {
+		return 1
+	}
+	return m.options.BatchSize
+}
+
+// enqueueEvaluation routes the metadata to the evaluation worker that owns the file, along with the
+// priority of copying it
+func (m *Monitor) enqueueEvaluation(metadata model.Metadata, priority int) {
+	m.enqueueEvaluationTask(evaluationTask{metadata: metadata, kind: evaluateChange, priority: priority})
+}
+
+// enqueueDeletion routes notice of the file's deletion to the evaluation worker that owns the file, so that
+// it's ordered with any other changes to the file
+func (m *Monitor) enqueueDeletion(fileId model.FileId) {
+	m.enqueueEvaluationTask(evaluationTask{metadata: model.Metadata{Id: fileId}, kind: evaluateDeletion})
+}
+
+// enqueueDeparture routes the metadata of a file that has left the watched tree to the evaluation worker
+// that owns the file
+func (m *Monitor) enqueueDeparture(metadata model.Metadata) {
+	m.enqueueEvaluationTask(evaluationTask{metadata: metadata, kind: evaluateDeparture})
+}
+
+func (m *Monitor) enqueueEvaluationTask(task evaluationTask) {
+	m.evaluationChannels[partition(task.metadata.Id, len(m.evaluationChannels))] <- task
+}
+
+// enqueueCopy queues the copy for the copy workers
+func (m *Monitor) enqueueCopy(task copyTask) {
+	m.copyQueue.push(task)
+}
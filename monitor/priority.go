@@ -0,0 +1,205 @@
+package monitor
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// Copies wait in a priority queue shared by the copy workers, so that a file the user listed doesn't wait
+// behind a large directory crawl.  A copy's priority is its watchlist entry's Priority, plus
+// explicitPriority if the file itself is in the watchlist.  Every PriorityAgingMs a copy spends in the queue
+// is worth one level of priority, which keeps low-priority copies from starving: a copy is always made
+// before any copy queued more than PriorityAgingMs times the difference in their priorities after it.
+// Since every copy ages at the same rate, the queue orders copies by their due time, which is when they
+// were queued less their priority's worth of aging.
+//
+// The versions of a file are still copied one at a time and in order.  A file's copies wait behind the
+// first of them, which is due as soon as any of them is, and the file is only handed to a worker while no
+// other worker is copying it.
+
+// explicitPriority is the priority a file gains from being in the watchlist itself
+const explicitPriority = 10
+
+// maxEntryPriority bounds the priority of a watchlist entry, and so how long a copy can be held back
+const maxEntryPriority = 100
+
+// copyPriority returns the priority of a copy of a file reached with the given scope
+func (m *Monitor) copyPriority(fileId model.FileId, scope watchScope) int {
+	if options, ok := m.watchOptions(fileId); ok {
+		return explicitPriority + options.Priority
+	}
+	return scope.options.Priority
+}
+
+// filePriority returns the priority of a copy of a file that wasn't reached by a sweep, from the scope it
+// had in the last complete sweep
+func (m *Monitor) filePriority(fileId model.FileId) int {
+	m.watchedMu.RLock()
+	scope := m.watched[fileId]
+	m.watchedMu.RUnlock()
+	return m.copyPriority(fileId, scope)
+}
+
+// copyQueue is the queue of copies waiting for a copy worker.  Pushing blocks while the queue is full.
+type copyQueue struct {
+	mu sync.Mutex
+	// ready is signalled when a file is ready to be copied, and space when a copy leaves the queue
+	ready sync.Cond
+	space sync.Cond
+
+	capacity int
+	aging    time.Duration
+	// length is the number of copies waiting, not counting those being made
+	length int
+	// files holds every file with copies waiting or being made, and due holds those ready to be copied
+	files  map[model.FileId]*queuedFile
+	due    dueFiles
+	closed bool
+}
+
+// queuedFile is the copies of a file waiting in the queue, in the order they were queued
+type queuedFile struct {
+	fileId model.FileId
+	copies []queuedCopy
+	// copying is set while a worker is copying the file
+	copying bool
+	// dueAt is the earliest due time of the file's copies, and index its position in the due heap
+	dueAt time.Time
+	index int
+}
+
+// queuedCopy is a copy waiting in the queue
+type queuedCopy struct {
+	task     copyTask
+	queuedAt time.Time
+	dueAt    time.Time
+}
+
+func newCopyQueue(capacity int, aging time.Duration) *copyQueue {
+	q := &copyQueue{capacity: capacity, aging: aging, files: make(map[model.FileId]*queuedFile)}
+	q.ready.L = &q.mu
+	q.space.L = &q.mu
+	return q
+}
+
+// push queues a copy, waiting while the queue is full
+func (q *copyQueue) push(task copyTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.length >= q.capacity && !q.closed {
+		q.space.Wait()
+	}
+
+	now := time.Now()
+	queued := queuedCopy{task: task, queuedAt: now, dueAt: now.Add(-time.Duration(task.priority) * q.aging)}
+	q.length++
+	file, ok := q.files[task.fileId]
+	if !ok {
+		file = &queuedFile{fileId: task.fileId, index: -1}
+		q.files[task.fileId] = file
+	}
+	file.copies = append(file.copies, queued)
+	switch {
+	case file.copying:
+	case file.index < 0:
+		file.dueAt = queued.dueAt
+		heap.Push(&q.due, file)
+		q.ready.Signal()
+	case queued.dueAt.Before(file.dueAt):
+		file.dueAt = queued.dueAt
+		heap.Fix(&q.due, file.index)
+	}
+}
+
+// pop waits for the next copy that's due, returning false once the queue is closed and empty.  The file is
+// held until done is called with it, so that its next copy isn't made at the same time.
+func (q *copyQueue) pop() (copyTask, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.due) == 0 {
+		if q.closed && q.length == 0 {
+			return copyTask{}, 0, false
+		}
+		q.ready.Wait()
+	}
+
+	file := heap.Pop(&q.due).(*queuedFile)
+	queued := file.copies[0]
+	file.copies = file.copies[1:]
+	file.copying = true
+	q.length--
+	q.space.Signal()
+	if q.closed && q.length == 0 {
+		// Wake the workers still waiting, so they can stop
+		q.ready.Broadcast()
+	}
+	return queued.task, time.Since(queued.queuedAt), true
+}
+
+// done releases a file taken by pop, making its next copy ready if it has one
+func (q *copyQueue) done(fileId model.FileId) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	file := q.files[fileId]
+	file.copying = false
+	if len(file.copies) == 0 {
+		delete(q.files, fileId)
+		return
+	}
+	file.dueAt = file.copies[0].dueAt
+	for _, queued := range file.copies[1:] {
+		if queued.dueAt.Before(file.dueAt) {
+			file.dueAt = queued.dueAt
+		}
+	}
+	heap.Push(&q.due, file)
+	q.ready.Signal()
+}
+
+// close stops the queue from taking more copies.  The workers stop once the copies already queued have
+// been made.
+func (q *copyQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+	q.space.Broadcast()
+}
+
+// len returns the number of copies waiting in the queue
+func (q *copyQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length
+}
+
+// dueFiles is a heap of the files ready to be copied, ordered by when they're due
+type dueFiles []*queuedFile
+
+func (d dueFiles) Len() int { return len(d) }
+
+func (d dueFiles) Less(i, j int) bool { return d[i].dueAt.Before(d[j].dueAt) }
+
+func (d dueFiles) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+	d[i].index = i
+	d[j].index = j
+}
+
+func (d *dueFiles) Push(x any) {
+	file := x.(*queuedFile)
+	file.index = len(*d)
+	*d = append(*d, file)
+}
+
+func (d *dueFiles) Pop() any {
+	old := *d
+	file := old[len(old)-1]
+	old[len(old)-1] = nil
+	file.index = -1
+	*d = old[:len(old)-1]
+	return file
+}
@@ -0,0 +1,185 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/metrics"
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// RetrieveMetadata, GetChildren and CopyFile, along with their batch versions, each go through a limiter of
+// their own, configured by the matching RateLimit in the options.  A call waits for a slot among the
+// MaxInFlight calls allowed in progress, then for a token from a bucket that refills at PerSecond and holds
+// up to Burst tokens.  Any time spent waiting is recorded in throttle_wait_seconds, labelled by operation.
+// A call that AdaptApi left running in the background after its context was done keeps its slot until it
+// returns, so a slow provider never has more than MaxInFlight calls running.
+//
+// The limiters adapt to the provider pushing back.  A call that returns model.ErrThrottled pauses every call
+// to the operation for as long as the provider asked, or throttlePause if it didn't say, and halves the
+// operation's rate, down to a sixteenth of PerSecond.  Every call that succeeds afterwards wins back a
+// hundredth of PerSecond, until the configured rate is reached again.  Without a PerSecond, a throttled call
+// only pauses the operation.
+
+const (
+	// throttlePause is how long an operation is paused for when the provider doesn't say
+	throttlePause = time.Second
+	// minRateFraction is the lowest fraction of PerSecond that throttling slows an operation to
+	minRateFraction = 1.0 / 16
+	// recoverySteps is the number of successful calls it takes to win back PerSecond after throttling
+	recoverySteps = 100
+)
+
+// limiter limits the calls made to a single Api operation
+type limiter struct {
+	operation string
+	metrics   *metrics.Registry
+	limit     RateLimit
+	// slots holds an entry for each call in progress, or is nil if there's no cap
+	slots chan struct{}
+
+	mu sync.Mutex
+	// rate is the number of calls allowed per second, lowered by throttling, and burst caps the tokens
+	rate   float64
+	burst  float64
+	tokens float64
+	// refilledAt is when the tokens were last topped up, and pausedUntil is when a throttled operation resumes
+	refilledAt  time.Time
+	pausedUntil time.Time
+}
+
+func newLimiter(operation string, limit RateLimit, registry *metrics.Registry) *limiter {
+	l := &limiter{
+		operation:  operation,
+		metrics:    registry,
+		limit:      limit,
+		rate:       limit.PerSecond,
+		burst:      float64(limit.Burst),
+		refilledAt: time.Now(),
+	}
+	if l.burst <= 0 {
+		l.burst = max(1, math.Ceil(limit.PerSecond))
+	}
+	l.tokens = l.burst
+	if limit.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return l
+}
+
+// wait waits until a call to the operation can be made, returning a function to call with the call's error
+// once it has returned.  It returns the context's error if the context is done first.
+func (l *limiter) wait(ctx context.Context) (func(error), error) {
+	start := time.Now()
+	waited := false
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			waited = true
+			select {
+			case l.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	for delay := l.take(); delay > 0; delay = l.take() {
+		waited = true
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			l.release()
+			return nil, ctx.Err()
+		}
+	}
+	if waited {
+		l.metrics.Histogram("throttle_wait_seconds", "operation", l.operation).Observe(time.Since(start).Seconds())
+	}
+	return l.finish, nil
+}
+
+// take takes a token from the bucket, returning zero, or returns how long to wait before trying again
+func (l *limiter) take() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.rate <= 0 {
+		return 0
+	}
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.refilledAt).Seconds()*l.rate)
+	l.refilledAt = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// finish frees the call's slot once the call has returned, and adapts the rate to whether the provider
+// throttled the call
+func (l *limiter) finish(err error) {
+	afterReturn(err, l.release)
+	var throttled *model.ThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		l.throttle(throttled.RetryAfter)
+	case errors.Is(err, model.ErrThrottled):
+		l.throttle(0)
+	case err == nil:
+		l.regain()
+	}
+}
+
+// release frees the call's slot, if there's a cap
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// throttle pauses the operation for the given time, or throttlePause if it's zero, and halves its rate
+// unless the operation was already paused
+func (l *limiter) throttle(retryAfter time.Duration) {
+	l.metrics.Counter("throttled_calls", "operation", l.operation).Inc()
+	if retryAfter <= 0 {
+		retryAfter = throttlePause
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.After(l.pausedUntil) && l.limit.PerSecond > 0 {
+		l.rate = max(l.rate/2, l.limit.PerSecond*minRateFraction)
+	}
+	if resume := now.Add(retryAfter); resume.After(l.pausedUntil) {
+		l.pausedUntil = resume
+	}
+	l.tokens = 0
+	l.refilledAt = l.pausedUntil
+}
+
+// regain wins back some of the rate lost to throttling
+func (l *limiter) regain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate < l.limit.PerSecond {
+		l.rate = min(l.limit.PerSecond, l.rate+l.limit.PerSecond/recoverySteps)
+	}
+}
+
+// currentRate returns the number of calls currently allowed per second
+func (l *limiter) currentRate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
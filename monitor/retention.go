@@ -0,0 +1,163 @@
+package monitor
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// Each entry in the watchlist can limit the copied versions kept of the files beneath it with a
+// model.RetentionPolicy.  While the monitor runs, a pruner goes through the version catalog every
+// PruneIntervalMs and removes the versions that no file's policy keeps, first from the copy destination
+// through PruneApi, when the api has it, and then from the catalog.  A copy that can't be removed stays in
+// the catalog, so it's tried again next time.
+//
+// A file's policy comes from the entry it was reached from in the last complete sweep, so nothing is pruned
+// before the first one, and the versions of a file that's no longer watched are kept.  Tombstones have no
+// copy, so they don't count towards KeepLast, and a tombstone is kept exactly when the version before it
+// is, so that a restore never reaches past a deletion.
+
+// startPruner starts pruning versions every PruneIntervalMs until the monitor is shut down
+func (m *Monitor) startPruner() {
+	stopped := m.intakeCtx
+	m.scheduler.wg.Add(1)
+	go func() {
+		defer m.scheduler.wg.Done()
+
+		ticker := time.NewTicker(time.Duration(m.options.PruneIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stopped.Done():
+				return
+			}
+			m.Prune(stopped)
+		}
+	}()
+}
+
+// Prune removes every copied version that its file's retention policy no longer keeps, returning the
+// number of versions removed.  It stops early if the context is done.
+func (m *Monitor) Prune(ctx context.Context) int {
+	m.metrics.Counter("prune_runs").Inc()
+	now := time.Now()
+	pruned := 0
+	for _, fileId := range m.versions.FileIds() {
+		policy := m.retentionPolicy(fileId)
+		if policy == nil {
+			continue
+		}
+		versions := m.versions.Versions(fileId)
+		kept := retained(*policy, versions, now)
+		for _, version := range versions {
+			if ctx.Err() != nil {
+				return pruned
+			}
+			if !kept[version.Version] && m.pruneVersion(ctx, version) {
+				pruned++
+			}
+		}
+	}
+	return pruned
+}
+
+// retentionPolicy returns the retention policy of the entry the file was reached from, or nil if every
+// version of the file is kept
+func (m *Monitor) retentionPolicy(fileId model.FileId) *model.RetentionPolicy {
+	if options, ok := m.watchOptions(fileId); ok {
+		return options.Retention
+	}
+	m.watchedMu.RLock()
+	defer m.watchedMu.RUnlock()
+	if scope, ok := m.watched[fileId]; ok {
+		return scope.options.Retention
+	}
+	return nil
+}
+
+// pruneVersion removes the copy of the version, if the api can, and then removes it from the catalog
+func (m *Monitor) pruneVersion(ctx context.Context, version model.FileVersion) bool {
+	if m.pruner != nil && !version.Deleted {
+		ctx, cancel := callContext(ctx, m.options.CopyTimeoutMs)
+		defer cancel()
+		done := m.timeCall("prune_copy")
+		err := m.pruner.PruneCopy(ctx, version)
+		done()
+		m.metrics.Counter("prune_copy_calls").Inc()
+		if err != nil {
+			log.Printf("Error pruning copy of FileId %s version %d: %v", version.FileId, version.Version, err)
+			return false
+		}
+	}
+	if err := m.versions.Remove(version.FileId, version.Version); err != nil {
+		log.Printf("Error removing FileId %s version %d from the catalog: %v", version.FileId, version.Version, err)
+		return false
+	}
+	m.metrics.Counter("versions_pruned").Inc()
+	return true
+}
+
+// retained returns the versions the policy keeps, out of the versions of a file sorted oldest first
+func retained(policy model.RetentionPolicy, versions []model.FileVersion, now time.Time) map[int]bool {
+	kept := make(map[int]bool)
+	if len(versions) == 0 {
+		return kept
+	}
+	// keepCurrentAt keeps the version that was current just before the given time
+	keepCurrentAt := func(before time.Time) {
+		at := before.UnixMilli() - 1
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i].LastModified <= at {
+				kept[versions[i].Version] = true
+				return
+			}
+		}
+	}
+
+	copies := slices.DeleteFunc(slices.Clone(versions), func(version model.FileVersion) bool { return version.Deleted })
+	for _, version := range copies[max(0, len(copies)-max(1, policy.KeepLast)):] {
+		kept[version.Version] = true
+	}
+
+	if policy.KeepDays > 0 {
+		cutoff := now.AddDate(0, 0, -policy.KeepDays)
+		keepCurrentAt(cutoff.Add(time.Millisecond))
+		for _, version := range versions {
+			if version.LastModified > cutoff.UnixMilli() {
+				kept[version.Version] = true
+			}
+		}
+	}
+
+	// The current day, week and month end in the future, so they keep the latest version
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for i := range policy.Daily {
+		keepCurrentAt(today.AddDate(0, 0, 1-i))
+	}
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	for i := range policy.Weekly {
+		keepCurrentAt(monday.AddDate(0, 0, 7*(1-i)))
+	}
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := range policy.Monthly {
+		keepCurrentAt(month.AddDate(0, 1-i, 0))
+	}
+
+	// A tombstone ends the version before it, so it's kept exactly when that version is
+	for i, version := range versions {
+		if !version.Deleted {
+			continue
+		}
+		if i > 0 && kept[versions[i-1].Version] {
+			kept[version.Version] = true
+		} else {
+			delete(kept, version.Version)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,214 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/samber/lo"
+)
+
+// copyWithRetry mirrors a single version of a file, copying it or mirroring its deletion or move, retrying failures
+// with jittered exponential backoff.  A successful copy clears the version's pending state in the cache.
+// A version that still fails after CopyAttempts, or a copy that is still throttled after
+// ThrottledCopyAttempts, is sent to the dead-letter store, and a copy's version stays pending.  A copy the
+// provider throttled is retried once the copy limiter lets it, without using up one of CopyAttempts.
+// Retries stop early if the file no longer exists or the version is superseded, since the newer version
+// will be mirrored instead.  It returns whether the version was mirrored.
+func (m *Monitor) copyWithRetry(ctx context.Context, task copyTask) bool {
+	var err error
+	attempts, throttles := 0, 0
+	for {
+		if err = m.tryMirror(ctx, task); err == nil {
+			if task.kind == copyVersion {
+				m.cache.MarkCopied(task.fileId, task.version)
+				m.recordVersion(task)
+			}
+			if _, _, err := m.deadLetters.Remove(task.fileId); err != nil {
+				log.Printf("Error removing dead letter for FileId %s: %v", task.fileId, err)
+			}
+			return true
+		}
+
+		if ctx.Err() != nil {
+			// Shutting down.  A copy stays pending in the cache and is resumed on the next Start, but nothing
+			// else records that a deletion or move still needs mirroring, so it's kept as a dead letter to replay.
+			if task.kind != copyVersion {
+				m.addDeadLetter(deadLetter(task, attempts+throttles, err))
+			}
+			return false
+		}
+		if errors.Is(err, model.ErrNotFound) {
+			// Deleted, which the next sweep will record
+			return false
+		}
+		// Only copies go through the copy limiter, which waits out the provider's pause
+		throttled := task.kind == copyVersion && errors.Is(err, model.ErrThrottled)
+		if throttled {
+			throttles++
+		} else {
+			attempts++
+		}
+		if attempts >= m.options.CopyAttempts || throttles >= m.options.ThrottledCopyAttempts {
+			break
+		}
+		if m.superseded(task) {
+			return false
+		}
+
+		m.metrics.Counter("copy_retries").Inc()
+		if throttled {
+			// The copy limiter waits out the pause the provider asked for
+			continue
+		}
+		select {
+		case <-time.After(m.backoff(attempts)):
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	log.Printf("Giving up on FileId %s version %d after %d attempts, %d of them throttled: %v", task.fileId, task.version, attempts+throttles, throttles, err)
+	m.metrics.Counter("copies_dead_lettered").Inc()
+	m.addDeadLetter(deadLetter(task, attempts+throttles, err))
+	return false
+}
+
+// addDeadLetter adds the dead letter to the store, logging any error
+func (m *Monitor) addDeadLetter(letter DeadLetter) {
+	if err := m.deadLetters.Add(letter); err != nil {
+		log.Printf("Error adding dead letter for FileId %s: %v", letter.FileId, err)
+	}
+}
+
+// deadLetter returns the dead letter of a task that ran out of attempts
+func deadLetter(task copyTask, attempts int, err error) DeadLetter {
+	letter := DeadLetter{
+		FileId:       task.fileId,
+		LastModified: task.lastModified,
+		Version:      task.version,
+		Attempts:     attempts,
+		Error:        err.Error(),
+		FailedAt:     time.Now().UnixMilli(),
+	}
+	switch task.kind {
+	case deleteVersion:
+		letter.Kind = DeadLetterDelete
+	case moveVersion:
+		letter.Kind = DeadLetterMove
+		letter.FromParentId = task.fromParentId
+		letter.ToParentId = task.toParentId
+	}
+	return letter
+}
+
+// replayTask returns the task that replays the dead letter
+func replayTask(letter DeadLetter) copyTask {
+	task := copyTask{fileId: letter.FileId, lastModified: letter.LastModified, version: letter.Version, kind: copyVersion}
+	switch letter.Kind {
+	case DeadLetterDelete:
+		task.kind = deleteVersion
+	case DeadLetterMove:
+		task.kind = moveVersion
+		task.fromParentId = letter.FromParentId
+		task.toParentId = letter.ToParentId
+	}
+	return task
+}
+
+// superseded returns whether the version no longer needs mirroring: a copy whose version is no longer
+// pending, or a deletion or move that is no longer the file's latest version
+func (m *Monitor) superseded(task copyTask) bool {
+	if task.kind == copyVersion {
+		return m.cache.PendingVersion(task.fileId) != task.version
+	}
+	_, version := m.cache.Get(task.fileId)
+	return version != task.version
+}
+
+// tryMirror makes a single attempt at mirroring a version of a file
+func (m *Monitor) tryMirror(ctx context.Context, task copyTask) error {
+	switch task.kind {
+	case deleteVersion:
+		return m.tryDelete(ctx, task)
+	case moveVersion:
+		return m.tryMove(ctx, task)
+	}
+	return m.tryCopy(ctx, task)
+}
+
+// tryCopy makes a single attempt at copying a version of a file
+func (m *Monitor) tryCopy(ctx context.Context, task copyTask) error {
+	finish, err := m.copyLimiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := callContext(ctx, m.options.CopyTimeoutMs)
+	defer cancel()
+	done := m.timeCall("copy_file")
+	err = m.api.CopyFile(ctx, task.fileId, task.lastModified, task.version)
+	done()
+	finish(err)
+	m.metrics.Counter("copy_file_calls").Inc()
+	if err != nil {
+		log.Printf("Error copying FileId %s version %d: %v", task.fileId, task.version, err)
+	}
+	return err
+}
+
+// backoff returns how long to wait before the given retry.  The delay doubles with every attempt up to
+// RetryMaxDelayMs, and a random delay up to that is used so that failures don't retry in lockstep.
+func (m *Monitor) backoff(attempt int) time.Duration {
+	delay := m.options.RetryMaxDelayMs
+	if attempt-1 < 32 {
+		delay = min(m.options.RetryBaseDelayMs<<(attempt-1), delay)
+	}
+	return time.Duration(rand.Int64N(delay+1)) * time.Millisecond
+}
+
+// resumePendingCopies queues the copies left pending in the cache, other than those already dead-lettered
+func (m *Monitor) resumePendingCopies() {
+	deadLettered := lo.SliceToMap(m.deadLetters.List(), func(letter DeadLetter) (model.FileId, int) { return letter.FileId, letter.Version })
+	for _, fileId := range m.cache.GetAllCacheKeys() {
+		version := m.cache.PendingVersion(fileId)
+		if version == 0 || deadLettered[fileId] == version {
+			continue
+		}
+		lastModified, _ := m.cache.Get(fileId)
+		m.enqueueCopy(copyTask{fileId: fileId, lastModified: lastModified, version: version, kind: copyVersion, priority: m.filePriority(fileId)})
+	}
+}
+
+// ReplayDeadLetters retries the dead-lettered copies, deletions and moves of the given files, or of every
+// dead-lettered file if none are given.  Each one is removed from the store and retried as it was the first
+// time, going back to the store if it runs out of attempts again.  Dead letters superseded by a newer
+// version or a deletion are dropped.  It returns the number that succeeded.
+func (m *Monitor) ReplayDeadLetters(ctx context.Context, fileIds ...model.FileId) int {
+	if len(fileIds) == 0 {
+		fileIds = lo.Map(m.deadLetters.List(), func(letter DeadLetter, _ int) model.FileId { return letter.FileId })
+	}
+
+	replayed := 0
+	for _, fileId := range fileIds {
+		letter, removed, err := m.deadLetters.Remove(fileId)
+		if err != nil {
+			log.Printf("Error removing dead letter for FileId %s: %v", fileId, err)
+			continue
+		}
+		if !removed {
+			continue
+		}
+		task := replayTask(letter)
+		if m.superseded(task) {
+			log.Printf("Dropping dead letter for FileId %s version %d, which has been superseded", fileId, letter.Version)
+			continue
+		}
+		if m.copyWithRetry(ctx, task) {
+			replayed++
+		}
+	}
+	return replayed
+}
@@ -0,0 +1,95 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When IntervalMs is set, the monitor schedules its own sweeps of the watchlist: one as soon as it starts,
+// then one every IntervalMs, each delayed by up to JitterMs so that monitors started together don't sweep
+// in lockstep.  Only one scheduled sweep runs at a time.  A tick that arrives while the previous sweep is
+// still running is skipped, and a sweep that takes longer than the interval is reported as an overrun.
+
+// scheduler runs the monitor's scheduled sweeps
+type scheduler struct {
+	// running is set while a scheduled sweep is in progress
+	running atomic.Bool
+	// wg tracks the scheduler's goroutine and its sweeps, along with the pruner, so ShutDown can wait for them
+	wg sync.WaitGroup
+}
+
+// startScheduler starts scheduling sweeps until the monitor is shut down, if an interval is configured
+func (m *Monitor) startScheduler() {
+	if m.options.IntervalMs <= 0 {
+		return
+	}
+
+	stopped := m.intakeCtx
+	m.scheduler.wg.Add(1)
+	go func() {
+		defer m.scheduler.wg.Done()
+
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-stopped.Done():
+				return
+			}
+			timer.Reset(m.nextTick())
+			m.tick()
+		}
+	}()
+}
+
+// nextTick returns the delay until the next scheduled sweep
+func (m *Monitor) nextTick() time.Duration {
+	delay := m.options.IntervalMs
+	if m.options.JitterMs > 0 {
+		delay += rand.Int64N(m.options.JitterMs + 1)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// tick starts a sweep of the watchlist, unless the last one is still running
+func (m *Monitor) tick() {
+	if !m.scheduler.running.CompareAndSwap(false, true) {
+		m.metrics.Counter("scheduled_sweeps_skipped").Inc()
+		log.Printf("Skipping scheduled sweep, the previous sweep is still running")
+		return
+	}
+
+	m.scheduler.wg.Add(1)
+	go func() {
+		defer m.scheduler.wg.Done()
+		defer m.scheduler.running.Store(false)
+
+		start := time.Now()
+		m.EvaluateWatchlistContext(m.ctx)
+		elapsed := time.Since(start)
+		m.metrics.Histogram("sweep_duration_seconds").Observe(elapsed.Seconds())
+
+		if interval := time.Duration(m.options.IntervalMs) * time.Millisecond; elapsed > interval {
+			m.metrics.Counter("sweep_overruns").Inc()
+			log.Printf("Sweep took %v, longer than the %v interval", elapsed, interval)
+		}
+	}()
+}
+
+// Run starts the monitor and blocks until the context is done, then shuts the monitor down gracefully.
+// Sweeps are only run if IntervalMs is set, or by calling EvaluateWatchlist from another goroutine.  It
+// returns an error if work was dropped because the pipeline didn't drain in time.
+func (m *Monitor) Run(ctx context.Context) error {
+	m.Start()
+	<-ctx.Done()
+	if report := m.ShutDown(); !report.Drained {
+		return fmt.Errorf("shut down before the pipeline drained, dropping %v", report.Unprocessed)
+	}
+	return nil
+}
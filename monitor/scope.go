@@ -0,0 +1,156 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// Each entry in the watchlist can limit what is watched beneath it with model.WatchOptions.  As a sweep
+// walks down from an entry, every directory and file it reaches carries the entry's options along with
+// its depth beneath the entry, and the options decide which children are followed:
+//
+//   - a child deeper than the entry's MaxDepth is ignored, and a child directory at MaxDepth is never
+//     scanned, since its children would be too deep
+//   - a child matching an Exclude pattern is ignored, so an excluded directory is never scanned
+//   - a child file not matching any Include pattern is ignored, when there are Include patterns
+//
+// Patterns are matched with path.Match against both the whole FileId and its last element.  The entry
+// itself is always watched, whatever its options.  A file reached from two entries keeps the scope it was
+// reached with first.
+//
+// Files ignored by the options aren't visited, so a file that becomes excluded is treated like one that
+// moved out of the watched tree.
+
+// watchScope is how a file or directory was reached from the watchlist
+type watchScope struct {
+	options model.WatchOptions
+	// depth is the number of levels beneath the watchlist entry
+	depth int
+	// unresolved is set for an id that a change sweep hasn't placed in the watched tree yet; its scope is
+	// taken from its parent once its metadata has been retrieved
+	unresolved bool
+}
+
+// watchTarget is an id queued for discovery along with its scope
+type watchTarget struct {
+	fileId model.FileId
+	scope  watchScope
+}
+
+// maxDepth returns the number of levels watched beneath the entry, or zero if there is no limit
+func (s watchScope) maxDepth() int {
+	if s.options.NonRecursive {
+		return 1
+	}
+	return s.options.MaxDepth
+}
+
+// child returns the scope of a child of the directory with this scope
+func (s watchScope) child() watchScope {
+	return watchScope{options: s.options, depth: s.depth + 1}
+}
+
+// follows returns whether the child of the directory with this scope is watched.  A child directory is
+// only followed if its own children could be watched.
+func (s watchScope) follows(child model.Metadata) bool {
+	depth, maxDepth := s.depth+1, s.maxDepth()
+	if maxDepth > 0 && (depth > maxDepth || child.IsDirectory && depth == maxDepth) {
+		return false
+	}
+	if matchesAny(s.options.Exclude, child.Id) {
+		return false
+	}
+	return child.IsDirectory || len(s.options.Include) == 0 || matchesAny(s.options.Include, child.Id)
+}
+
+// matchesAny returns whether the id, or its last element, matches any of the patterns.  The patterns are
+// checked when they're added to the watchlist, so a bad pattern never matches.
+func matchesAny(patterns []string, fileId model.FileId) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, string(fileId)); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(string(fileId))); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrInvalidWatchOptions is returned when adding an entry to the watchlist with a negative MaxDepth, a
+// malformed pattern, a priority out of range, or a negative retention
+var ErrInvalidWatchOptions = errors.New("invalid watch options")
+
+// validateOptions checks the depth, patterns, priority and retention of the options
+func validateOptions(options model.WatchOptions) error {
+	if options.MaxDepth < 0 {
+		return fmt.Errorf("%w: max depth %d is negative", ErrInvalidWatchOptions, options.MaxDepth)
+	}
+	if options.Priority < -maxEntryPriority || options.Priority > maxEntryPriority {
+		return fmt.Errorf("%w: priority %d is out of range", ErrInvalidWatchOptions, options.Priority)
+	}
+	if policy := options.Retention; policy != nil &&
+		min(policy.KeepLast, policy.KeepDays, policy.Daily, policy.Weekly, policy.Monthly) < 0 {
+		return fmt.Errorf("%w: retention %+v is negative", ErrInvalidWatchOptions, *policy)
+	}
+	for _, pattern := range append(slices.Clone(options.Include), options.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: pattern %q: %v", ErrInvalidWatchOptions, pattern, err)
+		}
+	}
+	return nil
+}
+
+// sweepTargets returns the ids to resolve with their scopes.  Ids in the watchlist are the top of their
+// own scope.  Any other id, in a sweep over changed ids, keeps the scope it had in the last complete sweep,
+// or is resolved from its parent if it wasn't watched then.  A feed sweep resolves every other id from its
+// parent, since the change may have moved it.
+func (m *Monitor) sweepTargets(fileIds []model.FileId, kind sweepKind) []watchTarget {
+	m.watchlistMu.RLock()
+	defer m.watchlistMu.RUnlock()
+	m.watchedMu.RLock()
+	defer m.watchedMu.RUnlock()
+
+	targets := make([]watchTarget, len(fileIds))
+	for i, fileId := range fileIds {
+		targets[i].fileId = fileId
+		if options, ok := m.watchlist[fileId]; ok {
+			targets[i].scope = watchScope{options: options}
+		} else if scope, ok := m.watched[fileId]; ok && kind != feedSweep {
+			targets[i].scope = scope
+		} else {
+			targets[i].scope = watchScope{unresolved: true}
+		}
+	}
+	return targets
+}
+
+// resolveScope places a file reached by a change sweep in the watched tree, beneath its parent, which is
+// looked up in the sweep and then in the last complete sweep.  It returns false if the file has already
+// been reached through its parent during the sweep, if the parent's options don't follow the file, or if
+// the parent isn't in the watched tree; such a change is left to the next full sweep.  Before the first
+// complete sweep, every file is placed at the top of its own scope.  A feed sweep has no full sweep to fall
+// back on, so it locates the file in the tree instead.
+func (m *Monitor) resolveScope(s *sweep, metadata model.Metadata) bool {
+	if s.kind == feedSweep {
+		return m.locate(s, metadata)
+	}
+	parent, ok := s.scope(metadata.ParentId)
+	if !ok {
+		m.watchedMu.RLock()
+		if m.watched == nil {
+			m.watchedMu.RUnlock()
+			return s.visit(metadata.Id, watchScope{})
+		}
+		parent, ok = m.watched[metadata.ParentId]
+		m.watchedMu.RUnlock()
+	}
+	if !ok || !parent.follows(metadata) {
+		return false
+	}
+	return s.visit(metadata.Id, parent.child())
+}
@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotRunning is returned by a sweep when the monitor hasn't been started or is shutting down
+var ErrNotRunning = errors.New("monitor is not running")
+
+// ShutdownReport describes how much of the pipeline's work was finished when the monitor shut down
+type ShutdownReport struct {
+	// Drained is true if every queued task was processed before the deadline
+	Drained bool `json:"drained"`
+	// Unprocessed is the number of tasks still queued in each stage when the deadline passed, keyed by stage.
+	// These tasks were dropped.
+	Unprocessed map[string]int `json:"unprocessed,omitempty"`
+	// PendingCopies is the number of versions in the cache still waiting to be copied, including dead
+	// letters.  With a persistent cache, they're copied the next time the monitor starts.
+	PendingCopies int `json:"pendingCopies"`
+	// UnsettledChanges is the number of changed files still waiting to settle, which weren't copied.  The
+	// next full sweep finds them again.
+	UnsettledChanges int `json:"unsettledChanges,omitempty"`
+}
+
+// ShutDown shuts the monitor down gracefully, waiting up to ShutdownTimeoutMs for queued work to finish.
+// See ShutDownContext.
+func (m *Monitor) ShutDown() ShutdownReport {
+	ctx, cancel := callContext(context.Background(), m.options.ShutdownTimeoutMs)
+	defer cancel()
+	return m.ShutDownContext(ctx)
+}
+
+// ShutDownContext shuts the monitor down gracefully.  Scheduled sweeps and change notifications stop, and
+// new sweeps are refused with ErrNotRunning.  Sweeps already in progress finish, and the pipeline works
+// through everything queued in it.  If the context is done first, in-flight Api calls are cancelled and
+// the work still queued is dropped.  Either way, every worker has stopped by the time it returns, so the
+// cache can be read safely.  Calling ShutDownContext on a monitor that isn't running does nothing.
+func (m *Monitor) ShutDownContext(ctx context.Context) ShutdownReport {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	if !m.running.Load() {
+		return ShutdownReport{Drained: true}
+	}
+	m.running.Store(false)
+	m.stopIntake()
+
+	// Once the sweeps in progress have finished, closing the discovery channel drains each stage in turn
+	go func() {
+		m.scheduler.wg.Wait()
+		m.intake.Lock()
+		defer m.intake.Unlock()
+		close(m.discoveryChannel)
+		m.queuesMu.Lock()
+		m.discoveryChannel = nil
+		m.queuesMu.Unlock()
+	}()
+
+	report := ShutdownReport{Drained: true}
+	select {
+	case <-m.pipelineDone:
+	case <-ctx.Done():
+		report.Drained = false
+		report.Unprocessed = map[string]int{}
+		for _, stage := range stages {
+			report.Unprocessed[stage] = m.queueDepth(stage)
+		}
+		m.cancel()
+		<-m.pipelineDone
+	}
+	m.cancel()
+	report.UnsettledChanges = m.stopSettling()
+	// Work that was dropped could otherwise be hidden beneath unchanged directories
+	if !report.Drained || report.UnsettledChanges > 0 {
+		m.forgetTree()
+	}
+
+	for _, fileId := range m.cache.GetAllCacheKeys() {
+		if m.cache.PendingVersion(fileId) > 0 {
+			report.PendingCopies++
+		}
+	}
+	return report
+}
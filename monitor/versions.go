@@ -0,0 +1,335 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jsfinn/enfi-assessment/model"
+)
+
+// Every version that is copied is recorded in the version catalog, with when it was modified and copied,
+// its size, and where the api put the copy if it says (see CopyLocationApi).  A tombstone is recorded too,
+// as of when the deletion was found, so that the file has no version while it's deleted.  Moves aren't
+// copies, so they aren't recorded.  The version that was current at a given time is the latest version
+// modified at or before then, unless that's a tombstone, and a file can be restored to it through
+// RestoreApi.
+
+// ErrNoVersion is returned when restoring a file that had no copied version at the given time
+var ErrNoVersion = errors.New("no version copied")
+
+// ErrRestoreUnsupported is returned when restoring a file through an api without RestoreApi
+var ErrRestoreUnsupported = errors.New("the api can't restore copies")
+
+// VersionCatalog records every copied version of every file.  Implementations must be safe for concurrent use.
+type VersionCatalog interface {
+	// Add records a copied version, replacing the record of the same version if it was copied before
+	Add(version model.FileVersion) error
+	// Versions returns the copied versions of the file with the given ID, oldest first
+	Versions(fileId model.FileId) []model.FileVersion
+	// Remove forgets a version that has been pruned
+	Remove(fileId model.FileId, version int) error
+	// FileIds returns the IDs of every file with a copied version
+	FileIds() []model.FileId
+}
+
+// SetVersionCatalog replaces the in-memory catalog that copied versions are recorded in.  It must be called
+// before Start.
+func (m *Monitor) SetVersionCatalog(catalog VersionCatalog) {
+	m.versions = catalog
+}
+
+// Versions returns the copied versions of the file with the given ID, oldest first
+func (m *Monitor) Versions(fileId model.FileId) []model.FileVersion {
+	return m.versions.Versions(fileId)
+}
+
+// VersionAt returns the version of the file that was current at the given time, in milliseconds since the
+// epoch: the latest copied version that was last modified at or before then.  There's none if the file had
+// been deleted by then.
+func (m *Monitor) VersionAt(fileId model.FileId, at int64) (model.FileVersion, bool) {
+	versions := m.versions.Versions(fileId)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].LastModified <= at {
+			return versions[i], !versions[i].Deleted
+		}
+	}
+	return model.FileVersion{}, false
+}
+
+// Restore restores the file with the given ID to the version that was current at the given time, returning
+// the version restored.  The restored content is picked up by the next sweep as a new version.
+func (m *Monitor) Restore(ctx context.Context, fileId model.FileId, at int64) (model.FileVersion, error) {
+	version, ok := m.VersionAt(fileId, at)
+	if !ok {
+		return version, fmt.Errorf("%w of %s at %d", ErrNoVersion, fileId, at)
+	}
+	if m.restorer == nil {
+		return version, ErrRestoreUnsupported
+	}
+
+	ctx, cancel := callContext(ctx, m.options.CopyTimeoutMs)
+	defer cancel()
+	done := m.timeCall("restore_copy")
+	err := m.restorer.RestoreCopy(ctx, version)
+	done()
+	m.metrics.Counter("restore_copy_calls").Inc()
+	if err != nil {
+		log.Printf("Error restoring FileId %s to version %d: %v", fileId, version.Version, err)
+		return version, err
+	}
+	m.metrics.Counter("files_restored").Inc()
+	return version, nil
+}
+
+// recordDeletion adds the tombstone of a file that has just been found to be deleted to the catalog
+func (m *Monitor) recordDeletion(fileId model.FileId, version int) {
+	now := time.Now().UnixMilli()
+	tombstone := model.FileVersion{FileId: fileId, Version: version, LastModified: now, CopiedAt: now, Deleted: true}
+	if err := m.versions.Add(tombstone); err != nil {
+		log.Printf("Error recording deletion of FileId %s as version %d: %v", fileId, version, err)
+	}
+}
+
+// recordVersion adds a version that has just been copied to the catalog
+func (m *Monitor) recordVersion(task copyTask) {
+	version := model.FileVersion{
+		FileId:       task.fileId,
+		Version:      task.version,
+		LastModified: task.lastModified,
+		CopiedAt:     time.Now().UnixMilli(),
+		Size:         task.size,
+	}
+	if m.locator != nil {
+		version.Location = m.locator.CopyLocation(task.fileId, task.version)
+	}
+	if err := m.versions.Add(version); err != nil {
+		log.Printf("Error recording FileId %s version %d: %v", task.fileId, task.version, err)
+	}
+}
+
+////////////////////////
+// IMPLEMENTATION     //
+////////////////////////
+
+// NewVersionCatalog creates a version catalog held in memory
+func NewVersionCatalog() *inMemoryVersionCatalog {
+	return &inMemoryVersionCatalog{versions: make(map[model.FileId][]model.FileVersion)}
+}
+
+type inMemoryVersionCatalog struct {
+	mu sync.RWMutex
+	// versions holds the versions of each file, sorted by version
+	versions map[model.FileId][]model.FileVersion
+}
+
+func (c *inMemoryVersionCatalog) Add(version model.FileVersion) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := c.versions[version.FileId]
+	i, found := slices.BinarySearchFunc(versions, version.Version, func(v model.FileVersion, target int) int { return v.Version - target })
+	if found {
+		versions[i] = version
+	} else {
+		c.versions[version.FileId] = slices.Insert(versions, i, version)
+	}
+	return nil
+}
+
+func (c *inMemoryVersionCatalog) Versions(fileId model.FileId) []model.FileVersion {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.versions[fileId])
+}
+
+func (c *inMemoryVersionCatalog) Remove(fileId model.FileId, version int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := slices.DeleteFunc(c.versions[fileId], func(v model.FileVersion) bool { return v.Version == version })
+	if len(versions) == 0 {
+		delete(c.versions, fileId)
+	} else {
+		c.versions[fileId] = versions
+	}
+	return nil
+}
+
+func (c *inMemoryVersionCatalog) FileIds() []model.FileId {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Collect(maps.Keys(c.versions))
+}
+
+// NewFileVersionCatalog creates a version catalog persisted to the given file, loading any versions already
+// in it.  Each version is appended to the file as a line of JSON, without an fsync, so a record survives the
+// process crashing but not the machine losing power.  A record that was only partially written when the
+// process crashed is discarded on load.  Pruning a version appends a record that removes it, and the file is
+// compacted on load when it holds any.
+func NewFileVersionCatalog(path string) (*fileVersionCatalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := &fileVersionCatalog{memory: NewVersionCatalog(), path: path, file: file}
+	if err := fc.load(); err != nil {
+		fc.file.Close()
+		return nil, err
+	}
+	return fc, nil
+}
+
+type fileVersionCatalog struct {
+	memory *inMemoryVersionCatalog
+	path   string
+	// mu serializes appends to the file
+	mu   sync.Mutex
+	file *os.File
+}
+
+// versionRecord is a line of the file: a copied version, or the removal of a pruned one
+type versionRecord struct {
+	model.FileVersion
+	Pruned bool `json:"pruned,omitempty"`
+}
+
+func (fc *fileVersionCatalog) Add(version model.FileVersion) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.append(versionRecord{FileVersion: version}); err != nil {
+		return err
+	}
+	return fc.memory.Add(version)
+}
+
+func (fc *fileVersionCatalog) Versions(fileId model.FileId) []model.FileVersion {
+	return fc.memory.Versions(fileId)
+}
+
+func (fc *fileVersionCatalog) Remove(fileId model.FileId, version int) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.append(versionRecord{FileVersion: model.FileVersion{FileId: fileId, Version: version}, Pruned: true}); err != nil {
+		return err
+	}
+	return fc.memory.Remove(fileId, version)
+}
+
+func (fc *fileVersionCatalog) FileIds() []model.FileId {
+	return fc.memory.FileIds()
+}
+
+// Close closes the file
+func (fc *fileVersionCatalog) Close() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.file.Close()
+}
+
+// append writes a record to the end of the file.  Must be called with mu held.
+func (fc *fileVersionCatalog) append(record versionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = fc.file.Write(append(data, '\n'))
+	return err
+}
+
+// load reads every record in the file and leaves it open for appending.  If the last record is
+// incomplete, the file is truncated to the end of the last complete record.
+func (fc *fileVersionCatalog) load() error {
+	var validLength int64
+	pruned := 0
+	reader := bufio.NewReader(fc.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding incomplete version record at offset %d", validLength)
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var record versionRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("Discarding corrupt version record at offset %d: %v", validLength, err)
+			break
+		}
+		if record.Pruned {
+			fc.memory.Remove(record.FileId, record.Version)
+			pruned++
+		} else {
+			fc.memory.Add(record.FileVersion)
+		}
+		validLength += int64(len(line))
+	}
+
+	if pruned > 0 {
+		return fc.compact()
+	}
+	if err := fc.file.Truncate(validLength); err != nil {
+		return err
+	}
+	_, err := fc.file.Seek(validLength, io.SeekStart)
+	return err
+}
+
+// compact rewrites the file with only the versions still in the catalog, and reopens it for appending.  The
+// versions are written to a temporary file and renamed into place, so a crash leaves either the old or the
+// new file.
+func (fc *fileVersionCatalog) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(fc.path), filepath.Base(fc.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, fileId := range fc.memory.FileIds() {
+		for _, version := range fc.memory.Versions(fileId) {
+			if err := encoder.Encode(versionRecord{FileVersion: version}); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fc.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fc.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fc.file.Close()
+	fc.file = file
+	return nil
+}
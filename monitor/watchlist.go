@@ -0,0 +1,202 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/samber/lo"
+)
+
+// The watchlist can be changed while the monitor is running.  A sweep resolves the watchlist as it was
+// when the sweep started, so a change takes effect from the next sweep and never disturbs one in progress.
+//
+// Removing an id from the watchlist stops it being watched but keeps its history: the cache entries of the
+// file, or of the files beneath the directory, are left in place, and their copies are untouched.  The
+// files become unwatched once the next complete sweep no longer finds them, and if an id is added back
+// later, its files carry on from the versions already in the cache rather than being copied again.
+
+// WatchlistStore persists the watchlist, so that changes made while the monitor is running survive a restart
+type WatchlistStore interface {
+	// Load returns the saved watchlist, and whether one has been saved
+	Load() (entries []model.WatchEntry, found bool, err error)
+	// Save replaces the saved watchlist
+	Save(entries []model.WatchEntry) error
+}
+
+// SetWatchlistStore sets the store that every change to the watchlist is saved to.  It must be called
+// before Start.
+func (m *Monitor) SetWatchlistStore(store WatchlistStore) {
+	m.watchlistStore = store
+}
+
+// Watchlist returns the ids in the watchlist, sorted
+func (m *Monitor) Watchlist() []model.FileId {
+	m.watchlistMu.RLock()
+	defer m.watchlistMu.RUnlock()
+	fileIds := lo.Keys(m.watchlist)
+	slices.Sort(fileIds)
+	return fileIds
+}
+
+// WatchEntries returns the entries in the watchlist with their options, sorted by id
+func (m *Monitor) WatchEntries() []model.WatchEntry {
+	m.watchlistMu.RLock()
+	defer m.watchlistMu.RUnlock()
+	return watchEntries(m.watchlist)
+}
+
+// AddToWatchlist adds the given ids to the watchlist, from the next sweep, watching the whole tree beneath
+// them.  Ids already in the watchlist are ignored.  If the watchlist can't be saved, it is left unchanged
+// and the error is returned.
+func (m *Monitor) AddToWatchlist(fileIds ...model.FileId) error {
+	return m.changeWatchlist(func(watchlist map[model.FileId]model.WatchOptions) {
+		for _, fileId := range fileIds {
+			if _, ok := watchlist[fileId]; !ok {
+				watchlist[fileId] = model.WatchOptions{}
+			}
+		}
+	})
+}
+
+// Watch adds the given entries to the watchlist, from the next sweep, replacing the options of any already
+// in it.  If an entry has a bad pattern, or the watchlist can't be saved, the watchlist is left unchanged
+// and the error is returned.
+func (m *Monitor) Watch(entries ...model.WatchEntry) error {
+	for _, entry := range entries {
+		if err := validateOptions(entry.WatchOptions); err != nil {
+			return fmt.Errorf("watching %v: %w", entry.Id, err)
+		}
+	}
+	return m.changeWatchlist(func(watchlist map[model.FileId]model.WatchOptions) {
+		for _, entry := range entries {
+			watchlist[entry.Id] = entry.WatchOptions
+		}
+	})
+}
+
+// RemoveFromWatchlist removes the given ids from the watchlist, from the next sweep, keeping their history
+// in the cache.  Ids not in the watchlist are ignored.  If the watchlist can't be saved, it is left
+// unchanged and the error is returned.
+func (m *Monitor) RemoveFromWatchlist(fileIds ...model.FileId) error {
+	return m.changeWatchlist(func(watchlist map[model.FileId]model.WatchOptions) {
+		for _, fileId := range fileIds {
+			delete(watchlist, fileId)
+		}
+	})
+}
+
+// changeWatchlist applies the change to a copy of the watchlist, saves it, and then replaces the watchlist
+// with it, telling the change sources that follow the watchlist which ids were added and removed.  Changes
+// are serialized by changeMu, so they're saved and passed on in the order they're applied, while
+// watchlistMu is only held to swap the watchlist in.
+func (m *Monitor) changeWatchlist(change func(watchlist map[model.FileId]model.WatchOptions)) error {
+	m.changeMu.Lock()
+	defer m.changeMu.Unlock()
+
+	// Only changes replace the watchlist, so it can be read without watchlistMu while changeMu is held
+	previous := m.watchlist
+	watchlist := maps.Clone(previous)
+	change(watchlist)
+
+	if m.watchlistStore != nil {
+		if err := m.watchlistStore.Save(watchEntries(watchlist)); err != nil {
+			return err
+		}
+	}
+	m.watchlistMu.Lock()
+	m.watchlist = watchlist
+	m.watchlistMu.Unlock()
+
+	added, removed := lo.Difference(lo.Keys(watchlist), lo.Keys(previous))
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	for _, source := range m.watchlistSources {
+		source.UpdateWatchlist(added, removed)
+	}
+	return nil
+}
+
+// inWatchlist returns whether the id is in the watchlist
+func (m *Monitor) inWatchlist(fileId model.FileId) bool {
+	m.watchlistMu.RLock()
+	defer m.watchlistMu.RUnlock()
+	_, ok := m.watchlist[fileId]
+	return ok
+}
+
+// watchOptions returns the options of the id, if it's in the watchlist
+func (m *Monitor) watchOptions(fileId model.FileId) (model.WatchOptions, bool) {
+	m.watchlistMu.RLock()
+	defer m.watchlistMu.RUnlock()
+	options, ok := m.watchlist[fileId]
+	return options, ok
+}
+
+// watchEntries returns the entries of the watchlist, sorted by id
+func watchEntries(watchlist map[model.FileId]model.WatchOptions) []model.WatchEntry {
+	entries := make([]model.WatchEntry, 0, len(watchlist))
+	for fileId, options := range watchlist {
+		entries = append(entries, model.WatchEntry{Id: fileId, WatchOptions: options})
+	}
+	slices.SortFunc(entries, func(a, b model.WatchEntry) int { return strings.Compare(string(a.Id), string(b.Id)) })
+	return entries
+}
+
+////////////////////////
+// IMPLEMENTATION     //
+////////////////////////
+
+// NewFileWatchlistStore creates a watchlist store that keeps the watchlist in the given file as a JSON
+// array, with each entry written as just its id unless it has options.  The file is replaced through a
+// temporary file that is renamed into place, so a crash leaves either the old or the new watchlist.
+func NewFileWatchlistStore(path string) *fileWatchlistStore {
+	return &fileWatchlistStore{path: path}
+}
+
+type fileWatchlistStore struct {
+	path string
+}
+
+func (s *fileWatchlistStore) Load() (entries []model.WatchEntry, found bool, err error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, false, err
+	}
+	return entries, true, nil
+}
+
+func (s *fileWatchlistStore) Save(entries []model.WatchEntry) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(entries); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jsfinn/enfi-assessment/mock"
+	"github.com/jsfinn/enfi-assessment/model"
+	"github.com/jsfinn/enfi-assessment/monitor"
+	"github.com/samber/lo"
+)
+
+const watchlistUsage = "usage: watchlist list | watchlist add fileId ... | watchlist remove fileId ..."
+
+// runWatchlist inspects or changes the saved watchlist, which the monitor picks up the next time it starts:
+//
+//	watchlist list                lists the saved watchlist
+//	watchlist add fileId ...      adds the ids to the saved watchlist
+//	watchlist remove fileId ...   removes the ids from the saved watchlist, keeping their history
+//
+// Until a change has been saved, the watchlist starts out as the one in the datafile or the local config.
+func runWatchlist(config *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(watchlistUsage)
+	}
+	if config.WatchlistFile == "" {
+		return errors.New("the watchlist is only saved when watchlist_file is set")
+	}
+
+	store := monitor.NewFileWatchlistStore(config.WatchlistFile)
+	watchlist, found, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("loading watchlist: %w", err)
+	}
+	if !found {
+		if watchlist, err = configuredWatchlist(config); err != nil {
+			return err
+		}
+	}
+
+	fileIds := lo.Map(args[1:], func(fileId string, _ int) model.FileId { return model.FileId(fileId) })
+	switch args[0] {
+	case "list":
+		for _, entry := range watchlist {
+			if entry.IsZero() {
+				fmt.Println(entry.Id)
+				continue
+			}
+			options, _ := json.Marshal(entry.WatchOptions)
+			fmt.Printf("%v %s\n", entry.Id, options)
+		}
+		return nil
+	case "add":
+		for _, fileId := range lo.Without(fileIds, model.WatchEntryIds(watchlist)...) {
+			watchlist = append(watchlist, model.WatchEntry{Id: fileId})
+		}
+	case "remove":
+		watchlist = lo.Reject(watchlist, func(entry model.WatchEntry, _ int) bool { return slices.Contains(fileIds, entry.Id) })
+	default:
+		return errors.New(watchlistUsage)
+	}
+
+	slices.SortFunc(watchlist, func(a, b model.WatchEntry) int { return strings.Compare(string(a.Id), string(b.Id)) })
+	if err := store.Save(watchlist); err != nil {
+		return fmt.Errorf("saving watchlist: %w", err)
+	}
+	fmt.Printf("%d ids in the watchlist\n", len(watchlist))
+	return nil
+}
+
+// configuredWatchlist returns the watchlist from the datafile or the local config
+func configuredWatchlist(config *Config) ([]model.WatchEntry, error) {
+	switch config.Provider {
+	case "", "mock":
+		_, watchlist, _, err := mock.NewFileProviderFromFile(config.Datafile)
+		return watchlist, err
+	case "local":
+		return config.Local.Watchlist, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", config.Provider)
+	}
+}